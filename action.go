@@ -13,3 +13,9 @@ type Event[Data any, Id any] struct {
 	IDs    []Id   `json:"ids,omitempty"`
 	Data   []Data `json:"data,omitempty"`
 }
+
+// Tombstone tells whether the event deletes its entities, keyed messages
+// carrying such events should be pushed as tombstones on compacted topics
+func (e Event[Data, Id]) Tombstone() bool {
+	return e.Action == ActionDelete
+}
@@ -0,0 +1,209 @@
+package cdc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/yang-zzhong/go-push"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// rowsKey is the instance key of the rows a statement is about to change
+const rowsKey = "push:cdc_rows"
+
+type capture[Model any, PK comparable] struct {
+	topic string
+	id    func(*Model) PK
+	captureOptions
+}
+
+func (c *capture[Model, PK]) topicName() string {
+	return c.topic
+}
+
+func (c *capture[Model, PK]) created(db *gorm.DB) ([]push.PushMessage, error) {
+	if db.Statement.ReflectValue.Kind() == reflect.Map {
+		return nil, fmt.Errorf("cdc: rows of %s created from a map aren't captured", db.Statement.Schema.Name)
+	}
+	rows := rowsOf[Model](db.Statement.ReflectValue)
+	return c.messages(push.ActionCreate, c.ids(rows), rows)
+}
+
+// before finds the rows the statement of db is about to change: the rows
+// of its value with an id, as the conditions of the statement match
+// them, or the rows its conditions match
+func (c *capture[Model, PK]) before(db *gorm.DB) error {
+	var rows []Model
+	var zero PK
+	for _, row := range rowsOf[Model](db.Statement.ReflectValue) {
+		if c.id(&row) != zero {
+			rows = append(rows, row)
+		}
+	}
+	where, ok := db.Statement.Clauses["WHERE"].Expression.(clause.Where)
+	if !ok && (len(rows) > 0 || !db.AllowGlobalUpdate) {
+		db.InstanceSet(rowsKey, rows)
+		return nil
+	}
+	tx := c.query(db)
+	if ok {
+		tx = tx.Clauses(where)
+	}
+	if len(rows) > 0 {
+		cond, err := primaryCondition(db, rows)
+		if err != nil {
+			return err
+		}
+		tx = tx.Clauses(clause.Where{Exprs: []clause.Expression{cond}})
+	}
+	var found []Model
+	if err := tx.Find(&found).Error; err != nil {
+		return fmt.Errorf("cdc: find rows of %s changing: %w", db.Statement.Schema.Name, err)
+	}
+	db.InstanceSet(rowsKey, found)
+	return nil
+}
+
+// changing returns the rows found before the statement of db changed them
+func (c *capture[Model, PK]) changing(db *gorm.DB) []Model {
+	rows, _ := db.InstanceGet(rowsKey)
+	found, _ := rows.([]Model)
+	return found
+}
+
+// updated reads the rows updated again, as the statement of db may update
+// some of the columns only
+func (c *capture[Model, PK]) updated(db *gorm.DB) ([]push.PushMessage, error) {
+	rows := c.changing(db)
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	cond, err := primaryCondition(db, rows)
+	if err != nil {
+		return nil, err
+	}
+	var data []Model
+	if err := c.query(db).Clauses(clause.Where{Exprs: []clause.Expression{cond}}).Find(&data).Error; err != nil {
+		return nil, fmt.Errorf("cdc: find rows of %s updated: %w", db.Statement.Schema.Name, err)
+	}
+	return c.messages(push.ActionUpdate, c.ids(data), data)
+}
+
+func (c *capture[Model, PK]) deleted(db *gorm.DB) ([]push.PushMessage, error) {
+	return c.messages(push.ActionDelete, c.ids(c.changing(db)), nil)
+}
+
+// query is a query of the table of the statement of db, in its transaction
+func (c *capture[Model, PK]) query(db *gorm.DB) *gorm.DB {
+	tx := db.Session(&gorm.Session{NewDB: true}).Table(db.Statement.Table)
+	if db.Statement.Unscoped {
+		tx = tx.Unscoped()
+	}
+	return tx
+}
+
+func (c *capture[Model, PK]) ids(rows []Model) []PK {
+	ids := make([]PK, len(rows))
+	for i := range rows {
+		ids[i] = c.id(&rows[i])
+	}
+	return ids
+}
+
+// messages returns the messages of the event of the rows of ids changed,
+// data holding the rows unless they're deleted
+func (c *capture[Model, PK]) messages(action push.Action, ids []PK, data []Model) ([]push.PushMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if !c.perRow {
+		msg, err := message(push.Event[Model, PK]{Action: action, IDs: ids, Data: data})
+		if err != nil {
+			return nil, err
+		}
+		return []push.PushMessage{msg}, nil
+	}
+	msgs := make([]push.PushMessage, len(ids))
+	for i := range ids {
+		e := push.Event[Model, PK]{Action: action, IDs: ids[i : i+1]}
+		if data != nil {
+			e.Data = data[i : i+1]
+		}
+		msg, err := message(e)
+		if err != nil {
+			return nil, err
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+func message[Model any, PK comparable](e push.Event[Model, PK]) (push.PushMessage, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return push.PushMessage{}, fmt.Errorf("cdc: encode event: %w", err)
+	}
+	msg := push.PushMessage{Data: string(data)}
+	if len(e.IDs) == 1 {
+		msg.Key = fmt.Sprint(e.IDs[0])
+		msg.Tombstone = e.Tombstone()
+	}
+	return msg, nil
+}
+
+// rowsOf returns the rows of v, a model, a slice or an array of models or
+// of pointers to them
+func rowsOf[Model any](v reflect.Value) []Model {
+	v = reflect.Indirect(v)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		rows := make([]Model, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if row, ok := reflect.Indirect(v.Index(i)).Interface().(Model); ok {
+				rows = append(rows, row)
+			}
+		}
+		return rows
+	case reflect.Struct:
+		if row, ok := v.Interface().(Model); ok {
+			return []Model{row}
+		}
+	}
+	return nil
+}
+
+// primaryCondition is the condition matching rows by their primary keys
+func primaryCondition[Model any](db *gorm.DB, rows []Model) (clause.Expression, error) {
+	s := db.Statement.Schema
+	if len(s.PrimaryFields) == 0 {
+		return nil, fmt.Errorf("cdc: %s has no primary key", s.Name)
+	}
+	ctx := db.Statement.Context
+	values := reflect.ValueOf(rows)
+	column := func(f string) clause.Column {
+		return clause.Column{Table: clause.CurrentTable, Name: f}
+	}
+	if len(s.PrimaryFields) == 1 {
+		f := s.PrimaryFields[0]
+		keys := make([]any, len(rows))
+		for i := range rows {
+			keys[i], _ = f.ValueOf(ctx, values.Index(i))
+		}
+		return clause.IN{Column: column(f.DBName), Values: keys}, nil
+	}
+	conds := make([]clause.Expression, len(rows))
+	for i := range rows {
+		eqs := make([]clause.Expression, len(s.PrimaryFields))
+		for j, f := range s.PrimaryFields {
+			key, _ := f.ValueOf(ctx, values.Index(i))
+			eqs[j] = clause.Eq{Column: column(f.DBName), Value: key}
+		}
+		conds[i] = clause.And(eqs...)
+	}
+	if len(conds) == 1 {
+		return conds[0], nil
+	}
+	return clause.Or(conds...), nil
+}
@@ -0,0 +1,243 @@
+// Package cdc captures the rows gorm creates, updates and deletes for the
+// models registered, and publishes the changes as push.Event to a topic per
+// model. A Projector applies such events to a table of another service,
+// which mirrors the table they're captured from
+package cdc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/yang-zzhong/go-push"
+	"github.com/yang-zzhong/go-push/outbox"
+	"gorm.io/gorm"
+)
+
+// Publisher publishes the messages of the changes made by a statement. tx
+// is the db of the statement, in its transaction unless the default
+// transaction is skipped. The statement fails with the error returned
+type Publisher interface {
+	Publish(tx *gorm.DB, topic string, msgs []push.PushMessage) error
+}
+
+// PublisherFunc is a function publishing as a Publisher
+type PublisherFunc func(tx *gorm.DB, topic string, msgs []push.PushMessage) error
+
+func (f PublisherFunc) Publish(tx *gorm.DB, topic string, msgs []push.PushMessage) error {
+	return f(tx, topic, msgs)
+}
+
+// Outbox writes the messages to the outbox in the transaction of the
+// statement, they're published by an outbox.Relay once it commits. It's
+// the publisher to use when the changes and their events must agree
+func Outbox() Publisher {
+	return PublisherFunc(func(tx *gorm.DB, topic string, msgs []push.PushMessage) error {
+		entries := make([]outbox.Entry, len(msgs))
+		for i, msg := range msgs {
+			entries[i] = outbox.Entry{Topic: topic, PushMessage: msg}
+		}
+		return outbox.Write(tx.Session(&gorm.Session{NewDB: true}), entries...)
+	})
+}
+
+// ErrInTransaction is the error of a statement run in a transaction of
+// the application with a publisher publishing after commit, which the
+// plugin can't tell. Outbox publishes such statements
+var ErrInTransaction = errors.New("cdc: publishing after commit in a transaction")
+
+// afterCommit is a publisher publishing once the statement commits
+type afterCommit struct {
+	Publisher
+}
+
+// AfterCommit publishes with p once the transaction of the statement
+// commits, nothing is published for a statement rolled back. A statement in
+// a transaction of the application fails with ErrInTransaction. A change
+// committed whose publishing fails isn't published, the statement fails
+// with the error still
+func AfterCommit(p Publisher) Publisher {
+	return afterCommit{p}
+}
+
+// Client pushes the messages with c once the statement commits, see
+// AfterCommit
+func Client(c *push.HTTPClient) Publisher {
+	return AfterCommit(PublisherFunc(func(tx *gorm.DB, topic string, msgs []push.PushMessage) error {
+		return c.PushMessages(topic, msgs)
+	}))
+}
+
+// Producer sends the messages with p once the statement commits, see
+// AfterCommit. They're pushed in the background, the events failing to be
+// pushed are reported as the deliveries of p
+func Producer(p *push.AsyncProducer) Publisher {
+	return AfterCommit(PublisherFunc(func(tx *gorm.DB, topic string, msgs []push.PushMessage) error {
+		for _, msg := range msgs {
+			if err := p.Send(tx.Statement.Context, topic, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// Plugin is the gorm plugin capturing the changes of the models registered
+// with Capture. Changes made with raw SQL aren't captured
+type Plugin struct {
+	publisher Publisher
+	lock      sync.RWMutex
+	models    map[reflect.Type]capturer
+}
+
+func New(publisher Publisher) *Plugin {
+	return &Plugin{publisher: publisher, models: make(map[reflect.Type]capturer)}
+}
+
+func (p *Plugin) Name() string {
+	return "push:cdc"
+}
+
+// Initialize registers the callbacks of the plugin with db, the changes
+// are published before the default transaction of a statement commits, or
+// after with AfterCommit
+func (p *Plugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:commit_or_rollback_transaction").Register("push:cdc_after_create", p.afterCreate),
+		cb.Create().After("gorm:commit_or_rollback_transaction").Register("push:cdc_after_create_commit", p.afterCommit),
+		cb.Update().After("gorm:setup_reflect_value").Before("gorm:update").Register("push:cdc_before_update", p.before),
+		cb.Update().Before("gorm:commit_or_rollback_transaction").Register("push:cdc_after_update", p.afterUpdate),
+		cb.Update().After("gorm:commit_or_rollback_transaction").Register("push:cdc_after_update_commit", p.afterCommit),
+		cb.Delete().Before("gorm:delete").Register("push:cdc_before_delete", p.before),
+		cb.Delete().Before("gorm:commit_or_rollback_transaction").Register("push:cdc_after_delete", p.afterDelete),
+		cb.Delete().After("gorm:commit_or_rollback_transaction").Register("push:cdc_after_delete_commit", p.afterCommit),
+	)
+}
+
+// CaptureOption configures the capture of a model
+type CaptureOption func(o *captureOptions)
+
+type captureOptions struct {
+	perRow bool
+}
+
+// PerRow publishes an event for each row changed, keyed by its id as
+// compacted topics need, rather than an event for each statement
+func PerRow() CaptureOption {
+	return func(o *captureOptions) {
+		o.perRow = true
+	}
+}
+
+// Capture registers Model with p, the rows of Model changed are published
+// to topic as push.Event[Model, PK], id telling the primary key of a row.
+// A statement changing rows publishes an event keyed by the id of the row
+// when it changes a single one. Models are registered before p is used
+func Capture[Model any, PK comparable](p *Plugin, topic string, id func(*Model) PK, opts ...CaptureOption) error {
+	if err := push.ValidateTopicName(topic); err != nil {
+		return err
+	}
+	if id == nil {
+		return errors.New("cdc: no id of the model")
+	}
+	t := reflect.TypeOf((*Model)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("cdc: model %s isn't a struct", t)
+	}
+	c := &capture[Model, PK]{topic: topic, id: id}
+	for _, opt := range opts {
+		opt(&c.captureOptions)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.models[t] = c
+	return nil
+}
+
+// capturer captures the changes of a model registered
+type capturer interface {
+	created(db *gorm.DB) ([]push.PushMessage, error)
+	// before remembers the rows the statement of db is about to change
+	before(db *gorm.DB) error
+	updated(db *gorm.DB) ([]push.PushMessage, error)
+	deleted(db *gorm.DB) ([]push.PushMessage, error)
+	topicName() string
+}
+
+func (p *Plugin) capturer(db *gorm.DB) capturer {
+	if db.Error != nil || db.DryRun || db.Statement.Schema == nil {
+		return nil
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.models[db.Statement.Schema.ModelType]
+}
+
+func (p *Plugin) before(db *gorm.DB) {
+	if c := p.capturer(db); c != nil {
+		db.AddError(c.before(db))
+	}
+}
+
+func (p *Plugin) afterCreate(db *gorm.DB) {
+	if c := p.capturer(db); c != nil {
+		p.publish(db, c, c.created)
+	}
+}
+
+func (p *Plugin) afterUpdate(db *gorm.DB) {
+	if c := p.capturer(db); c != nil && db.RowsAffected > 0 {
+		p.publish(db, c, c.updated)
+	}
+}
+
+func (p *Plugin) afterDelete(db *gorm.DB) {
+	if c := p.capturer(db); c != nil && db.RowsAffected > 0 {
+		p.publish(db, c, c.deleted)
+	}
+}
+
+func (p *Plugin) publish(db *gorm.DB, c capturer, messages func(*gorm.DB) ([]push.PushMessage, error)) {
+	msgs, err := messages(db)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	if _, ok := p.publisher.(afterCommit); ok {
+		_, started := db.InstanceGet("gorm:started_transaction")
+		if _, inTx := db.Statement.ConnPool.(gorm.TxCommitter); inTx && !started {
+			db.AddError(ErrInTransaction)
+			return
+		}
+		db.InstanceSet(pendingKey, &pending{topic: c.topicName(), msgs: msgs})
+		return
+	}
+	if err := p.publisher.Publish(db, c.topicName(), msgs); err != nil {
+		db.AddError(fmt.Errorf("cdc: publish to [%s]: %w", c.topicName(), err))
+	}
+}
+
+// pendingKey is the instance key of the messages of a statement published
+// once it commits
+const pendingKey = "push:cdc_pending"
+
+type pending struct {
+	topic string
+	msgs  []push.PushMessage
+}
+
+func (p *Plugin) afterCommit(db *gorm.DB) {
+	v, ok := db.InstanceGet(pendingKey)
+	if !ok || db.Error != nil {
+		return
+	}
+	pub := v.(*pending)
+	if err := p.publisher.(afterCommit).Publish(db, pub.topic, pub.msgs); err != nil {
+		db.AddError(fmt.Errorf("cdc: publish to [%s]: %w", pub.topic, err))
+	}
+}
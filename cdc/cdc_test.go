@@ -0,0 +1,208 @@
+package cdc_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+	"github.com/yang-zzhong/go-push/cdc"
+	"github.com/yang-zzhong/go-push/outbox"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type order struct {
+	ID     int64 `gorm:"primarykey"`
+	Amount int
+	Note   string
+}
+
+type published struct {
+	topic string
+	msg   push.PushMessage
+}
+
+func orderID(o *order) int64 {
+	return o.ID
+}
+
+func setup(t *testing.T, publisher cdc.Publisher, opts ...cdc.CaptureOption) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "app.db")))
+	assert.Nil(t, err)
+	p := cdc.New(publisher)
+	assert.Nil(t, cdc.Capture(p, "cdc-orders", orderID, opts...))
+	assert.Nil(t, db.Use(p))
+	assert.Nil(t, db.AutoMigrate(&order{}))
+	return db
+}
+
+func recorder(msgs *[]published) cdc.Publisher {
+	return cdc.PublisherFunc(func(tx *gorm.DB, topic string, batch []push.PushMessage) error {
+		for _, msg := range batch {
+			*msgs = append(*msgs, published{topic: topic, msg: msg})
+		}
+		return nil
+	})
+}
+
+func event(t *testing.T, msg push.PushMessage) push.Event[order, int64] {
+	var e push.Event[order, int64]
+	assert.Nil(t, json.Unmarshal([]byte(msg.Data), &e))
+	return e
+}
+
+func TestCapture(t *testing.T) {
+	var msgs []published
+	db := setup(t, recorder(&msgs))
+
+	o := order{Amount: 1}
+	assert.Nil(t, db.Create(&o).Error)
+	assert.Nil(t, db.Create(&[]order{{Amount: 2}, {Amount: 3}}).Error)
+	o.Amount = 10
+	assert.Nil(t, db.Save(&o).Error)
+	// the event carries the rows as updated, not the columns set only
+	assert.Nil(t, db.Model(&order{}).Where("amount > ?", 1).Update("note", "big").Error)
+	assert.Nil(t, db.Delete(&order{}, o.ID).Error)
+	assert.Nil(t, db.Where("amount = ?", 2).Delete(&order{}).Error)
+	// no rows changed, no event
+	assert.Nil(t, db.Where("amount = ?", 100).Delete(&order{}).Error)
+
+	assert.Equal(t, 6, len(msgs))
+	for _, m := range msgs {
+		assert.Equal(t, "cdc-orders", m.topic)
+	}
+	e := event(t, msgs[0].msg)
+	assert.Equal(t, push.ActionCreate, e.Action)
+	assert.Equal(t, []int64{1}, e.IDs)
+	assert.Equal(t, []order{{ID: 1, Amount: 1}}, e.Data)
+	assert.Equal(t, "1", msgs[0].msg.Key)
+
+	e = event(t, msgs[1].msg)
+	assert.Equal(t, push.ActionCreate, e.Action)
+	assert.Equal(t, []int64{2, 3}, e.IDs)
+	assert.Equal(t, "", msgs[1].msg.Key)
+
+	e = event(t, msgs[2].msg)
+	assert.Equal(t, push.ActionUpdate, e.Action)
+	assert.Equal(t, []order{{ID: 1, Amount: 10}}, e.Data)
+
+	e = event(t, msgs[3].msg)
+	assert.Equal(t, push.ActionUpdate, e.Action)
+	assert.Equal(t, []int64{1, 2, 3}, e.IDs)
+	assert.Equal(t, []order{{ID: 1, Amount: 10, Note: "big"}, {ID: 2, Amount: 2, Note: "big"}, {ID: 3, Amount: 3, Note: "big"}}, e.Data)
+
+	e = event(t, msgs[4].msg)
+	assert.Equal(t, push.ActionDelete, e.Action)
+	assert.Equal(t, []int64{1}, e.IDs)
+	assert.Nil(t, e.Data)
+	assert.True(t, msgs[4].msg.Tombstone)
+
+	e = event(t, msgs[5].msg)
+	assert.Equal(t, []int64{2}, e.IDs)
+}
+
+func TestCapture_perRow(t *testing.T) {
+	var msgs []published
+	db := setup(t, recorder(&msgs), cdc.PerRow())
+	assert.Nil(t, db.Create(&[]order{{Amount: 1}, {Amount: 2}}).Error)
+	assert.Nil(t, db.Where("1 = 1").Delete(&order{}).Error)
+	assert.Equal(t, 4, len(msgs))
+	for i, key := range []string{"1", "2", "1", "2"} {
+		assert.Equal(t, key, msgs[i].msg.Key)
+		assert.Equal(t, 1, len(event(t, msgs[i].msg).IDs))
+	}
+	assert.Equal(t, []order{{ID: 2, Amount: 2}}, event(t, msgs[1].msg).Data)
+	assert.True(t, msgs[3].msg.Tombstone)
+}
+
+func TestCapture_publishFails(t *testing.T) {
+	failed := errors.New("broker down")
+	db := setup(t, cdc.PublisherFunc(func(*gorm.DB, string, []push.PushMessage) error {
+		return failed
+	}))
+	err := db.Create(&order{Amount: 1}).Error
+	assert.True(t, errors.Is(err, failed))
+	// the row isn't created without its event
+	var n int64
+	assert.Nil(t, db.Model(&order{}).Count(&n).Error)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestCapture_afterCommit(t *testing.T) {
+	var db *gorm.DB
+	var msgs []published
+	var seen []int64
+	db = setup(t, cdc.AfterCommit(cdc.PublisherFunc(func(tx *gorm.DB, topic string, batch []push.PushMessage) error {
+		// the rows are committed by then
+		var n int64
+		if err := db.Model(&order{}).Count(&n).Error; err != nil {
+			return err
+		}
+		seen = append(seen, n)
+		return recorder(&msgs).Publish(tx, topic, batch)
+	})))
+	assert.Nil(t, db.Create(&order{Amount: 1}).Error)
+	assert.Equal(t, []int64{1}, seen)
+	assert.Equal(t, 1, len(msgs))
+
+	// the plugin can't tell when a transaction of the application commits
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&order{Amount: 2}).Error
+	})
+	assert.True(t, errors.Is(err, cdc.ErrInTransaction))
+	var n int64
+	assert.Nil(t, db.Model(&order{}).Count(&n).Error)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, 1, len(msgs))
+}
+
+func TestCapture_afterCommitFails(t *testing.T) {
+	failed := errors.New("broker down")
+	db := setup(t, cdc.AfterCommit(cdc.PublisherFunc(func(*gorm.DB, string, []push.PushMessage) error {
+		return failed
+	})))
+	assert.True(t, errors.Is(db.Create(&order{Amount: 1}).Error, failed))
+	// the row is committed without its event
+	var n int64
+	assert.Nil(t, db.Model(&order{}).Count(&n).Error)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestCapture_outbox(t *testing.T) {
+	db := setup(t, cdc.Outbox())
+	assert.Nil(t, outbox.Migrate(db))
+	failed := errors.New("failed")
+	assert.Equal(t, failed, db.Transaction(func(tx *gorm.DB) error {
+		assert.Nil(t, tx.Create(&order{Amount: 1}).Error)
+		return failed
+	}))
+	assert.Nil(t, db.Transaction(func(tx *gorm.DB) error {
+		o := order{Amount: 2}
+		if err := tx.Create(&o).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&o).Error
+	}))
+
+	s := push.NewMemoryStorage()
+	srv := httptest.NewServer(push.NewHTTPHandler(s, logf.New()))
+	defer srv.Close()
+	n, err := outbox.NewRelay(db, &push.HTTPClient{Endpoint: srv.URL}).Relay(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	msgs, err := s.Get(context.Background(), "cdc-orders", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+	var e push.Event[order, int64]
+	assert.Nil(t, json.Unmarshal(msgs[0].Data, &e))
+	assert.Equal(t, push.ActionCreate, e.Action)
+	assert.Equal(t, []order{{ID: 1, Amount: 2}}, e.Data)
+	assert.Nil(t, json.Unmarshal(msgs[1].Data, &e))
+	assert.Equal(t, push.ActionDelete, e.Action)
+}
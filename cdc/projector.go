@@ -0,0 +1,128 @@
+package cdc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/yang-zzhong/go-push"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Projector applies the push.Event[Data, Id] of a topic to the table of
+// Data, as a mirror of the table the events are captured from. Each event
+// is applied in a transaction together with the offset of the subscriber,
+// kept in the same db, so that an event is applied once however often it's
+// delivered. Creates and updates are upserts of the rows of the events,
+// deletes delete the rows by their single primary key
+type Projector[Data any, Id any] struct {
+	db         *gorm.DB
+	client     *push.HTTPClient
+	topic      string
+	subscriber string
+}
+
+func NewProjector[Data any, Id any](db *gorm.DB, c *push.HTTPClient, topic, subscriber string) *Projector[Data, Id] {
+	return &Projector[Data, Id]{db: db, client: c, topic: topic, subscriber: subscriber}
+}
+
+// Migrate creates or updates the table of Data and the one of the offsets
+func (p *Projector[Data, Id]) Migrate() error {
+	return p.db.AutoMigrate(new(Data), &push.TopicReadOffset{})
+}
+
+// Run subscribes to the topic and applies its events until ctx is done or
+// an error isn't retried, as HTTPClient.SubscribeMessages does. An event
+// failing to be applied is delivered again. Events are applied one by one
+// whatever workers opts set. The subscription resumes from the offsets
+// Apply keeps in the db, whatever the OffsetStorage of the client is
+func (p *Projector[Data, Id]) Run(ctx context.Context, opts ...push.SubscribeOption) error {
+	c := &push.HTTPClient{
+		Endpoint:      p.client.Endpoint,
+		APIKey:        p.client.APIKey,
+		OffsetStorage: projectorOffsets{db: p.db},
+		TLS:           p.client.TLS,
+		Underlying:    p.client.Underlying,
+		Logfer:        p.client.Logfer,
+	}
+	opts = append(opts, push.SubscribeWorkers(1, false))
+	return c.SubscribeMessages(ctx, p.topic, p.subscriber, func(msg push.ReceivedMessage) error {
+		return p.Apply(ctx, msg)
+	}, opts...)
+}
+
+// projectorOffsets reads the offsets Apply keeps. They are set by Apply in
+// the transaction of the event, so the ones the client sets are dropped
+type projectorOffsets struct {
+	db *gorm.DB
+}
+
+func (o projectorOffsets) SetOffset(context.Context, string, string, int64) error {
+	return nil
+}
+
+func (o projectorOffsets) GetOffset(ctx context.Context, topic, subscriber string, offset *int64) error {
+	return getOffset(o.db.WithContext(ctx), topic, subscriber, offset)
+}
+
+// getOffset reads the offset of subscriber with plain queries, a projector
+// never runs the migrations of a db storage on the db of the application
+func getOffset(db *gorm.DB, topic, subscriber string, offset *int64) error {
+	var r []push.TopicReadOffset
+	if err := db.Where("topic = ? AND subscriber = ?", topic, subscriber).Limit(1).Find(&r).Error; err != nil {
+		return err
+	}
+	*offset = 0
+	if len(r) > 0 {
+		*offset = r[0].Offset
+	}
+	return nil
+}
+
+func setOffset(db *gorm.DB, topic, subscriber string, offset int64) error {
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&push.TopicReadOffset{Topic: topic, Subscriber: subscriber, Offset: offset}).Error
+}
+
+// Apply applies the event of msg unless it was, and moves the offset of
+// the subscriber past it
+func (p *Projector[Data, Id]) Apply(ctx context.Context, msg push.ReceivedMessage) error {
+	var e push.Event[Data, Id]
+	if err := json.Unmarshal([]byte(msg.Data), &e); err != nil {
+		return fmt.Errorf("projector: decode event at %d of [%s]: %w", msg.Offset, p.topic, err)
+	}
+	key := push.PartitionOffsetKey(p.topic, msg.Partition)
+	return p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var offset int64
+		if err := getOffset(tx, key, p.subscriber, &offset); err != nil {
+			return fmt.Errorf("projector: get offset: %w", err)
+		}
+		if msg.Offset < offset {
+			return nil
+		}
+		if err := p.apply(tx, e); err != nil {
+			return fmt.Errorf("projector: apply event at %d of [%s]: %w", msg.Offset, p.topic, err)
+		}
+		if err := setOffset(tx, key, p.subscriber, msg.Offset+1); err != nil {
+			return fmt.Errorf("projector: set offset: %w", err)
+		}
+		return nil
+	})
+}
+
+func (p *Projector[Data, Id]) apply(tx *gorm.DB, e push.Event[Data, Id]) error {
+	switch e.Action {
+	case push.ActionCreate, push.ActionUpdate:
+		if len(e.Data) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&e.Data).Error
+	case push.ActionDelete:
+		if len(e.IDs) == 0 {
+			return nil
+		}
+		return tx.Delete(new(Data), e.IDs).Error
+	}
+	return fmt.Errorf("unknown action %d", e.Action)
+}
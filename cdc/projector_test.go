@@ -0,0 +1,128 @@
+package cdc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+	"github.com/yang-zzhong/go-push/cdc"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func mirror(t *testing.T, c *push.HTTPClient, topic string) (*gorm.DB, *cdc.Projector[order, int64]) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "mirror.db")))
+	assert.Nil(t, err)
+	p := cdc.NewProjector[order, int64](db, c, topic, "mirror")
+	assert.Nil(t, p.Migrate())
+	return db, p
+}
+
+func orders(t *testing.T, db *gorm.DB) []order {
+	var rows []order
+	assert.Nil(t, db.Order("id").Find(&rows).Error)
+	return rows
+}
+
+// offset returns the offset the projector of mirror db keeps for topic
+func offset(t *testing.T, db *gorm.DB, topic string) int64 {
+	var r []push.TopicReadOffset
+	assert.Nil(t, db.Where("topic = ? AND subscriber = ?", topic, "mirror").Find(&r).Error)
+	if len(r) == 0 {
+		return 0
+	}
+	return r[0].Offset
+}
+
+// project runs p until it applied the events up to offset
+func project(t *testing.T, p *cdc.Projector[order, int64], db *gorm.DB, until int64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for offset(t, db, "cdc-orders") < until && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	assert.True(t, errors.Is(<-done, context.Canceled))
+	assert.Equal(t, until, offset(t, db, "cdc-orders"))
+}
+
+func TestProjector(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		resumed []string
+	)
+	handler := push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/subscribe") {
+			lock.Lock()
+			resumed = append(resumed, req.URL.Query().Get("offsets"))
+			lock.Unlock()
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	source := setup(t, cdc.Client(c))
+	db, p := mirror(t, c, "cdc-orders")
+
+	assert.Nil(t, source.Create(&[]order{{Amount: 1}, {Amount: 2}, {Amount: 3}}).Error)
+	assert.Nil(t, source.Model(&order{}).Where("amount > ?", 1).Update("note", "big").Error)
+	assert.Nil(t, source.Delete(&order{}, 1).Error)
+	assert.Nil(t, source.Create(&order{Amount: 4}).Error)
+	project(t, p, db, 4)
+	assert.Equal(t, orders(t, source), orders(t, db))
+	assert.Equal(t, []order{{ID: 2, Amount: 2, Note: "big"}, {ID: 3, Amount: 3, Note: "big"}, {ID: 4, Amount: 4}}, orders(t, db))
+
+	// restarted with a client of its own, it resumes from the offset in the db
+	assert.Nil(t, source.Delete(&order{}, 2).Error)
+	p = cdc.NewProjector[order, int64](db, &push.HTTPClient{Endpoint: srv.URL}, "cdc-orders", "mirror")
+	project(t, p, db, 5)
+	assert.Equal(t, orders(t, source), orders(t, db))
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, "0:4", resumed[len(resumed)-1])
+}
+
+func TestProjector_applyOnce(t *testing.T) {
+	db, p := mirror(t, &push.HTTPClient{}, "cdc-once")
+	ctx := context.Background()
+	created := push.ReceivedMessage{Offset: 0, Data: `{"action":0,"ids":[1],"data":[{"ID":1,"Amount":1}]}`}
+	deleted := push.ReceivedMessage{Offset: 1, Data: `{"action":2,"ids":[1]}`}
+	assert.Nil(t, p.Apply(ctx, created))
+	assert.Nil(t, p.Apply(ctx, deleted))
+	// delivered again, the creation doesn't bring the row back
+	assert.Nil(t, p.Apply(ctx, created))
+	assert.Equal(t, 0, len(orders(t, db)))
+	assert.Equal(t, int64(2), offset(t, db, "cdc-once"))
+
+	// an event failing to be applied leaves the offset as it was
+	assert.NotNil(t, p.Apply(ctx, push.ReceivedMessage{Offset: 2, Data: `{"action":7}`}))
+	assert.Equal(t, int64(2), offset(t, db, "cdc-once"))
+}
+
+func TestProjector_noMigration(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "mirror.db")))
+	assert.Nil(t, err)
+	// a table of the application looking like a topic table
+	assert.Nil(t, db.Table("q_app").AutoMigrate(&push.DBItem{}))
+	assert.Nil(t, db.AutoMigrate(&order{}))
+	p := cdc.NewProjector[order, int64](db, &push.HTTPClient{}, "cdc-unmigrated", "mirror")
+	// without the offsets of Migrate, applying fails rather than creating
+	// the tables of a broker
+	assert.NotNil(t, p.Apply(context.Background(), push.ReceivedMessage{Data: `{"action":2,"ids":[1]}`}))
+	assert.False(t, db.Migrator().HasTable(&push.DBTopic{}))
+	assert.False(t, db.Migrator().HasTable(&push.TopicReadOffset{}))
+}
@@ -1,38 +1,124 @@
 package push
 
-import "context"
+import (
+	"context"
+	"sync"
+)
 
 type SubMessage struct {
+	Partition   int      `json:"partition"`
 	StartOffset int      `json:"start_offset"`
 	Data        []string `json:"data"`
+	// Offsets holds the offset of each item of Data. Offsets are not
+	// contiguous when expired messages have been skipped
+	Offsets []int64 `json:"offsets,omitempty"`
+	// Keys holds the key of each item of Data, omitted when no item has a key
+	Keys []string `json:"keys,omitempty"`
+}
+
+type TopicMeta struct {
+	Partitions int `json:"partitions"`
+}
+
+// PushMessage is a message pushed with its own options. TTL is in seconds,
+// a message without TTL never expires
+type PushMessage struct {
+	Data      string `json:"data"`
+	TTL       int64  `json:"ttl,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Tombstone bool   `json:"tombstone,omitempty"`
+}
+
+func newSubMessage(msgs []*Message) SubMessage {
+	ret := SubMessage{
+		Data:    make([]string, len(msgs)),
+		Offsets: make([]int64, len(msgs)),
+	}
+	for i, m := range msgs {
+		ret.Data[i] = string(m.Data)
+		ret.Offsets[i] = m.Offset
+		if m.Key != "" && ret.Keys == nil {
+			ret.Keys = make([]string, len(msgs))
+		}
+		if ret.Keys != nil {
+			ret.Keys[i] = m.Key
+		}
+	}
+	if len(msgs) > 0 {
+		ret.StartOffset = int(msgs[0].Offset)
+	}
+	return ret
+}
+
+// Offset returns the offset of the ith item of Data
+func (m SubMessage) Offset(i int) int64 {
+	if i < len(m.Offsets) {
+		return m.Offsets[i]
+	}
+	return int64(m.StartOffset + i)
+}
+
+// Key returns the key of the ith item of Data
+func (m SubMessage) Key(i int) string {
+	if i < len(m.Keys) {
+		return m.Keys[i]
+	}
+	return ""
+}
+
+// Messages returns the messages of m
+func (m SubMessage) Messages() []ReceivedMessage {
+	ret := make([]ReceivedMessage, len(m.Data))
+	for i, data := range m.Data {
+		ret[i] = ReceivedMessage{Partition: m.Partition, Offset: m.Offset(i), Key: m.Key(i), Data: data}
+	}
+	return ret
+}
+
+// NextOffset returns the offset to continue with once every item of Data is handled
+func (m SubMessage) NextOffset() int64 {
+	if len(m.Data) == 0 {
+		return int64(m.StartOffset)
+	}
+	return m.Offset(len(m.Data)-1) + 1
 }
 
 type SubscribeHandler func(msg SubMessage) (currentOffset int64)
 
+// OffsetStorage keeps the offset each subscriber of a topic consumes from,
+// so that subscribers of the same topic don't move each other's offsets
 type OffsetStorage interface {
-	SetOffset(ctx context.Context, topic string, offset int64) error
-	GetOffset(ctx context.Context, topic string, offset *int64) error
+	SetOffset(ctx context.Context, topic, subscriber string, offset int64) error
+	// GetOffset returns 0 when subscriber has no offset of topic
+	GetOffset(ctx context.Context, topic, subscriber string, offset *int64) error
+}
+
+type offsetKey struct {
+	topic      string
+	subscriber string
 }
 
 type memoryOffsetStorage struct {
-	data map[string]int64
+	data map[offsetKey]int64
+	lock sync.RWMutex
 }
 
 func NewMemoryOffsetStorage() OffsetStorage {
 	return &memoryOffsetStorage{
-		data: make(map[string]int64),
+		data: make(map[offsetKey]int64),
 	}
 }
 
-func (m *memoryOffsetStorage) SetOffset(_ context.Context, topic string, offset int64) error {
-	m.data[topic] = offset
+func (m *memoryOffsetStorage) SetOffset(_ context.Context, topic, subscriber string, offset int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.data[offsetKey{topic, subscriber}] = offset
 	return nil
 }
 
-func (m *memoryOffsetStorage) GetOffset(_ context.Context, topic string, offset *int64) error {
-	if o, ok := m.data[topic]; ok {
-		*offset = o
-	}
-	*offset = 0
+func (m *memoryOffsetStorage) GetOffset(_ context.Context, topic, subscriber string, offset *int64) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	*offset = m.data[offsetKey{topic, subscriber}]
 	return nil
 }
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/dev-mockingbird/logf"
+	"github.com/spf13/pflag"
 	"github.com/yang-zzhong/go-push"
 	"github.com/yang-zzhong/go-push/config"
 	"gorm.io/driver/mysql"
@@ -15,38 +21,226 @@ import (
 
 func main() {
 	var cfg config.Config
-	logger := logf.New()
-	if err := config.ReadInput(&cfg, logger); err != nil {
+	err := config.Read(&cfg, pflag.CommandLine, os.Args[1:])
+	if pflag.Arg(0) == "config" {
+		os.Exit(configCommand(cfg, err, pflag.Arg(1)))
+	}
+	if err != nil {
 		panic(err)
 	}
-	if cfg.Logpath != "" {
-		f, err := os.OpenFile(cfg.Logpath, os.O_APPEND|os.O_CREATE, 0644)
+	if err := cfg.Validate(); err != nil {
+		panic("invalid config:\n" + err.Error())
+	}
+	// the level is filtered by the leveled logger, which follows reloads
+	logOpts := []logf.Option{logf.LogLevel(logf.Trace), logf.Caller(logf.CallerDepth + 1)}
+	if cfg.Log.Path != "" {
+		f, err := os.OpenFile(cfg.Log.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 		if err != nil {
 			panic("can't open log file: " + err.Error())
 		}
-		logger = logf.New(logf.CustomPrinter(logf.NewPrinter(f)))
+		logOpts = append(logOpts, logf.CustomPrinter(logf.NewPrinter(f)))
 	}
+	logger := newLeveledLogger(logf.New(logOpts...), cfg.Log.LogfLevel())
 	var db *gorm.DB
-	var err error
-	switch cfg.DB.DBMS {
+	var storage push.Storage
+	switch cfg.Storage.Backend {
+	case config.StorageMemory:
+		if pflag.Arg(0) == "migrate-single-table" {
+			panic("can't migrate the memory storage")
+		}
+		storage = push.NewMemoryStorage()
+	case config.StorageDB:
+		if db, err = openDB(cfg.Storage.DB); err != nil {
+			panic("can't open DB: " + err.Error())
+		}
+		if pflag.Arg(0) == "migrate-single-table" {
+			if err := push.MigrateToSingleTable(db); err != nil {
+				panic("can't migrate to single table: " + err.Error())
+			}
+			logger.Logf(logf.Info, "moved topic tables into the messages table")
+			return
+		}
+		layout := push.WithDBLayout(push.DBLayout(cfg.Storage.DB.Layout))
+		if err := push.MigrateDB(db, layout); err != nil {
+			panic("can't migrate DB: " + err.Error())
+		}
+		storage = push.NewDBStorage(db, layout)
+	}
+	for _, t := range cfg.Topics {
+		if err := push.DeclareTopic(t.Name, t.Partitions); err != nil {
+			panic("can't declare topic: " + err.Error())
+		}
+	}
+	// the broker shuts down on SIGTERM, as sent by kubernetes, or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	// SIGHUP is caught before serving, it would kill the broker otherwise
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	compaction := cfg.Retention.Compaction
+	compactor, err := push.NewCompactor(storage, logger.Prefix("compactor:"), compaction.Interval, compaction.TombstoneGrace)
+	if err != nil {
+		panic("can't create compactor: " + err.Error())
+	}
+	opts, err := httpOptions(cfg)
+	if err != nil {
+		panic(err.Error())
+	}
+	retention := push.NewRetention(cfg.Retention.DefaultTTL, cfg.Retention.ExpiredTopic)
+	opts = append(opts, push.WithQueueOptions(push.WithRetention(retention)))
+	handler := push.NewHTTPHandler(storage, logger, opts...)
+	r := &reloader{
+		cfg:       cfg,
+		args:      os.Args[1:],
+		handler:   handler,
+		retention: retention,
+		compactor: compactor,
+		logger:    logger,
+	}
+	r.compact(ctx, compaction.Topics)
+	go r.run(ctx, hup, pflag.Lookup("config").Value.String())
+	s := http.Server{
+		Addr:    cfg.Listen.HTTP,
+		Handler: handler,
+	}
+	if tls := cfg.Listen.TLS; tls.Enabled() {
+		if s.TLSConfig, err = (push.TLSOptions{
+			CertFile:   tls.CertFile,
+			KeyFile:    tls.KeyFile,
+			CAFile:     tls.CAFile,
+			ClientAuth: config.ClientAuthTypes[tls.ClientAuth],
+		}).ServerConfig(); err != nil {
+			panic("can't set up TLS: " + err.Error())
+		}
+	}
+	served := make(chan error, 1)
+	go func() {
+		logger.Logf(logf.Info, "start listen http on %s", cfg.Listen.HTTP)
+		var err error
+		if s.TLSConfig != nil {
+			// the certificate comes from the TLS config, which reloads it
+			err = s.ListenAndServeTLS("", "")
+		} else {
+			err = s.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			served <- err
+		}
+	}()
+	code := 0
+	select {
+	case <-ctx.Done():
+	case err := <-served:
+		logger.Logf(logf.Error, "listen: %s", err.Error())
+		code = 1
+	}
+	stop()
+	logger.Logf(logf.Info, "shutting down, waiting at most %s", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	// the handler ends the event streams, which the server waits for
+	drained := make(chan error, 1)
+	go func() {
+		drained <- handler.Shutdown(shutdownCtx)
+	}()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		logger.Logf(logf.Error, "shutdown http: %s", err.Error())
+	}
+	if err := <-drained; err != nil {
+		logger.Logf(logf.Error, "drain: %s", err.Error())
+	}
+	if db != nil {
+		if sqlDB, err := db.DB(); err == nil {
+			if err := sqlDB.Close(); err != nil {
+				logger.Logf(logf.Error, "close DB: %s", err.Error())
+			}
+		}
+	}
+	logger.Logf(logf.Info, "shut down")
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+func openDB(cfg config.DBConfig) (*gorm.DB, error) {
+	switch cfg.DBMS {
 	case config.DBMysql:
-		db, err = gorm.Open(mysql.Open(cfg.DB.DSN()))
+		return gorm.Open(mysql.Open(cfg.DSN()))
 	case config.DBPgsql:
-		db, err = gorm.Open(postgres.Open(cfg.DB.DSN()))
+		return gorm.Open(postgres.Open(cfg.DSN()))
 	case config.DBSqlite:
-		db, err = gorm.Open(sqlite.Open(cfg.DB.DSN()))
+		return gorm.Open(sqlite.Open(cfg.DSN()))
 	default:
-		panic("not support DBMS [" + cfg.DB.DBMS + "]")
+		return nil, fmt.Errorf("not support DBMS [%s]", cfg.DBMS)
 	}
-	if err != nil {
-		panic("can't open DB: " + err.Error())
-	}
-	s := http.Server{
-		Addr:    cfg.Http,
-		Handler: push.NewHTTPHandler(push.NewDBStorage(db), logger),
+}
+
+// configCommand runs push config <command> on cfg, read with err, returning
+// the exit code
+func configCommand(cfg config.Config, err error, command string) int {
+	switch command {
+	case "validate":
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		fmt.Println("config is valid")
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command [config %s], usage: push config validate\n", command)
+		return 2
 	}
-	logger.Logf(logf.Info, "start listen http on %s", cfg.Http)
-	if err := s.ListenAndServe(); err != nil {
-		logger.Logf(logf.Fatal, "listen: %s", err.Error())
+}
+
+// httpOptions returns the options of the http handler set by cfg, which
+// are the ones reloading applies
+func httpOptions(cfg config.Config) ([]push.HTTPOption, error) {
+	var ts *push.Tenants
+	if len(cfg.Auth.Tenants) > 0 {
+		tenants := make([]*push.Tenant, len(cfg.Auth.Tenants))
+		for i, t := range cfg.Auth.Tenants {
+			tenants[i] = &push.Tenant{
+				Name:     t.Name,
+				Keys:     t.Keys,
+				Subjects: t.Subjects,
+				Quota: push.Quota{
+					MaxTopics:      t.Quota.MaxTopics,
+					MaxStoredBytes: t.Quota.MaxStoredBytes,
+					MaxPublishRate: t.Quota.MaxPublishRate,
+					MaxSubscribers: t.Quota.MaxSubscribers,
+				},
+			}
+		}
+		var err error
+		if ts, err = push.NewTenants(tenants...); err != nil {
+			return nil, fmt.Errorf("can't load tenants: %w", err)
+		}
 	}
+	return []push.HTTPOption{
+		push.WithTenants(ts),
+		push.WithAdminKey(cfg.Auth.AdminKey),
+		push.WithRateLimit(push.RateLimit{
+			PrincipalRate:  cfg.RateLimit.PrincipalRate,
+			PrincipalBurst: cfg.RateLimit.PrincipalBurst,
+			TopicRate:      cfg.RateLimit.TopicRate,
+			TopicBurst:     cfg.RateLimit.TopicBurst,
+		}),
+		push.WithFlowControl(push.FlowControl{
+			WriteTimeout: cfg.Subscribe.WriteTimeout,
+			MaxLag:       cfg.Subscribe.MaxLag,
+		}),
+		push.WithPprof(cfg.Pprof),
+		push.WithCORS(push.CORS{
+			AllowedOrigins:   cfg.CORS.AllowedOrigins,
+			AllowedMethods:   cfg.CORS.AllowedMethods,
+			AllowedHeaders:   cfg.CORS.AllowedHeaders,
+			ExposedHeaders:   cfg.CORS.ExposedHeaders,
+			AllowCredentials: cfg.CORS.AllowCredentials,
+			MaxAge:           cfg.CORS.MaxAge,
+		}),
+	}, nil
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/yang-zzhong/go-push"
+	"github.com/yang-zzhong/go-push/config"
+)
+
+// reloadDelay gathers the events of a single change of the config file,
+// editors and kubernetes write files in several steps
+const reloadDelay = 200 * time.Millisecond
+
+// leveledLogger filters its logs by a level changing with reloads
+type leveledLogger struct {
+	logf.Logger
+	level *atomic.Uint32
+}
+
+func newLeveledLogger(logger logf.Logger, level logf.Level) leveledLogger {
+	l := leveledLogger{Logger: logger, level: new(atomic.Uint32)}
+	l.setLevel(level)
+	return l
+}
+
+func (l leveledLogger) setLevel(level logf.Level) {
+	l.level.Store(uint32(level))
+}
+
+func (l leveledLogger) Logf(level logf.Level, format string, args ...any) {
+	if uint32(level) < l.level.Load() {
+		return
+	}
+	l.Logger.Logf(level, format, args...)
+}
+
+func (l leveledLogger) Prefix(prefix string) logf.Logger {
+	return leveledLogger{Logger: l.Logger.Prefix(prefix), level: l.level}
+}
+
+// reloader reloads the config on SIGHUP and when its file changes, applying
+// the reloadable sections and keeping the current config when the new one
+// is invalid
+type reloader struct {
+	cfg       config.Config
+	args      []string
+	handler   push.HTTPHandler
+	retention *push.Retention
+	compactor *push.Compactor
+	// compacting starts the compactor once there are topics to compact
+	compacting sync.Once
+	logger     leveledLogger
+	lock       sync.Mutex
+}
+
+// compact adds topics to the compactor, which runs until ctx is done from
+// the first ones on
+func (r *reloader) compact(ctx context.Context, topics []string) {
+	if len(topics) == 0 {
+		return
+	}
+	r.compactor.Add(topics...)
+	r.compacting.Do(func() {
+		go r.compactor.Run(ctx)
+	})
+}
+
+// run reloads on hup until ctx is done, watching the config file at path
+func (r *reloader) run(ctx context.Context, hup <-chan os.Signal, path string) {
+	var changed <-chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		r.logger.Logf(logf.Error, "reload: watch config: %s", err.Error())
+	} else {
+		defer watcher.Close()
+		// the directory is watched as the file may be replaced, as with
+		// the symlinks of a kubernetes config map
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			r.logger.Logf(logf.Warn, "reload: watch config [%s]: %s, reloading on SIGHUP only", path, err.Error())
+		}
+		changed = watcher.Events
+	}
+	delay := time.NewTimer(0)
+	<-delay.C
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.logger.Logf(logf.Info, "reload: SIGHUP")
+			r.reload(ctx)
+		case e := <-changed:
+			if filepath.Base(e.Name) == filepath.Base(path) || filepath.Base(e.Name) == "..data" {
+				delay.Reset(reloadDelay)
+			}
+		case <-delay.C:
+			r.logger.Logf(logf.Info, "reload: config file changed")
+			r.reload(ctx)
+		}
+	}
+}
+
+// reload reads the config again and applies its changes
+func (r *reloader) reload(ctx context.Context) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var cfg config.Config
+	if err := config.Read(&cfg, pflag.NewFlagSet("push", pflag.ContinueOnError), r.args); err != nil {
+		r.logger.Logf(logf.Error, "reload: %s, keeping the current config", err.Error())
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		r.logger.Logf(logf.Error, "reload: invalid config, keeping the current one:\n%s", err.Error())
+		return
+	}
+	opts, err := httpOptions(cfg)
+	if err != nil {
+		r.logger.Logf(logf.Error, "reload: %s, keeping the current config", err.Error())
+		return
+	}
+	changes := config.Diff(r.cfg, cfg)
+	if len(changes) == 0 {
+		r.logger.Logf(logf.Info, "reload: config unchanged")
+		return
+	}
+	r.handler.Reload(opts...)
+	r.retention.Set(cfg.Retention.DefaultTTL, cfg.Retention.ExpiredTopic)
+	for _, t := range r.cfg.Retention.Compaction.Topics {
+		r.compactor.Remove(t)
+	}
+	r.compact(ctx, cfg.Retention.Compaction.Topics)
+	r.logger.setLevel(cfg.Log.LogfLevel())
+	for _, c := range changes {
+		if c.Reloadable() {
+			r.logger.Logf(logf.Info, "reload: %s", c)
+		} else {
+			r.logger.Logf(logf.Warn, "reload: %s, applies on restart", c)
+		}
+	}
+	r.cfg = cfg
+}
@@ -0,0 +1,114 @@
+package push
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes the values of a TypedTopic into messages and back
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	// ContentType names the encoding, messages carry it
+	ContentType() string
+}
+
+const contentTypeJSON = "application/json"
+
+var (
+	// JSONCodec encodes values with encoding/json, its messages are
+	// readable as they are
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes values with encoding/gob
+	GobCodec Codec = gobCodec{}
+	// MsgpackCodec encodes values as MessagePack
+	MsgpackCodec Codec = msgpackCodec{}
+	// ProtobufCodec encodes protobuf messages, the values of its topics
+	// are proto.Message
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) ContentType() string {
+	return contentTypeJSON
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: %T isn't a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal decodes into a message, or into a pointer to a message pointer
+// as a TypedTopic of messages does, allocating the message when it's nil
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Ptr {
+			if rv.Elem().IsNil() {
+				rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+			}
+			m, ok = rv.Elem().Interface().(proto.Message)
+		}
+	}
+	if !ok {
+		return fmt.Errorf("protobuf: %T isn't a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+func (protobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
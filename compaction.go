@@ -0,0 +1,102 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+)
+
+// CompactableStorage is implemented by storages supporting keyed topics compaction
+type CompactableStorage interface {
+	Storage
+	// Compact removes every keyed message superseded by a later message of
+	// the same key, then the remaining tombstones created before
+	// tombstoneBefore. Offsets of the kept messages don't change, and the
+	// last message of the topic is always kept
+	Compact(ctx context.Context, name string, tombstoneBefore time.Time) (removed int64, err error)
+}
+
+// Compactor compacts its topics in background, keeping only the latest
+// message per key. Messages without key are never removed
+type Compactor struct {
+	storage  CompactableStorage
+	interval time.Duration
+	grace    time.Duration
+	topics   map[string]struct{}
+	lock     sync.RWMutex
+	logf.Logger
+}
+
+func NewCompactor(s Storage, logger logf.Logger, interval, tombstoneGrace time.Duration) (*Compactor, error) {
+	cs, ok := s.(CompactableStorage)
+	if !ok {
+		return nil, errors.New("storage doesn't support compaction")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid compaction interval [%s]", interval)
+	}
+	return &Compactor{
+		storage:  cs,
+		interval: interval,
+		grace:    tombstoneGrace,
+		topics:   make(map[string]struct{}),
+		Logger:   logger,
+	}, nil
+}
+
+func (c *Compactor) Add(topics ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, t := range topics {
+		c.topics[t] = struct{}{}
+	}
+}
+
+func (c *Compactor) Remove(topic string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.topics, topic)
+}
+
+// Compact compacts every topic once
+func (c *Compactor) Compact(ctx context.Context) error {
+	c.lock.RLock()
+	topics := make([]string, 0, len(c.topics))
+	for t := range c.topics {
+		topics = append(topics, t)
+	}
+	c.lock.RUnlock()
+	for _, t := range topics {
+		removed, err := c.storage.Compact(ctx, t, time.Now().Add(-c.grace))
+		if err != nil {
+			if errors.Is(err, ErrQueueNotFound) {
+				continue
+			}
+			return fmt.Errorf("compact topic [%s]: %w", t, err)
+		}
+		if removed > 0 {
+			c.Logf(logf.Info, "compact topic [%s]: removed %d messages", t, removed)
+		}
+	}
+	return nil
+}
+
+// Run compacts the topics every interval until ctx is done
+func (c *Compactor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := c.Compact(ctx); err != nil {
+				c.Logf(logf.Error, "compaction: %s", err.Error())
+			}
+		}
+	}
+}
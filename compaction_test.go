@@ -0,0 +1,68 @@
+package push_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+func testCompaction(t *testing.T, s push.Storage) {
+	ctx := context.Background()
+	assert.Nil(t, s.Create(ctx, "entities"))
+	err := s.Add(ctx, "entities", []*push.Message{
+		push.NewMessage([]byte("a1")).WithKey("a"),
+		push.NewMessage([]byte("b1")).WithKey("b"),
+		push.NewMessage([]byte("plain")),
+		push.NewMessage([]byte("a2")).WithKey("a"),
+		push.NewMessage([]byte("b-deleted")).WithKey("b").AsTombstone(),
+		push.NewMessage([]byte("c1")).WithKey("c"),
+	})
+	assert.Nil(t, err)
+	c, err := push.NewCompactor(s, logf.New(), time.Minute, time.Hour)
+	assert.Nil(t, err)
+	c.Add("entities")
+	assert.Nil(t, c.Compact(ctx))
+	msgs, err := s.Get(ctx, "entities", 0, 10)
+	assert.Nil(t, err)
+	offsets := []int64{}
+	for _, m := range msgs {
+		offsets = append(offsets, m.Offset)
+	}
+	assert.Equal(t, []int64{2, 3, 4, 5}, offsets)
+	assert.True(t, msgs[2].Tombstone)
+	// the tombstone is removed once the grace period passed
+	c, err = push.NewCompactor(s, logf.New(), time.Minute, -time.Hour)
+	assert.Nil(t, err)
+	c.Add("entities")
+	assert.Nil(t, c.Compact(ctx))
+	msgs, err = s.Get(ctx, "entities", 3, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, "a2", string(msgs[0].Data))
+	assert.Equal(t, "c1", string(msgs[1].Data))
+	// offsets keep growing after compaction
+	next := []*push.Message{push.NewMessage([]byte("d1")).WithKey("d")}
+	assert.Nil(t, s.Add(ctx, "entities", next))
+	assert.Equal(t, int64(6), next[0].Offset)
+}
+
+func TestCompaction_memory(t *testing.T) {
+	testCompaction(t, push.NewMemoryStorage())
+}
+
+func TestCompaction_sqlite(t *testing.T) {
+	testCompaction(t, sqliteStorage(t))
+}
+
+func TestCompaction_sqliteSingleTable(t *testing.T) {
+	testCompaction(t, sqliteStorage(t, push.WithDBLayout(push.DBLayoutSingleTable)))
+}
+
+func TestCompactor_unsupported(t *testing.T) {
+	_, err := push.NewCompactor(struct{ push.Storage }{push.NewMemoryStorage()}, logf.New(), time.Minute, 0)
+	assert.NotNil(t, err)
+}
@@ -1,13 +1,21 @@
 package config
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/dev-mockingbird/logf"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/yang-zzhong/go-push"
 )
 
 const (
@@ -16,21 +24,176 @@ const (
 	DBSqlite = "sqlite"
 )
 
+const (
+	StorageDB     = "db"
+	StorageMemory = "memory"
+)
+
+const (
+	// DefaultPath is where the config is read from unless --config is given,
+	// it's fine for it to be missing
+	DefaultPath = "/etc/push/config.yaml"
+	// EnvPrefix prefixes the environment variables overriding the config,
+	// as in PUSH_LISTEN_HTTP for listen.http
+	EnvPrefix = "push"
+)
+
+// LogLevels are the names of the log levels
+var LogLevels = map[string]logf.Level{
+	"trace": logf.Trace,
+	"debug": logf.Debug,
+	"info":  logf.Info,
+	"warn":  logf.Warn,
+	"error": logf.Error,
+	"fatal": logf.Fatal,
+}
+
+// ClientAuthTypes are the names of the ways to verify client certificates
+var ClientAuthTypes = map[string]tls.ClientAuthType{
+	"":                tls.NoClientCert,
+	"none":            tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"require_any":     tls.RequireAnyClientCert,
+	"verify_if_given": tls.VerifyClientCertIfGiven,
+	"require":         tls.RequireAndVerifyClientCert,
+}
+
+// TLSConfig enables TLS on a listener when the certificate is set
+type TLSConfig struct {
+	CertFile string `json:"cert_file" yaml:"cert_file" mapstructure:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file" mapstructure:"key_file"`
+	// CAFile holds the CAs verifying client certificates
+	CAFile string `json:"ca_file" yaml:"ca_file" mapstructure:"ca_file"`
+	// ClientAuth is how client certificates are verified: none, request,
+	// require_any, verify_if_given or require. The common name of a
+	// verified certificate authenticates as the tenant it's a subject of
+	ClientAuth string `json:"client_auth" yaml:"client_auth" mapstructure:"client_auth"`
+}
+
+func (cfg TLSConfig) Enabled() bool {
+	return cfg.CertFile != "" || cfg.KeyFile != ""
+}
+
+type ListenConfig struct {
+	// HTTP is the address the http broker listens on
+	HTTP string    `json:"http" yaml:"http" mapstructure:"http"`
+	TLS  TLSConfig `json:"tls" yaml:"tls" mapstructure:"tls"`
+}
+
+type LogConfig struct {
+	// Path is the file logs are appended to, empty for stdout
+	Path  string `json:"path" yaml:"path"`
+	Level string `json:"level" yaml:"level"`
+}
+
+// LogfLevel returns the level of Level, info when it's unknown
+func (cfg LogConfig) LogfLevel() logf.Level {
+	if l, ok := LogLevels[strings.ToLower(cfg.Level)]; ok {
+		return l
+	}
+	return logf.Info
+}
+
 type DBConfig struct {
 	DBMS     string `json:"dbms" yaml:"dbms"`
 	Database string `json:"database" yaml:"database"`
 	Host     string `json:"host" yaml:"host"`
 	Port     int64  `json:"port" yaml:"port"`
 	User     string `json:"user" yaml:"user"`
-	Password string `json:"password" yaml:"password"`
+	Password string `json:"password" yaml:"password" secret:"true"`
+	// Layout is how messages are kept, table_per_topic or single_table
+	Layout string `json:"layout" yaml:"layout"`
+}
+
+type StorageConfig struct {
+	// Backend is where messages are kept, db or memory
+	Backend string   `json:"backend" yaml:"backend"`
+	DB      DBConfig `json:"db" yaml:"db"`
+}
+
+type QuotaConfig struct {
+	MaxTopics      int     `json:"max_topics" yaml:"max_topics" mapstructure:"max_topics"`
+	MaxStoredBytes int64   `json:"max_stored_bytes" yaml:"max_stored_bytes" mapstructure:"max_stored_bytes"`
+	MaxPublishRate float64 `json:"max_publish_rate" yaml:"max_publish_rate" mapstructure:"max_publish_rate"`
+	MaxSubscribers int     `json:"max_subscribers" yaml:"max_subscribers" mapstructure:"max_subscribers"`
+}
+
+type TenantConfig struct {
+	Name string   `json:"name" yaml:"name"`
+	Keys []string `json:"keys" yaml:"keys" secret:"true"`
+	// Subjects are the common names of the client certificates
+	// authenticating as the tenant
+	Subjects []string    `json:"subjects" yaml:"subjects"`
+	Quota    QuotaConfig `json:"quota" yaml:"quota"`
+}
+
+type AuthConfig struct {
+	// AdminKey enables the admin API, empty to disable it
+	AdminKey string `json:"admin_key" yaml:"admin_key" mapstructure:"admin_key" secret:"true"`
+	// Tenants, when any, must authenticate every request with their keys
+	Tenants []TenantConfig `json:"tenants" yaml:"tenants"`
+}
+
+type CompactionConfig struct {
+	Topics         []string      `json:"topics" yaml:"topics"`
+	Interval       time.Duration `json:"interval" yaml:"interval"`
+	TombstoneGrace time.Duration `json:"tombstone_grace" yaml:"tombstone_grace" mapstructure:"tombstone_grace"`
+}
+
+type RetentionConfig struct {
+	// DefaultTTL expires the messages pushed without a ttl, zero keeps them
+	DefaultTTL time.Duration `json:"default_ttl" yaml:"default_ttl" mapstructure:"default_ttl"`
+	// ExpiredTopic is the topic expired messages are routed to, empty to
+	// drop them
+	ExpiredTopic string           `json:"expired_topic" yaml:"expired_topic" mapstructure:"expired_topic"`
+	Compaction   CompactionConfig `json:"compaction" yaml:"compaction"`
+}
+
+type TopicConfig struct {
+	Name       string `json:"name" yaml:"name"`
+	Partitions int    `json:"partitions" yaml:"partitions"`
+}
+
+type RateLimitConfig struct {
+	PrincipalRate  float64 `json:"principal_rate" yaml:"principal_rate" mapstructure:"principal_rate"`
+	PrincipalBurst int     `json:"principal_burst" yaml:"principal_burst" mapstructure:"principal_burst"`
+	TopicRate      float64 `json:"topic_rate" yaml:"topic_rate" mapstructure:"topic_rate"`
+	TopicBurst     int     `json:"topic_burst" yaml:"topic_burst" mapstructure:"topic_burst"`
+}
+
+type SubscribeConfig struct {
+	WriteTimeout time.Duration `json:"write_timeout" yaml:"write_timeout" mapstructure:"write_timeout"`
+	MaxLag       int64         `json:"max_lag" yaml:"max_lag" mapstructure:"max_lag"`
+}
+
+// CORSConfig is the policy of cross origin requests of browsers, which are
+// refused unless their origin is allowed
+type CORSConfig struct {
+	// AllowedOrigins are origins or patterns with a single *, as
+	// https://*.example.com, a lone * allows any origin
+	AllowedOrigins   []string      `json:"allowed_origins" yaml:"allowed_origins" mapstructure:"allowed_origins"`
+	AllowedMethods   []string      `json:"allowed_methods" yaml:"allowed_methods" mapstructure:"allowed_methods"`
+	AllowedHeaders   []string      `json:"allowed_headers" yaml:"allowed_headers" mapstructure:"allowed_headers"`
+	ExposedHeaders   []string      `json:"exposed_headers" yaml:"exposed_headers" mapstructure:"exposed_headers"`
+	AllowCredentials bool          `json:"allow_credentials" yaml:"allow_credentials" mapstructure:"allow_credentials"`
+	MaxAge           time.Duration `json:"max_age" yaml:"max_age" mapstructure:"max_age"`
 }
 
 type Config struct {
-	Http     string    `json:"http" yaml:"http"`
-	Tcp      string    `json:"tcp" yaml:"tcp"`
-	Logpath  string    `json:"logpath" yaml:"logpath"`
-	Loglevel int       `json:"loglevel" yaml:"loglevel"`
-	DB       *DBConfig `json:"db" yaml:"db"`
+	Listen    ListenConfig    `json:"listen" yaml:"listen"`
+	Log       LogConfig       `json:"log" yaml:"log"`
+	Storage   StorageConfig   `json:"storage" yaml:"storage"`
+	Auth      AuthConfig      `json:"auth" yaml:"auth"`
+	Retention RetentionConfig `json:"retention" yaml:"retention"`
+	Topics    []TopicConfig   `json:"topics" yaml:"topics"`
+	// RateLimit limits pushes in messages per second
+	RateLimit RateLimitConfig `json:"rate_limit" yaml:"rate_limit" mapstructure:"rate_limit"`
+	Subscribe SubscribeConfig `json:"subscribe" yaml:"subscribe"`
+	CORS      CORSConfig      `json:"cors" yaml:"cors"`
+	// ShutdownTimeout bounds how long the broker drains on shutdown
+	ShutdownTimeout time.Duration `json:"shutdown_timeout" yaml:"shutdown_timeout" mapstructure:"shutdown_timeout"`
+	// Pprof serves the profiles under /debug/pprof/
+	Pprof bool `json:"pprof" yaml:"pprof"`
 }
 
 func (cfg DBConfig) MysqlDSN() string {
@@ -63,66 +226,329 @@ func (cfg DBConfig) DSN() string {
 	}
 }
 
-func ReadInput(cfg *Config, logger logf.Logger) error {
-	viper.SetEnvPrefix("mb")
-	replacer := strings.NewReplacer(".", "_")
-	viper.SetEnvKeyReplacer(replacer)
-	viper.AutomaticEnv()
-	var (
-		jsonFile string
-		yamlFile string
-	)
-	pflag.StringVar(&jsonFile, "json", "", "json config path file")
-	pflag.StringVar(&yamlFile, "yaml", "/etc/mockingbird/config.yaml", "yaml config path file")
-	pflag.Bool("db.disable", false, "enable db or not")
-	pflag.String("db.dbms", "mysql", "dbms")
-	pflag.Int("loglevel", 0, "log level, from 0 to 5")
-	pflag.String("logpath", "", "log file path, default: ./mockingbird.log")
-	pflag.String("db.host", "127.0.0.1", "db host")
-	pflag.String("db.database", "mockingbird", "database to use")
-	pflag.Int("db.port", 3306, "db port")
-	pflag.String("db.user", "root", "db user")
-	pflag.String("db.password", "", "db password")
-	pflag.String("jaeger.url", "", "jaeger url")
-	pflag.String("http.disable", "", "enable http or not")
-	pflag.String("http.docroot", "./static/", "docment root of static files")
-	pflag.Int("http.port", 7000, "http port")
-	pflag.String("mail.from", "", "mail from")
-	pflag.String("mail.user", "", "mail user")
-	pflag.String("mail.password", "", "mail password")
-	pflag.String("mail.smtphost", "", "mail smtp host")
-	pflag.Int("mail.smtpport", 0, "mail smtp host")
-	pflag.Parse()
-	if jsonFile != "" {
-		viper.SetConfigType("json")
-		f, err := os.Open(jsonFile)
-		if err != nil {
-			logger.Logf(logf.Error, "open file [%s]: %s", jsonFile, err.Error())
-			return err
+// flags registers the flags of the config on set, their defaults are the
+// defaults of the config
+func flags(set *pflag.FlagSet) *string {
+	path := set.String("config", DefaultPath, "config file, yaml or json by its extension")
+	set.String("listen.http", ":8081", "address the http broker listens on")
+	set.String("listen.tls.cert_file", "", "certificate of the http listener, enables TLS")
+	set.String("listen.tls.key_file", "", "private key of the certificate of the http listener")
+	set.String("listen.tls.ca_file", "", "CAs verifying the certificates of clients")
+	set.String("listen.tls.client_auth", "none", "how client certificates are verified: none, request, require_any, verify_if_given or require")
+	set.String("log.path", "", "file logs are appended to, empty for stdout")
+	set.String("log.level", "info", "log level: trace, debug, info, warn, error or fatal")
+	set.String("storage.backend", StorageDB, "where messages are kept: db or memory")
+	set.String("storage.db.dbms", DBMysql, "dbms: mysql, pgsql or sqlite")
+	set.String("storage.db.host", "127.0.0.1", "db host")
+	set.Int("storage.db.port", 3306, "db port")
+	set.String("storage.db.database", "push", "database to use")
+	set.String("storage.db.user", "root", "db user")
+	set.String("storage.db.password", "", "db password")
+	set.String("storage.db.layout", "table_per_topic", "how messages are kept, table_per_topic or single_table")
+	set.String("auth.admin_key", "", "key of the admin api, empty to disable it")
+	set.Duration("retention.default_ttl", 0, "expiry of the messages pushed without a ttl, 0 to keep them")
+	set.String("retention.expired_topic", "", "topic to route expired messages to, empty to drop them")
+	set.StringSlice("retention.compaction.topics", nil, "topics keeping only the latest message of each key")
+	set.Duration("retention.compaction.interval", time.Minute, "interval between compactions of compacted topics")
+	set.Duration("retention.compaction.tombstone_grace", 24*time.Hour, "how long tombstones are kept before their key is removed")
+	set.Float64("rate_limit.principal_rate", 0, "messages per second each principal can push, 0 for unlimited")
+	set.Int("rate_limit.principal_burst", 0, "messages each principal can push at once, defaults to the rate")
+	set.Float64("rate_limit.topic_rate", 0, "messages per second each topic accepts, 0 for unlimited")
+	set.Int("rate_limit.topic_burst", 0, "messages each topic accepts at once, defaults to the rate")
+	set.Duration("subscribe.write_timeout", 30*time.Second, "how long a subscriber has to read a batch before it's disconnected")
+	set.Int64("subscribe.max_lag", 0, "messages a subscriber can be behind before it's disconnected, 0 for unlimited")
+	set.StringSlice("cors.allowed_origins", nil, "origins allowed to make cross origin requests, as https://*.example.com")
+	set.StringSlice("cors.allowed_methods", nil, "methods of cross origin requests, GET and POST by default")
+	set.StringSlice("cors.allowed_headers", nil, "headers of cross origin requests, Authorization, Content-Type and Last-Event-ID by default")
+	set.StringSlice("cors.exposed_headers", nil, "response headers scripts can read")
+	set.Bool("cors.allow_credentials", false, "let cross origin requests carry credentials")
+	set.Duration("cors.max_age", 0, "how long browsers may cache preflight answers")
+	set.Duration("shutdown_timeout", 25*time.Second, "how long to drain connections on shutdown")
+	set.Bool("pprof", false, "serve profiles under /debug/pprof/, to the admin key when there is one")
+	return path
+}
+
+// Read reads cfg from the command line args parsed with set, the config file
+// they point to and the environment, the latter overriding the former
+func Read(cfg *Config, set *pflag.FlagSet, args []string) error {
+	path := flags(set)
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	v := viper.New()
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	if err := readFile(v, *path, set.Changed("config")); err != nil {
+		return err
+	}
+	var err error
+	set.VisitAll(func(f *pflag.Flag) {
+		// config is the flag pointing to the file, not a field of the config
+		if f.Name != "config" && err == nil {
+			err = v.BindPFlag(f.Name, f)
 		}
-		if err := viper.ReadConfig(f); err != nil {
-			logger.Logf(logf.Error, "read json config: %s", err.Error())
-			return err
+	})
+	if err != nil {
+		return fmt.Errorf("read command line: %w", err)
+	}
+	if err := v.UnmarshalExact(cfg); err != nil {
+		return fmt.Errorf("decode config: %w", err)
+	}
+	return nil
+}
+
+// readFile reads the config file at path, which is fine to be missing
+// unless it's explicitly given
+func readFile(v *viper.Viper, path string, explicit bool) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open config: %w", err)
+	}
+	defer f.Close()
+	v.SetConfigType("yaml")
+	if filepath.Ext(path) == ".json" {
+		v.SetConfigType("json")
+	}
+	if err := v.ReadConfig(f); err != nil {
+		return fmt.Errorf("read config [%s]: %w", path, err)
+	}
+	return nil
+}
+
+// FieldError is an invalid value of the config, Path locates it as in
+// storage.db.dbms or auth.tenants[0].name
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationError holds every invalid value of a config
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) fail(path, format string, args ...any) {
+	v.errs = append(v.errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) check(path string, err error) {
+	if err != nil {
+		v.fail(path, "%s", err.Error())
+	}
+}
+
+// Validate checks cfg is usable by the broker, the returned error is a
+// ValidationError telling every invalid value
+func (cfg Config) Validate() error {
+	var v validator
+	cfg.Listen.validate(&v, "listen")
+	if _, ok := LogLevels[strings.ToLower(cfg.Log.Level)]; !ok {
+		v.fail("log.level", "unknown level [%s]", cfg.Log.Level)
+	}
+	cfg.Storage.validate(&v, "storage")
+	cfg.Auth.validate(&v, "auth")
+	cfg.Retention.validate(&v, "retention")
+	cfg.CORS.validate(&v, "cors")
+	names := make(map[string]int)
+	for i, t := range cfg.Topics {
+		path := fmt.Sprintf("topics[%d]", i)
+		v.check(path+".name", push.ValidateDeclaredTopicName(t.Name))
+		if j, ok := names[t.Name]; ok {
+			v.fail(path+".name", "topic [%s] is declared by topics[%d] too", t.Name, j)
+		}
+		names[t.Name] = i
+		if t.Partitions < 1 {
+			v.fail(path+".partitions", "must be at least 1")
 		}
 	}
-	if yamlFile != "" {
-		viper.SetConfigType("yaml")
-		f, err := os.Open(yamlFile)
-		if err != nil {
-			logger.Logf(logf.Error, "open file [%s]: %s", yamlFile, err.Error())
-			return err
+	for path, n := range map[string]float64{
+		"rate_limit.principal_rate":  cfg.RateLimit.PrincipalRate,
+		"rate_limit.principal_burst": float64(cfg.RateLimit.PrincipalBurst),
+		"rate_limit.topic_rate":      cfg.RateLimit.TopicRate,
+		"rate_limit.topic_burst":     float64(cfg.RateLimit.TopicBurst),
+		"subscribe.write_timeout":    float64(cfg.Subscribe.WriteTimeout),
+		"subscribe.max_lag":          float64(cfg.Subscribe.MaxLag),
+	} {
+		if n < 0 {
+			v.fail(path, "must not be negative")
 		}
-		if err := viper.ReadConfig(f); err != nil {
-			logger.Logf(logf.Error, "read json config: %s", err.Error())
-			return err
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		v.fail("shutdown_timeout", "must be positive")
+	}
+	if len(v.errs) == 0 {
+		return nil
+	}
+	// the checks ranging over maps run in random order
+	sort.SliceStable(v.errs, func(i, j int) bool { return v.errs[i].Path < v.errs[j].Path })
+	return v.errs
+}
+
+func (cfg ListenConfig) validate(v *validator, path string) {
+	if cfg.HTTP == "" {
+		v.fail(path+".http", "required")
+	} else if _, _, err := net.SplitHostPort(cfg.HTTP); err != nil {
+		v.fail(path+".http", "invalid address: %s", err.Error())
+	}
+	cfg.TLS.validate(v, path+".tls")
+}
+
+func (cfg TLSConfig) validate(v *validator, path string) {
+	auth, ok := ClientAuthTypes[cfg.ClientAuth]
+	if !ok {
+		v.fail(path+".client_auth", "unknown client auth [%s], none, request, require_any, verify_if_given or require", cfg.ClientAuth)
+	}
+	if !cfg.Enabled() {
+		if cfg.CAFile != "" || auth != tls.NoClientCert {
+			v.fail(path+".cert_file", "required with client certificates")
 		}
+		return
 	}
-	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
-		logger.Logf(logf.Error, "read command line: %s", err.Error())
-		return err
+	files := map[string]string{"cert_file": cfg.CertFile, "key_file": cfg.KeyFile, "ca_file": cfg.CAFile}
+	for name, file := range files {
+		if file == "" {
+			if name != "ca_file" {
+				v.fail(path+"."+name, "required with TLS")
+			}
+		} else if _, err := os.Stat(file); err != nil {
+			v.fail(path+"."+name, "%s", err.Error())
+		}
 	}
-	if err := viper.Unmarshal(cfg); err != nil {
-		return err
+	if cfg.CAFile == "" && auth >= tls.VerifyClientCertIfGiven {
+		v.fail(path+".ca_file", "required to verify client certificates")
+	}
+}
+
+func (cfg StorageConfig) validate(v *validator, path string) {
+	switch cfg.Backend {
+	case StorageMemory:
+		return
+	case StorageDB:
+	default:
+		v.fail(path+".backend", "unknown backend [%s], db or memory", cfg.Backend)
+		return
+	}
+	path += ".db"
+	switch cfg.DB.DBMS {
+	case DBMysql, DBPgsql:
+		if cfg.DB.Host == "" {
+			v.fail(path+".host", "required by %s", cfg.DB.DBMS)
+		}
+		if cfg.DB.Port < 1 || cfg.DB.Port > 65535 {
+			v.fail(path+".port", "invalid port [%d]", cfg.DB.Port)
+		}
+	case DBSqlite:
+	default:
+		v.fail(path+".dbms", "unknown dbms [%s], mysql, pgsql or sqlite", cfg.DB.DBMS)
+	}
+	if cfg.DB.Database == "" {
+		v.fail(path+".database", "required")
+	}
+	switch push.DBLayout(cfg.DB.Layout) {
+	case "", push.DBLayoutTablePerTopic, push.DBLayoutSingleTable:
+	default:
+		v.fail(path+".layout", "unknown layout [%s], table_per_topic or single_table", cfg.DB.Layout)
+	}
+}
+
+func (cfg AuthConfig) validate(v *validator, path string) {
+	names := make(map[string]int)
+	keys := make(map[string]string)
+	subjects := make(map[string]string)
+	for i, t := range cfg.Tenants {
+		tpath := fmt.Sprintf("%s.tenants[%d]", path, i)
+		if t.Name == "" {
+			v.fail(tpath+".name", "required")
+		} else if err := push.ValidateTopicName(t.Name + push.NamespaceSeparator + "topic"); err != nil {
+			v.fail(tpath+".name", "invalid tenant [%s]", t.Name)
+		}
+		if j, ok := names[t.Name]; ok {
+			v.fail(tpath+".name", "tenant [%s] is declared by %s.tenants[%d] too", t.Name, path, j)
+		}
+		names[t.Name] = i
+		if len(t.Keys) == 0 && len(t.Subjects) == 0 {
+			v.fail(tpath+".keys", "required without subjects")
+		}
+		for j, key := range t.Keys {
+			kpath := fmt.Sprintf("%s.keys[%d]", tpath, j)
+			if key == "" {
+				v.fail(kpath, "empty key")
+			} else if other, ok := keys[key]; ok {
+				v.fail(kpath, "key is used by %s too", other)
+			}
+			keys[key] = kpath
+		}
+		for j, subject := range t.Subjects {
+			spath := fmt.Sprintf("%s.subjects[%d]", tpath, j)
+			if subject == "" {
+				v.fail(spath, "empty subject")
+			} else if other, ok := subjects[subject]; ok {
+				v.fail(spath, "subject is used by %s too", other)
+			}
+			subjects[subject] = spath
+		}
+		for name, n := range map[string]float64{
+			"max_topics":       float64(t.Quota.MaxTopics),
+			"max_stored_bytes": float64(t.Quota.MaxStoredBytes),
+			"max_publish_rate": t.Quota.MaxPublishRate,
+			"max_subscribers":  float64(t.Quota.MaxSubscribers),
+		} {
+			if n < 0 {
+				v.fail(tpath+".quota."+name, "must not be negative")
+			}
+		}
+	}
+}
+
+func (cfg CORSConfig) validate(v *validator, path string) {
+	for i, origin := range cfg.AllowedOrigins {
+		opath := fmt.Sprintf("%s.allowed_origins[%d]", path, i)
+		v.check(opath, push.ValidateOrigin(origin))
+		if origin == "*" && cfg.AllowCredentials {
+			v.fail(opath, "any origin can't be allowed with credentials")
+		}
+	}
+	if cfg.MaxAge < 0 {
+		v.fail(path+".max_age", "must not be negative")
+	}
+}
+
+func (cfg RetentionConfig) validate(v *validator, path string) {
+	if cfg.DefaultTTL < 0 {
+		v.fail(path+".default_ttl", "must not be negative")
+	}
+	if cfg.ExpiredTopic != "" {
+		v.check(path+".expired_topic", push.ValidateDeclaredTopicName(cfg.ExpiredTopic))
+	}
+	path += ".compaction"
+	for i, t := range cfg.Compaction.Topics {
+		v.check(fmt.Sprintf("%s.topics[%d]", path, i), push.ValidateDeclaredTopicName(t))
+	}
+	if cfg.Compaction.Interval <= 0 {
+		v.fail(path+".interval", "must be positive")
+	}
+	if cfg.Compaction.TombstoneGrace < 0 {
+		v.fail(path+".tombstone_grace", "must not be negative")
 	}
-	return nil
 }
@@ -0,0 +1,136 @@
+package config_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push/config"
+)
+
+func read(t *testing.T, yaml string, args ...string) (config.Config, error) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(yaml), 0644))
+	var cfg config.Config
+	err := config.Read(&cfg, pflag.NewFlagSet("push", pflag.ContinueOnError), append([]string{"--config", path}, args...))
+	return cfg, err
+}
+
+func TestRead(t *testing.T) {
+	t.Setenv("PUSH_STORAGE_DB_HOST", "db.local")
+	cfg, err := read(t, `
+listen:
+  http: ":9000"
+storage:
+  db:
+    dbms: pgsql
+    port: 5432
+retention:
+  default_ttl: 1h
+topics:
+- name: orders
+  partitions: 4
+`, "--log.level", "debug")
+	assert.Nil(t, err)
+	assert.Equal(t, ":9000", cfg.Listen.HTTP)
+	assert.Equal(t, "debug", cfg.Log.Level)
+	assert.Equal(t, config.DBPgsql, cfg.Storage.DB.DBMS)
+	assert.Equal(t, "db.local", cfg.Storage.DB.Host)
+	assert.Equal(t, int64(5432), cfg.Storage.DB.Port)
+	assert.Equal(t, time.Hour, cfg.Retention.DefaultTTL)
+	assert.Equal(t, 30*time.Second, cfg.Subscribe.WriteTimeout)
+	assert.Equal(t, []config.TopicConfig{{Name: "orders", Partitions: 4}}, cfg.Topics)
+	assert.Nil(t, cfg.Validate())
+}
+
+func TestRead_unknownKey(t *testing.T) {
+	_, err := read(t, "listen: \":9000\"\n")
+	assert.NotNil(t, err)
+	_, err = read(t, "mail:\n  from: me\n")
+	assert.NotNil(t, err)
+}
+
+func TestRead_missingDefault(t *testing.T) {
+	var cfg config.Config
+	assert.Nil(t, config.Read(&cfg, pflag.NewFlagSet("push", pflag.ContinueOnError), nil))
+	assert.Equal(t, ":8081", cfg.Listen.HTTP)
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := read(t, `
+storage:
+  db:
+    dbms: oracle
+auth:
+  tenants:
+  - name: team-a
+    keys: [k1]
+  - name: team/b
+    keys: [k1]
+topics:
+- name: orders
+  partitions: 0
+`, "--log.level", "loud")
+	assert.Nil(t, err)
+	var verr config.ValidationError
+	assert.True(t, errors.As(cfg.Validate(), &verr))
+	paths := make([]string, len(verr))
+	for i, fe := range verr {
+		paths[i] = fe.Path
+	}
+	assert.Equal(t, []string{
+		"auth.tenants[1].keys[0]",
+		"auth.tenants[1].name",
+		"log.level",
+		"storage.db.dbms",
+		"topics[0].partitions",
+	}, paths)
+}
+
+func TestDiff(t *testing.T) {
+	old, err := read(t, "auth:\n  admin_key: a\nrate_limit:\n  topic_rate: 1\n")
+	assert.Nil(t, err)
+	cfg, err := read(t, `
+listen:
+  http: ":9000"
+auth:
+  admin_key: b
+  tenants:
+  - name: team
+    keys: [k]
+rate_limit:
+  topic_rate: 2
+`)
+	assert.Nil(t, err)
+	var changes []string
+	for _, c := range config.Diff(old, cfg) {
+		changes = append(changes, fmt.Sprintf("%s %t", c, c.Reloadable()))
+	}
+	assert.Equal(t, []string{
+		"listen.http: :8081 -> :9000 false",
+		"auth.admin_key changed true",
+		"auth.tenants[0]: unset -> added true",
+		"rate_limit.topic_rate: 1 -> 2 true",
+	}, changes)
+	assert.Equal(t, 0, len(config.Diff(cfg, cfg)))
+}
+
+func TestValidate_tls(t *testing.T) {
+	cfg, err := read(t, "listen:\n  tls:\n    client_auth: require\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "listen.tls.cert_file: required with client certificates", cfg.Validate().Error())
+	cfg, err = read(t, "listen:\n  tls:\n    cert_file: /nonexistent/cert.pem\n    key_file: /nonexistent/key.pem\n    client_auth: require\n")
+	assert.Nil(t, err)
+	var verr config.ValidationError
+	assert.True(t, errors.As(cfg.Validate(), &verr))
+	paths := make([]string, len(verr))
+	for i, fe := range verr {
+		paths[i] = fe.Path
+	}
+	assert.Equal(t, []string{"listen.tls.ca_file", "listen.tls.cert_file", "listen.tls.key_file"}, paths)
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// reloadable are the paths of the sections applied without restarting
+var reloadable = []string{
+	"auth",
+	"cors",
+	"log.level",
+	"pprof",
+	"rate_limit",
+	"retention.default_ttl",
+	"retention.expired_topic",
+	"retention.compaction.topics",
+	"subscribe",
+}
+
+// Change is a value changed between two configs
+type Change struct {
+	Path string
+	From any
+	To   any
+	// Secret changes don't tell their values
+	Secret bool
+}
+
+func (c Change) String() string {
+	if c.Secret {
+		return c.Path + " changed"
+	}
+	return fmt.Sprintf("%s: %v -> %v", c.Path, c.From, c.To)
+}
+
+// Reloadable tells whether the change applies without restarting the broker
+func (c Change) Reloadable() bool {
+	for _, p := range reloadable {
+		if c.Path == p || strings.HasPrefix(c.Path, p+".") || strings.HasPrefix(c.Path, p+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff returns the values changed from old to cfg, by path
+func Diff(old, cfg Config) []Change {
+	var changes []Change
+	diff(&changes, "", reflect.ValueOf(old), reflect.ValueOf(cfg), false)
+	return changes
+}
+
+func diff(changes *[]Change, path string, from, to reflect.Value, secret bool) {
+	switch {
+	case from.Kind() == reflect.Struct:
+		for i := 0; i < from.NumField(); i++ {
+			f := from.Type().Field(i)
+			diff(changes, join(path, fieldName(f)), from.Field(i), to.Field(i), secret || f.Tag.Get("secret") == "true")
+		}
+	case from.Kind() == reflect.Slice && from.Type().Elem().Kind() == reflect.Struct:
+		for i := 0; i < from.Len() || i < to.Len(); i++ {
+			ipath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= to.Len():
+				*changes = append(*changes, Change{Path: ipath, From: "set", To: "removed", Secret: secret})
+			case i >= from.Len():
+				*changes = append(*changes, Change{Path: ipath, From: "unset", To: "added", Secret: secret})
+			default:
+				diff(changes, ipath, from.Index(i), to.Index(i), secret)
+			}
+		}
+	case !reflect.DeepEqual(from.Interface(), to.Interface()):
+		*changes = append(*changes, Change{Path: path, From: from.Interface(), To: to.Interface(), Secret: secret})
+	}
+}
+
+// fieldName returns the name of f in the config file
+func fieldName(f reflect.StructField) string {
+	for _, tag := range []string{"mapstructure", "yaml"} {
+		if name, _, _ := strings.Cut(f.Tag.Get(tag), ","); name != "" {
+			return name
+		}
+	}
+	return strings.ToLower(f.Name)
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,169 @@
+package push
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost}
+	// Last-Event-ID is sent by EventSource when it reconnects
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Last-Event-ID"}
+)
+
+// CORS is the policy of the requests browsers make across origins, such as
+// EventSource subscriptions of web pages served from other hosts
+type CORS struct {
+	// AllowedOrigins are origins, as https://app.example.com, or patterns
+	// of origins with a single *, as https://*.example.com. A lone * allows
+	// any origin, but not with credentials
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET and POST
+	AllowedMethods []string
+	// AllowedHeaders defaults to Authorization, Content-Type and
+	// Last-Event-ID, a lone * allows any header
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts can read
+	ExposedHeaders []string
+	// AllowCredentials lets requests carry cookies and client certificates,
+	// as EventSource does with withCredentials
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the answer of a preflight
+	MaxAge time.Duration
+}
+
+// WithCORS answers cross origin requests following cors, without it the
+// handler sends no CORS headers
+func WithCORS(cors CORS) HTTPOption {
+	return func(b *httpBroker) {
+		b.cors = &cors
+	}
+}
+
+// ValidateOrigin checks an allowed origin of CORS
+func ValidateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	if strings.Count(origin, "*") > 1 {
+		return fmt.Errorf("origin [%s] has more than one *", origin)
+	}
+	if !strings.Contains(origin, "://") {
+		return fmt.Errorf("origin [%s] has no scheme", origin)
+	}
+	return nil
+}
+
+// allowOrigin tells whether origin is allowed
+func (c *CORS) allowOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(allowed, "*")
+		if ok && len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) anyOrigin() bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) methods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return defaultCORSMethods
+	}
+	return c.AllowedMethods
+}
+
+func (c *CORS) headers() []string {
+	if len(c.AllowedHeaders) == 0 {
+		return defaultCORSHeaders
+	}
+	return c.AllowedHeaders
+}
+
+// allowHeaders returns the headers to allow of the requested ones, false
+// when one of them isn't allowed
+func (c *CORS) allowHeaders(requested string) (string, bool) {
+	allowed := c.headers()
+	if len(allowed) == 1 && allowed[0] == "*" {
+		return requested, true
+	}
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !containsFold(allowed, h) {
+			return "", false
+		}
+	}
+	return strings.Join(allowed, ", "), true
+}
+
+func containsFold(values []string, v string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle sets the CORS headers of the response to req, and answers it when
+// it's a preflight from an origin allowed. It returns whether req is
+// answered
+func (c *CORS) handle(w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+	// the answer depends on the origin unless any origin gets the same
+	if !c.anyOrigin() || c.AllowCredentials {
+		w.Header().Add("Vary", "Origin")
+	}
+	if origin == "" || !c.allowOrigin(origin) {
+		return false
+	}
+	if c.anyOrigin() && !c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(c.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+		}
+		return false
+	}
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	if !containsFold(c.methods(), req.Header.Get("Access-Control-Request-Method")) {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	headers, ok := c.allowHeaders(req.Header.Get("Access-Control-Request-Headers"))
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.methods(), ", "))
+	if headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,96 @@
+package push_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+func corsRequest(t *testing.T, h http.Handler, method, origin string, headers map[string]string) *http.Response {
+	req := httptest.NewRequest(method, "/cors/meta", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestCORS_origins(t *testing.T) {
+	h := push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithCORS(push.CORS{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"},
+		ExposedHeaders: []string{"Retry-After"},
+	}))
+	resp := corsRequest(t, h, http.MethodGet, "https://app.example.com", nil)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Retry-After", resp.Header.Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", resp.Header.Get("Vary"))
+	resp = corsRequest(t, h, http.MethodGet, "https://team.example.org", nil)
+	assert.Equal(t, "https://team.example.org", resp.Header.Get("Access-Control-Allow-Origin"))
+	for _, origin := range []string{"https://evil.com", "https://.example.org", "http://app.example.com", ""} {
+		resp = corsRequest(t, h, http.MethodGet, origin, nil)
+		assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"), origin)
+	}
+}
+
+func TestCORS_preflight(t *testing.T) {
+	h := push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithCORS(push.CORS{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}))
+	resp := corsRequest(t, h, http.MethodOptions, "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method":  "GET",
+		"Access-Control-Request-Headers": "last-event-id, authorization",
+	})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, POST", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type, Last-Event-ID", resp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+
+	resp = corsRequest(t, h, http.MethodOptions, "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method": "DELETE",
+	})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = corsRequest(t, h, http.MethodOptions, "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "X-Custom",
+	})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	// other origins get what the handler answers OPTIONS with
+	resp = corsRequest(t, h, http.MethodOptions, "https://evil.com", map[string]string{
+		"Access-Control-Request-Method": "GET",
+	})
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORS_noPolicy(t *testing.T) {
+	h := push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())
+	resp := corsRequest(t, h, http.MethodOptions, "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method": "GET",
+	})
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, POST", resp.Header.Get("Allow"))
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORS_anyOrigin(t *testing.T) {
+	h := push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithCORS(push.CORS{AllowedOrigins: []string{"*"}}))
+	resp := corsRequest(t, h, http.MethodGet, "https://anywhere.com", nil)
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", resp.Header.Get("Vary"))
+	h = push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())
+	resp = corsRequest(t, h, http.MethodGet, "https://anywhere.com", nil)
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,74 @@
+package push
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type DBErrorKind int
+
+const (
+	DBErrorUnknown DBErrorKind = iota
+	DBErrorNoSuchTable
+	DBErrorDuplicateKey
+	DBErrorNoSuchColumn
+)
+
+const (
+	mysqlNoSuchTable  = 1146
+	mysqlDuplicateKey = 1062
+	mysqlNoSuchColumn = 1054
+	pgsqlNoSuchTable  = "42P01"
+	pgsqlDuplicateKey = "23505"
+	pgsqlNoSuchColumn = "42703"
+)
+
+// ClassifyDBError tells what err returned by a db of dialect means, dialect
+// is the name of the gorm dialector, such as mysql, postgres or sqlite
+func ClassifyDBError(dialect string, err error) DBErrorKind {
+	if err == nil {
+		return DBErrorUnknown
+	}
+	switch dialect {
+	case "mysql":
+		var e *mysql.MySQLError
+		if errors.As(err, &e) {
+			switch e.Number {
+			case mysqlNoSuchTable:
+				return DBErrorNoSuchTable
+			case mysqlDuplicateKey:
+				return DBErrorDuplicateKey
+			case mysqlNoSuchColumn:
+				return DBErrorNoSuchColumn
+			}
+		}
+	case "postgres":
+		var e *pgconn.PgError
+		if errors.As(err, &e) {
+			switch e.Code {
+			case pgsqlNoSuchTable:
+				return DBErrorNoSuchTable
+			case pgsqlDuplicateKey:
+				return DBErrorDuplicateKey
+			case pgsqlNoSuchColumn:
+				return DBErrorNoSuchColumn
+			}
+		}
+	case "sqlite":
+		// sqlite reports both as the generic SQLITE_ERROR / SQLITE_CONSTRAINT
+		// codes, only the message tells them apart
+		msg := err.Error()
+		switch {
+		case strings.HasPrefix(msg, "no such table"):
+			return DBErrorNoSuchTable
+		case strings.HasPrefix(msg, "UNIQUE constraint failed"):
+			return DBErrorDuplicateKey
+		case strings.HasPrefix(msg, "no such column"), strings.Contains(msg, "has no column named"):
+			return DBErrorNoSuchColumn
+		}
+	}
+	return DBErrorUnknown
+}
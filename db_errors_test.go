@@ -0,0 +1,127 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestClassifyDBError(t *testing.T) {
+	cases := []struct {
+		dialect string
+		err     error
+		kind    push.DBErrorKind
+	}{
+		{"mysql", &mysql.MySQLError{Number: 1146, Message: "Table 'push.q_hello' doesn't exist"}, push.DBErrorNoSuchTable},
+		{"mysql", fmt.Errorf("wrapped: %w", &mysql.MySQLError{Number: 1062}), push.DBErrorDuplicateKey},
+		{"mysql", &mysql.MySQLError{Number: 1045}, push.DBErrorUnknown},
+		{"mysql", &mysql.MySQLError{Number: 1054}, push.DBErrorNoSuchColumn},
+		{"postgres", &pgconn.PgError{Code: "42P01"}, push.DBErrorNoSuchTable},
+		{"postgres", &pgconn.PgError{Code: "23505"}, push.DBErrorDuplicateKey},
+		{"postgres", &pgconn.PgError{Code: "42703"}, push.DBErrorNoSuchColumn},
+		{"postgres", errors.New("no such table: q_hello"), push.DBErrorUnknown},
+		{"sqlite", errors.New("no such table: q_hello"), push.DBErrorNoSuchTable},
+		{"sqlite", errors.New("UNIQUE constraint failed: topics.name"), push.DBErrorDuplicateKey},
+		{"sqlite", errors.New("no such column: subscriber"), push.DBErrorNoSuchColumn},
+		{"sqlite", errors.New("table topic_read_offsets has no column named subscriber"), push.DBErrorNoSuchColumn},
+		{"sqlite", nil, push.DBErrorUnknown},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.kind, push.ClassifyDBError(c.dialect, c.err), "%s: %v", c.dialect, c.err)
+	}
+}
+
+type dialectCase struct {
+	name     string
+	open     func(t *testing.T) (*gorm.DB, sqlmock.Sqlmock)
+	topicSql string
+	getSql   string
+	err      error
+}
+
+var dialectCases = []dialectCase{
+	{
+		name: "mysql",
+		open: func(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+			db, mock, err := sqlmock.New()
+			assert.Nil(t, err)
+			gdb, err := gorm.Open(dialector(db))
+			assert.Nil(t, err)
+			return gdb, mock
+		},
+		topicSql: "SELECT \\* FROM `topics` WHERE name = \\? LIMIT \\?",
+		getSql:   "SELECT \\* FROM `q_hello` WHERE `offset` >= \\?",
+		err:      &mysql.MySQLError{Number: 1146, Message: "Table 'push.q_hello' doesn't exist"},
+	},
+	{
+		name: "postgres",
+		open: func(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+			db, mock, err := sqlmock.New()
+			assert.Nil(t, err)
+			gdb, err := gorm.Open(postgres.New(postgres.Config{Conn: db}))
+			assert.Nil(t, err)
+			return gdb, mock
+		},
+		topicSql: `SELECT \* FROM "topics" WHERE name = \$1 LIMIT \$2`,
+		getSql:   `SELECT \* FROM "q_hello" WHERE "offset" >= \$1`,
+		err:      &pgconn.PgError{Code: "42P01", Message: `relation "q_hello" does not exist`},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+			db, mock, err := sqlmock.New()
+			assert.Nil(t, err)
+			mock.ExpectQuery("select sqlite_version\\(\\)").
+				WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("3.45.1"))
+			gdb, err := gorm.Open(sqlite.New(sqlite.Config{Conn: db}))
+			assert.Nil(t, err)
+			return gdb, mock
+		},
+		topicSql: "SELECT \\* FROM `topics` WHERE name = \\? LIMIT 1",
+		getSql:   "SELECT \\* FROM `q_hello` WHERE `offset` >= \\?",
+		err:      errors.New("no such table: q_hello"),
+	},
+}
+
+func TestDBStorage_unknownTopic(t *testing.T) {
+	for _, c := range dialectCases {
+		t.Run(c.name, func(t *testing.T) {
+			gdb, mock := c.open(t)
+			mock.ExpectQuery(c.topicSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "created_at"}))
+			s := push.NewDBStorage(gdb)
+			err := s.Add(context.Background(), "hello", []*push.Message{push.NewMessage([]byte("hello"))})
+			assert.True(t, errors.Is(err, push.ErrQueueNotFound))
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDBStorage_droppedTable(t *testing.T) {
+	for _, c := range dialectCases {
+		t.Run(c.name, func(t *testing.T) {
+			gdb, mock := c.open(t)
+			mock.ExpectQuery(c.topicSql).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "created_at"}).AddRow(1, "hello", nil))
+			mock.ExpectQuery(c.getSql).WillReturnError(c.err)
+			// the topic is looked up in the catalog again once its table is missing
+			mock.ExpectQuery(c.topicSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "created_at"}))
+			s := push.NewDBStorage(gdb)
+			ctx := context.Background()
+			_, err := s.Get(ctx, "hello", 0, 10)
+			assert.True(t, errors.Is(err, push.ErrQueueNotFound))
+			_, err = s.Get(ctx, "hello", 0, 10)
+			assert.True(t, errors.Is(err, push.ErrQueueNotFound))
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
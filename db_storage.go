@@ -2,113 +2,619 @@ package push
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+// TopicReadOffset is the offset a subscriber consumes a topic from. Offsets
+// kept before they were per subscriber have an empty subscriber
 type TopicReadOffset struct {
-	Topic  string `gorm:"column:topic;type:VARCHAR(64);primarykey"`
-	Offset int64  `gorm:"column:offset;type:BIGINT"`
+	Topic      string `gorm:"column:topic;type:VARCHAR(64);primarykey"`
+	Subscriber string `gorm:"column:subscriber;type:VARCHAR(191);primarykey"`
+	Offset     int64  `gorm:"column:offset;type:BIGINT"`
 }
 
 func (TopicReadOffset) TableName() string {
 	return "topic_read_offsets"
 }
 
-type DBItem struct {
-	Offset    int64     `gorm:"column:offset;type:BIGINT;primarykey"`
-	Data      []byte    `gorm:"column:data;type:LONGTEXT"`
+// TopicSequence holds the offset the next message added to a topic gets
+type TopicSequence struct {
+	Topic      string `gorm:"column:topic;type:VARCHAR(191);primarykey"`
+	NextOffset int64  `gorm:"column:next_offset;type:BIGINT"`
+}
+
+func (TopicSequence) TableName() string {
+	return "topic_sequences"
+}
+
+// DBTopic is an entry of the topic catalog, a topic exists once it is in
+// the catalog
+type DBTopic struct {
+	ID        int64     `gorm:"column:id;primarykey;autoIncrement"`
+	Name      string    `gorm:"column:name;type:VARCHAR(191);uniqueIndex"`
 	CreatedAt time.Time `gorm:"column:created_at;autoCreate"`
 }
 
-type dbstorage struct {
-	DB    *gorm.DB
-	locks map[string]*sync.Mutex
-	lock  sync.RWMutex
+func (DBTopic) TableName() string {
+	return "topics"
 }
 
-func NewDBStorage(db *gorm.DB) ClientServerStorage {
-	return &dbstorage{DB: db}
+// DBMessage is a message of the single table layout, where the messages
+// of every topic are kept in the same table
+type DBMessage struct {
+	TopicID   int64      `gorm:"column:topic_id;primarykey;autoIncrement:false;index:idx_messages_topic_created,priority:1;index:idx_messages_topic_key,priority:1"`
+	Offset    int64      `gorm:"column:offset;primarykey;autoIncrement:false"`
+	Key       string     `gorm:"column:msg_key;type:VARCHAR(255);index:idx_messages_topic_key,priority:2"`
+	Data      []byte     `gorm:"column:data"`
+	Tombstone bool       `gorm:"column:tombstone"`
+	CreatedAt time.Time  `gorm:"column:created_at;autoCreate;index:idx_messages_topic_created,priority:2"`
+	ExpiresAt *time.Time `gorm:"column:expires_at"`
 }
 
-func (q *dbstorage) Add(ctx context.Context, name string, data [][]byte) error {
-	if len(data) == 0 {
-		return nil
+func (DBMessage) TableName() string {
+	return "messages"
+}
+
+type DBLayout string
+
+const (
+	// DBLayoutTablePerTopic keeps the messages of each topic in its own q_<topic> table
+	DBLayoutTablePerTopic DBLayout = "table_per_topic"
+	// DBLayoutSingleTable keeps the messages of every topic in the messages table
+	DBLayoutSingleTable DBLayout = "single_table"
+)
+
+const dbTablePrefix = "q_"
+
+type dbOptions struct {
+	layout DBLayout
+}
+
+type DBOption func(o *dbOptions)
+
+// WithDBLayout sets how the messages are kept, an empty layout keeps the
+// default table per topic layout
+func WithDBLayout(layout DBLayout) DBOption {
+	return func(o *dbOptions) {
+		if layout != "" {
+			o.layout = layout
+		}
 	}
-	q.lock.RLock()
-	locker, ok := q.locks[name]
-	q.lock.RUnlock()
-	if !ok {
-		locker = &sync.Mutex{}
-		q.lock.Lock()
-		if q.locks == nil {
-			q.locks = make(map[string]*sync.Mutex)
+}
+
+func getDBOptions(opts ...DBOption) dbOptions {
+	o := dbOptions{layout: DBLayoutTablePerTopic}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// ErrTopicTablesLeft is returned when migrating for the single table layout
+// a db that still keeps messages in q_<topic> tables
+var ErrTopicTablesLeft = errors.New("topic tables left, run MigrateToSingleTable first")
+
+// MigrateDB creates or updates the tables shared by every topic. A db
+// storage runs it itself the first time it finds one of them missing or
+// outdated, but a deployment should run it before serving so that schema
+// changes are applied up front. Topics whose table exists but which are not
+// in the catalog yet are added to it
+func MigrateDB(db *gorm.DB, opts ...DBOption) error {
+	if err := migrateReadOffsets(db); err != nil {
+		return fmt.Errorf("migrate read offsets: %w", err)
+	}
+	models := []any{&DBTopic{}, &TopicSequence{}, &TopicReadOffset{}}
+	single := getDBOptions(opts...).layout == DBLayoutSingleTable
+	if single {
+		models = append(models, &DBMessage{})
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		return err
+	}
+	if err := copyLegacyReadOffsets(db); err != nil {
+		return fmt.Errorf("migrate read offsets: %w", err)
+	}
+	tables, err := db.Migrator().GetTables()
+	if err != nil {
+		return fmt.Errorf("list tables: %w", err)
+	}
+	for _, table := range tables {
+		if !strings.HasPrefix(table, dbTablePrefix) {
+			continue
+		}
+		if single {
+			return fmt.Errorf("table [%s]: %w", table, ErrTopicTablesLeft)
 		}
-		q.locks[name] = locker
-		q.lock.Unlock()
+		err := db.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&DBTopic{Name: strings.TrimPrefix(table, dbTablePrefix)}).Error
+		if err != nil {
+			return fmt.Errorf("catalog table [%s]: %w", table, err)
+		}
+	}
+	return nil
+}
+
+type DBItem struct {
+	Offset    int64      `gorm:"column:offset;type:BIGINT;primarykey;autoIncrement:false"`
+	Key       string     `gorm:"column:msg_key;type:VARCHAR(255)"`
+	Data      []byte     `gorm:"column:data;type:LONGTEXT"`
+	Tombstone bool       `gorm:"column:tombstone"`
+	CreatedAt time.Time  `gorm:"column:created_at;autoCreate"`
+	ExpiresAt *time.Time `gorm:"column:expires_at"`
+}
+
+func (item DBItem) message() *Message {
+	m := &Message{
+		Offset:    item.Offset,
+		Key:       item.Key,
+		Data:      item.Data,
+		Tombstone: item.Tombstone,
+		CreatedAt: item.CreatedAt,
+	}
+	if item.ExpiresAt != nil {
+		m.ExpiresAt = *item.ExpiresAt
+	}
+	return m
+}
+
+type dbstorage struct {
+	DB     *gorm.DB
+	layout DBLayout
+	// topics caches the ids of the topics found in the catalog
+	topics sync.Map
+	// migrating serializes creating the shared tables
+	migrating sync.Mutex
+	// upgraded tells that a missing column made the storage migrate, which
+	// it does once
+	upgraded atomic.Bool
+}
+
+func NewDBStorage(db *gorm.DB, opts ...DBOption) ClientServerStorage {
+	return &dbstorage{DB: db, layout: getDBOptions(opts...).layout}
+}
+
+func (q *dbstorage) table(name string) string {
+	if q.layout == DBLayoutSingleTable {
+		return DBMessage{}.TableName()
 	}
-	locker.Lock()
-	defer locker.Unlock()
-	var total int64
-	if err := q.DB.WithContext(ctx).Table("q_" + name).Count(&total).Error; err != nil {
-		if err.Error() == "no such table: q_"+name {
-			return ErrQueueNotFound
+	return dbTablePrefix + name
+}
+
+// shared runs fn on the tables shared by every topic. When one of them is
+// missing, as the db was never migrated, or misses a column, as it has the
+// schema of an older version, they are created or upgraded by MigrateDB the
+// way topic tables are created on demand, and fn runs again. A storage in a
+// transaction of the caller never migrates
+func (q *dbstorage) shared(ctx context.Context, fn func(db *gorm.DB) error) error {
+	err := fn(q.DB.WithContext(ctx))
+	switch ClassifyDBError(q.DB.Dialector.Name(), err) {
+	case DBErrorNoSuchTable:
+	case DBErrorNoSuchColumn:
+		if q.upgraded.Swap(true) {
+			return err
 		}
-		return fmt.Errorf("get offset: %w", err)
+	default:
+		return err
+	}
+	if _, ok := q.DB.Statement.ConnPool.(gorm.TxCommitter); ok {
+		return err
+	}
+	q.migrating.Lock()
+	err = MigrateDB(q.DB.WithContext(ctx), WithDBLayout(q.layout))
+	q.migrating.Unlock()
+	if err != nil {
+		return fmt.Errorf("create shared tables: %w", err)
+	}
+	return fn(q.DB.WithContext(ctx))
+}
+
+// topicID returns the id of the topic in the catalog, or ErrQueueNotFound
+// when it isn't there
+func (q *dbstorage) topicID(ctx context.Context, name string) (int64, error) {
+	if id, ok := q.topics.Load(name); ok {
+		return id.(int64), nil
+	}
+	var topics []DBTopic
+	err := q.shared(ctx, func(db *gorm.DB) error {
+		return db.Where("name = ?", name).Limit(1).Find(&topics).Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("lookup topic: %w", err)
 	}
-	items := make([]*DBItem, len(data))
-	for i, bs := range data {
-		items[i] = &DBItem{
-			Data:   bs,
-			Offset: total + int64(i) + 1,
+	if len(topics) == 0 {
+		return 0, ErrQueueNotFound
+	}
+	q.topics.Store(name, topics[0].ID)
+	return topics[0].ID, nil
+}
+
+// messages returns a query on the messages of topic id
+func (q *dbstorage) messages(tx *gorm.DB, name string, id int64) *gorm.DB {
+	if q.layout == DBLayoutSingleTable {
+		return tx.Table(q.table(name)).Where("topic_id = ?", id)
+	}
+	return tx.Table(q.table(name))
+}
+
+// topicCond is the condition selecting the messages of topic id in raw queries
+func (q *dbstorage) topicCond(id int64) clause.Expr {
+	if q.layout == DBLayoutSingleTable {
+		return gorm.Expr("topic_id = ?", id)
+	}
+	return gorm.Expr("1 = 1")
+}
+
+func (q *dbstorage) insert(tx *gorm.DB, name string, id int64, items []*DBItem) error {
+	if q.layout != DBLayoutSingleTable {
+		return tx.Table(q.table(name)).Create(items).Error
+	}
+	msgs := make([]*DBMessage, len(items))
+	for i, item := range items {
+		msgs[i] = &DBMessage{
+			TopicID:   id,
+			Offset:    item.Offset,
+			Key:       item.Key,
+			Data:      item.Data,
+			Tombstone: item.Tombstone,
+			CreatedAt: item.CreatedAt,
+			ExpiresAt: item.ExpiresAt,
 		}
 	}
-	err := q.DB.WithContext(ctx).Table("q_" + name).Create(items).Error
-	if err != nil && err.Error() == "no such table: q_"+name {
+	return tx.Create(msgs).Error
+}
+
+// err translates the error of a query on the table of topic name, a
+// missing table means the topic doesn't exist any more
+func (q *dbstorage) err(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if q.layout == DBLayoutTablePerTopic && ClassifyDBError(q.DB.Dialector.Name(), err) == DBErrorNoSuchTable {
+		q.topics.Delete(name)
 		return ErrQueueNotFound
 	}
 	return err
 }
 
+func (q *dbstorage) Add(ctx context.Context, name string, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	id, err := q.topicID(ctx, name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	items := make([]*DBItem, len(msgs))
+	err = q.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		next, err := q.allocate(tx, name, id, int64(len(msgs)))
+		if err != nil {
+			return err
+		}
+		for i, m := range msgs {
+			items[i] = &DBItem{
+				Key:       m.Key,
+				Data:      m.Data,
+				Tombstone: m.Tombstone,
+				Offset:    next + int64(i),
+				CreatedAt: now,
+			}
+			if !m.ExpiresAt.IsZero() {
+				items[i].ExpiresAt = &m.ExpiresAt
+			}
+		}
+		return q.insert(tx, name, id, items)
+	})
+	if err != nil {
+		return q.err(name, err)
+	}
+	for i, m := range msgs {
+		m.Offset = items[i].Offset
+		m.CreatedAt = items[i].CreatedAt
+	}
+	return nil
+}
+
+// allocate reserves n offsets of the topic in the sequence row of the topic
+// and returns the first of them. The row stays locked by tx until it ends,
+// so that concurrent writers, even from other processes, never get the
+// same offsets
+func (q *dbstorage) allocate(tx *gorm.DB, name string, id, n int64) (int64, error) {
+	for {
+		r := tx.Model(&TopicSequence{}).
+			Where("topic = ?", name).
+			Update("next_offset", gorm.Expr("next_offset + ?", n))
+		if r.Error != nil {
+			return 0, fmt.Errorf("allocate offsets: %w", r.Error)
+		}
+		if r.RowsAffected > 0 {
+			var seq TopicSequence
+			if err := tx.Where("topic = ?", name).Take(&seq).Error; err != nil {
+				return 0, fmt.Errorf("allocate offsets: %w", err)
+			}
+			return seq.NextOffset - n, nil
+		}
+		// the sequence of topics created before sequences existed starts
+		// after the messages already kept
+		var last sql.NullInt64
+		if err := q.messages(tx, name, id).Select("MAX(?)", clause.Column{Name: "offset"}).Scan(&last).Error; err != nil {
+			return 0, err
+		}
+		next := int64(0)
+		if last.Valid {
+			next = last.Int64 + 1
+		}
+		r = tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&TopicSequence{Topic: name, NextOffset: next + n})
+		if r.Error != nil {
+			return 0, fmt.Errorf("allocate offsets: %w", r.Error)
+		}
+		if r.RowsAffected > 0 {
+			return next, nil
+		}
+		// another writer created the sequence meanwhile, allocate from it
+	}
+}
+
+func (q *dbstorage) Ping(ctx context.Context) error {
+	db, err := q.DB.DB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
+
 func (q *dbstorage) Create(ctx context.Context, name string) error {
-	return q.DB.WithContext(ctx).Table("q_" + name).AutoMigrate(&DBItem{})
+	if q.layout == DBLayoutTablePerTopic {
+		if err := q.DB.WithContext(ctx).Table(q.table(name)).AutoMigrate(&DBItem{}); err != nil {
+			return err
+		}
+	}
+	return q.shared(ctx, func(db *gorm.DB) error {
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&TopicSequence{Topic: name}).Error; err != nil {
+			return err
+		}
+		// the topic exists once in the catalog, so it's the last thing created
+		return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&DBTopic{Name: name}).Error
+	})
 }
 
-func (q *dbstorage) Get(ctx context.Context, name string, offset, limit int64) ([][]byte, error) {
-	data := [][]byte{}
-	err := q.DB.WithContext(ctx).Table("q_"+name).
-		Where("offset >= ?", offset).
+func (q *dbstorage) Get(ctx context.Context, name string, offset, limit int64) ([]*Message, error) {
+	id, err := q.topicID(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	items := []DBItem{}
+	col := clause.Column{Name: "offset"}
+	err = q.messages(q.DB.WithContext(ctx), name, id).
+		Where("? >= ?", col, offset).
 		Limit(int(limit)).
-		Order("offset asc").Pluck("data", &data).Error
-	if err != nil && err.Error() == "no such table: q_"+name {
-		return nil, ErrQueueNotFound
+		Order(clause.OrderByColumn{Column: col}).Find(&items).Error
+	if err != nil {
+		return nil, q.err(name, err)
+	}
+	ret := make([]*Message, len(items))
+	for i, item := range items {
+		ret[i] = item.message()
+	}
+	return ret, nil
+}
+
+func (q *dbstorage) OffsetAt(ctx context.Context, name string, t time.Time) (int64, error) {
+	id, err := q.topicID(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	var offset sql.NullInt64
+	err = q.messages(q.DB.WithContext(ctx), name, id).
+		Select("MIN(?)", clause.Column{Name: "offset"}).
+		Where("created_at >= ?", t).
+		Scan(&offset).Error
+	if err != nil {
+		return 0, q.err(name, err)
+	}
+	if offset.Valid {
+		return offset.Int64, nil
+	}
+	_, next, err := q.Bounds(ctx, name)
+	return next, err
+}
+
+func (q *dbstorage) Bounds(ctx context.Context, name string) (first, next int64, err error) {
+	id, err := q.topicID(ctx, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	var bounds struct {
+		First sql.NullInt64
+		Last  sql.NullInt64
+	}
+	col := clause.Column{Name: "offset"}
+	err = q.messages(q.DB.WithContext(ctx), name, id).
+		Select("MIN(?) AS first, MAX(?) AS last", col, col).
+		Scan(&bounds).Error
+	if err != nil {
+		return 0, 0, q.err(name, err)
+	}
+	if !bounds.Last.Valid {
+		return 0, 0, nil
+	}
+	return bounds.First.Int64, bounds.Last.Int64 + 1, nil
+}
+
+func (q *dbstorage) Size(ctx context.Context, name string) (int64, error) {
+	id, err := q.topicID(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	var size sql.NullInt64
+	err = q.messages(q.DB.WithContext(ctx), name, id).
+		Select("SUM(LENGTH(data))").
+		Scan(&size).Error
+	if err != nil {
+		return 0, q.err(name, err)
 	}
-	return data, err
+	return size.Int64, nil
 }
 
-func (q *dbstorage) SetOffset(ctx context.Context, topic string, offset int64) error {
-	return q.DB.WithContext(ctx).
-		Clauses(clause.OnConflict{UpdateAll: true}).
-		Create(TopicReadOffset{Topic: topic, Offset: offset}).Error
+func (q *dbstorage) Compact(ctx context.Context, name string, tombstoneBefore time.Time) (int64, error) {
+	id, err := q.topicID(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	var removed int64
+	err = q.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		table := clause.Table{Name: q.table(name)}
+		col := clause.Column{Name: "offset"}
+		cond := q.topicCond(id)
+		// the derived table lets mysql select from the table it deletes from
+		r := tx.Exec(
+			"DELETE FROM ? WHERE ? AND msg_key <> '' AND ? NOT IN "+
+				"(SELECT latest.o FROM (SELECT MAX(?) AS o FROM ? WHERE ? AND msg_key <> '' GROUP BY msg_key) AS latest)",
+			table, cond, col, col, table, cond,
+		)
+		if r.Error != nil {
+			return r.Error
+		}
+		removed += r.RowsAffected
+		// the last message is kept as the next offset is computed from it
+		r = tx.Exec(
+			"DELETE FROM ? WHERE ? AND msg_key <> '' AND tombstone = ? AND created_at < ? AND ? < "+
+				"(SELECT tail.o FROM (SELECT MAX(?) AS o FROM ? WHERE ?) AS tail)",
+			table, cond, true, tombstoneBefore, col, col, table, cond,
+		)
+		if r.Error != nil {
+			return r.Error
+		}
+		removed += r.RowsAffected
+		return nil
+	})
+	if err != nil {
+		if err = q.err(name, err); errors.Is(err, ErrQueueNotFound) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("compact: %w", err)
+	}
+	return removed, nil
 }
 
-func (q *dbstorage) GetOffset(ctx context.Context, topic string, offset *int64) error {
-	r := []int64{}
-	err := q.DB.WithContext(ctx).
-		Where("topic = ?", topic).
-		Limit(1).
-		Pluck("offset", &r).Error
+func (q *dbstorage) SetOffset(ctx context.Context, topic, subscriber string, offset int64) error {
+	return q.shared(ctx, func(db *gorm.DB) error {
+		return db.Clauses(clause.OnConflict{UpdateAll: true}).
+			Create(TopicReadOffset{Topic: topic, Subscriber: subscriber, Offset: offset}).Error
+	})
+}
+
+// GetOffset implements OffsetStorage. A subscriber without an offset of its
+// own starts from the offset of topic kept before offsets were per
+// subscriber, if any
+func (q *dbstorage) GetOffset(ctx context.Context, topic, subscriber string, offset *int64) error {
+	var r []TopicReadOffset
+	err := q.shared(ctx, func(db *gorm.DB) error {
+		return db.Where("topic = ? AND subscriber IN ?", topic, []string{subscriber, ""}).Find(&r).Error
+	})
 	if err != nil {
 		return err
 	}
-	if len(r) > 0 {
-		*offset = r[0]
-	} else {
-		*offset = 0
+	*offset = 0
+	for _, o := range r {
+		if o.Subscriber == subscriber {
+			*offset = o.Offset
+			break
+		}
+		*offset = o.Offset
 	}
 	return nil
 }
+
+// legacyReadOffsetsTable holds the read offsets kept by topic only while
+// they are migrated
+const legacyReadOffsetsTable = "topic_read_offsets_legacy"
+
+// migrateReadOffsets moves aside the read offsets table of before offsets
+// were per subscriber, as its primary key can't be changed in place. Its
+// rows are copied back by copyLegacyReadOffsets once the table is created
+// again, so an interrupted migration can simply be run again
+func migrateReadOffsets(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&TopicReadOffset{}) || m.HasColumn(&TopicReadOffset{}, "subscriber") || m.HasTable(legacyReadOffsetsTable) {
+		return nil
+	}
+	return m.RenameTable(TopicReadOffset{}.TableName(), legacyReadOffsetsTable)
+}
+
+func copyLegacyReadOffsets(db *gorm.DB) error {
+	if !db.Migrator().HasTable(legacyReadOffsetsTable) {
+		return nil
+	}
+	var offsets []TopicReadOffset
+	if err := db.Table(legacyReadOffsetsTable).Select("topic", "offset").Find(&offsets).Error; err != nil {
+		return err
+	}
+	if len(offsets) > 0 {
+		// offsets copied before an interruption are kept as they are
+		err := db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(offsets, 100).Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.Migrator().DropTable(legacyReadOffsetsTable)
+}
+
+// MigrateToSingleTable moves the messages of every q_<topic> table into the
+// messages table of the single table layout and drops the q_<topic> tables.
+// Each topic is moved in its own transaction, so an interrupted migration
+// can simply be run again
+func MigrateToSingleTable(db *gorm.DB) error {
+	if err := MigrateDB(db); err != nil {
+		return err
+	}
+	if err := db.AutoMigrate(&DBMessage{}); err != nil {
+		return err
+	}
+	tables, err := db.Migrator().GetTables()
+	if err != nil {
+		return fmt.Errorf("list tables: %w", err)
+	}
+	for _, table := range tables {
+		if !strings.HasPrefix(table, dbTablePrefix) {
+			continue
+		}
+		if err := migrateTopicTable(db, table); err != nil {
+			return fmt.Errorf("migrate table [%s]: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func migrateTopicTable(db *gorm.DB, table string) error {
+	var topic DBTopic
+	if err := db.Where("name = ?", strings.TrimPrefix(table, dbTablePrefix)).Take(&topic).Error; err != nil {
+		return err
+	}
+	// tables of old topics may miss the columns added since
+	if err := db.Table(table).AutoMigrate(&DBItem{}); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		col := clause.Column{Name: "offset"}
+		err := tx.Exec(
+			"INSERT INTO ? (topic_id, ?, msg_key, data, tombstone, created_at, expires_at) "+
+				"SELECT ?, ?, msg_key, data, tombstone, created_at, expires_at FROM ?",
+			clause.Table{Name: DBMessage{}.TableName()}, col, topic.ID, col, clause.Table{Name: table},
+		).Error
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().DropTable(table)
+	})
+}
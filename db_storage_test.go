@@ -3,13 +3,24 @@ package push_test
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
 	"github.com/tj/assert"
 	"github.com/yang-zzhong/go-push"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func dialector(db *sql.DB) gorm.Dialector {
@@ -20,18 +31,32 @@ func dialector(db *sql.DB) gorm.Dialector {
 	})
 }
 
+func expectTopic(mock sqlmock.Sqlmock, name string) {
+	mock.ExpectQuery("SELECT \\* FROM `topics` WHERE name = \\? LIMIT \\?").
+		WithArgs(name, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "created_at"}).AddRow(1, name, nil))
+}
+
 func TestCreateTable(t *testing.T) {
 	db, mock, err := sqlmock.New() // mock sql.DB
 	assert.Nil(t, err)
 	defer db.Close()
-	defer assert.Nil(t, mock.ExpectationsWereMet())
+	defer func() { assert.NoError(t, mock.ExpectationsWereMet()) }()
 	gdb, err := gorm.Open(dialector(db)) // open gorm db
 	assert.Nil(t, err)
 	func() {
 		querySql := "SELECT SCHEMA_NAME from Information_schema.SCHEMATA where SCHEMA_NAME LIKE \\? ORDER BY SCHEMA_NAME=\\? DESC,SCHEMA_NAME limit 1"
 		mock.ExpectQuery(querySql).WithArgs("%", "").WillReturnRows(&sqlmock.Rows{})
-		execSql := "CREATE TABLE `q_hello` \\(`offset` BIGINT,`data` LONGTEXT,`created_at` datetime\\(3\\) NULL\\)"
+		execSql := "CREATE TABLE `q_hello` \\(`offset` BIGINT,`msg_key` VARCHAR\\(255\\),`data` LONGTEXT,`tombstone` boolean,`created_at` datetime\\(3\\) NULL,`expires_at` datetime\\(3\\) NULL,PRIMARY KEY \\(`offset`\\)\\)"
 		mock.ExpectExec(execSql).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO `topic_sequences` \\(`topic`,`next_offset`\\) VALUES \\(\\?,\\?\\) ON DUPLICATE KEY UPDATE `topic`=`topic`").
+			WithArgs("hello", 0).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO `topics` \\(`name`,`created_at`\\) VALUES \\(\\?,\\?\\) ON DUPLICATE KEY UPDATE `id`=`id`").
+			WithArgs("hello", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
 	}()
 	s := push.NewDBStorage(gdb)
 	ctx := context.Background()
@@ -45,18 +70,23 @@ func TestAdd(t *testing.T) {
 	db, mock, err := sqlmock.New() // mock sql.DB
 	assert.Nil(t, err)
 	defer db.Close()
-	defer assert.Nil(t, mock.ExpectationsWereMet())
+	defer func() { assert.NoError(t, mock.ExpectationsWereMet()) }()
 	gdb, err := gorm.Open(dialector(db)) // open gorm db
 	assert.Nil(t, err)
 	func() {
+		expectTopic(mock, "hello")
 		mock.ExpectBegin()
-		execSql := "INSERT INTO `q_hello` \\(`offset`,`data`,`created_at`\\) VALUES \\(\\?,\\?,\\?\\)"
-		mock.ExpectExec(execSql).WithArgs(0, []byte("hello"), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE `topic_sequences` SET `next_offset`=next_offset \\+ \\? WHERE topic = \\?").
+			WithArgs(1, "hello").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT \\* FROM `topic_sequences` WHERE topic = \\? LIMIT \\?").
+			WithArgs("hello", 1).WillReturnRows(sqlmock.NewRows([]string{"topic", "next_offset"}).AddRow("hello", 1))
+		execSql := "INSERT INTO `q_hello` \\(`offset`,`msg_key`,`data`,`tombstone`,`created_at`,`expires_at`\\) VALUES \\(\\?,\\?,\\?,\\?,\\?,\\?\\)"
+		mock.ExpectExec(execSql).WithArgs(0, "", []byte("hello"), false, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
 		mock.ExpectCommit()
 	}()
 	s := push.NewDBStorage(gdb)
 	ctx := context.Background()
-	if err := s.Add(ctx, "hello", [][]byte{[]byte("hello")}); err != nil {
+	if err := s.Add(ctx, "hello", []*push.Message{push.NewMessage([]byte("hello"))}); err != nil {
 		t.Fatal(err)
 	}
 	assert.Nil(t, err)
@@ -66,11 +96,12 @@ func TestGet(t *testing.T) {
 	db, mock, err := sqlmock.New() // mock sql.DB
 	assert.Nil(t, err)
 	defer db.Close()
-	defer assert.Nil(t, mock.ExpectationsWereMet())
+	defer func() { assert.NoError(t, mock.ExpectationsWereMet()) }()
 	gdb, err := gorm.Open(dialector(db)) // open gorm db
 	assert.Nil(t, err)
 	func() {
-		execSql := "SELECT `data` FROM `q_hello` WHERE offset >= \\? ORDER BY offset asc LIMIT \\?"
+		expectTopic(mock, "hello")
+		execSql := "SELECT \\* FROM `q_hello` WHERE `offset` >= \\? ORDER BY `offset` LIMIT \\?"
 		mock.ExpectQuery(execSql).WithArgs(0, 1).WillReturnRows(&sqlmock.Rows{})
 	}()
 	s := push.NewDBStorage(gdb)
@@ -80,3 +111,158 @@ func TestGet(t *testing.T) {
 	}
 	assert.Nil(t, err)
 }
+
+func TestAdd_sequenceFromExistingTopic(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	defer func() { assert.NoError(t, mock.ExpectationsWereMet()) }()
+	gdb, err := gorm.Open(dialector(db))
+	assert.Nil(t, err)
+	func() {
+		expectTopic(mock, "hello")
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE `topic_sequences` SET `next_offset`=next_offset \\+ \\? WHERE topic = \\?").
+			WithArgs(2, "hello").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT MAX\\(`offset`\\) FROM `q_hello`").
+			WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(4))
+		mock.ExpectExec("INSERT INTO `topic_sequences` \\(`topic`,`next_offset`\\) VALUES \\(\\?,\\?\\) ON DUPLICATE KEY UPDATE `topic`=`topic`").
+			WithArgs("hello", 7).WillReturnResult(sqlmock.NewResult(1, 1))
+		execSql := "INSERT INTO `q_hello` \\(`offset`,`msg_key`,`data`,`tombstone`,`created_at`,`expires_at`\\) VALUES \\(\\?,\\?,\\?,\\?,\\?,\\?\\),\\(\\?,\\?,\\?,\\?,\\?,\\?\\)"
+		mock.ExpectExec(execSql).
+			WithArgs(5, "", []byte("a"), false, sqlmock.AnyArg(), nil, 6, "", []byte("b"), false, sqlmock.AnyArg(), nil).
+			WillReturnResult(sqlmock.NewResult(2, 2))
+		mock.ExpectCommit()
+	}()
+	s := push.NewDBStorage(gdb)
+	msgs := []*push.Message{push.NewMessage([]byte("a")), push.NewMessage([]byte("b"))}
+	assert.Nil(t, s.Add(context.Background(), "hello", msgs))
+	assert.Equal(t, int64(5), msgs[0].Offset)
+	assert.Equal(t, int64(6), msgs[1].Offset)
+}
+
+func TestAdd_postgres(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	defer func() { assert.NoError(t, mock.ExpectationsWereMet()) }()
+	gdb, err := gorm.Open(postgres.New(postgres.Config{Conn: db}))
+	assert.Nil(t, err)
+	func() {
+		mock.ExpectQuery(`SELECT \* FROM "topics" WHERE name = \$1 LIMIT \$2`).
+			WithArgs("hello", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "created_at"}).AddRow(1, "hello", nil))
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE "topic_sequences" SET "next_offset"=next_offset \+ \$1 WHERE topic = \$2`).
+			WithArgs(1, "hello").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(`SELECT MAX\("offset"\) FROM "q_hello"`).
+			WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(nil))
+		mock.ExpectExec(`INSERT INTO "topic_sequences" \("topic","next_offset"\) VALUES \(\$1,\$2\) ON CONFLICT DO NOTHING`).
+			WithArgs("hello", 1).WillReturnResult(sqlmock.NewResult(0, 0))
+		// another broker created the sequence meanwhile
+		mock.ExpectExec(`UPDATE "topic_sequences" SET "next_offset"=next_offset \+ \$1 WHERE topic = \$2`).
+			WithArgs(1, "hello").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(`SELECT \* FROM "topic_sequences" WHERE topic = \$1 LIMIT \$2`).
+			WithArgs("hello", 1).WillReturnRows(sqlmock.NewRows([]string{"topic", "next_offset"}).AddRow("hello", 4))
+		mock.ExpectExec(`INSERT INTO "q_hello" \("offset","msg_key","data","tombstone","created_at","expires_at"\) VALUES \(\$1,\$2,\$3,\$4,\$5,\$6\)`).
+			WithArgs(3, "", []byte("hello"), false, sqlmock.AnyArg(), nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}()
+	s := push.NewDBStorage(gdb)
+	msgs := []*push.Message{push.NewMessage([]byte("hello"))}
+	assert.Nil(t, s.Add(context.Background(), "hello", msgs))
+	assert.Equal(t, int64(3), msgs[0].Offset)
+}
+
+// TestAdd_concurrentWriters runs the writers of two brokers against sqlite,
+// which serializes them with its db lock
+func TestAdd_concurrentWriters(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "push.db") + "?_busy_timeout=10000"
+	concurrentWriters(t, func() *gorm.DB {
+		db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+		assert.Nil(t, err)
+		return db
+	})
+}
+
+// TestAdd_concurrentWritersPostgres runs the writers of two brokers against
+// postgres, which serializes them with the row lock of the sequence. It
+// runs against PUSH_TEST_POSTGRES_DSN, or else an embedded postgres, whose
+// binaries are downloaded on the first run
+func TestAdd_concurrentWritersPostgres(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs postgres")
+	}
+	dsn := os.Getenv("PUSH_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		port := uint32(l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+		cfg := embeddedpostgres.DefaultConfig().
+			Port(port).
+			RuntimePath(t.TempDir()).
+			Logger(io.Discard)
+		pg := embeddedpostgres.NewDatabase(cfg)
+		if err := pg.Start(); err != nil {
+			t.Skipf("can't start an embedded postgres, set PUSH_TEST_POSTGRES_DSN: %s", err.Error())
+		}
+		t.Cleanup(func() { assert.Nil(t, pg.Stop()) })
+		dsn = cfg.GetConnectionURL() + "?sslmode=disable"
+	}
+	concurrentWriters(t, func() *gorm.DB {
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+		assert.Nil(t, err)
+		return db
+	})
+}
+
+// concurrentWriters adds messages to a topic from two storages opened with
+// open at once, checking that no offset is allocated twice
+func concurrentWriters(t *testing.T, open func() *gorm.DB) {
+	// each storage has its own connection pool, like two brokers sharing a db
+	storages := make([]push.Storage, 2)
+	for i := range storages {
+		db := open()
+		assert.Nil(t, push.MigrateDB(db))
+		storages[i] = push.NewDBStorage(db)
+	}
+	ctx := context.Background()
+	// a topic of its own, as a db given by the environment may be shared
+	topic := fmt.Sprintf("concurrent-%d", time.Now().UnixNano())
+	assert.Nil(t, storages[0].Create(ctx, topic))
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		seen = make(map[int64]bool)
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(s push.Storage) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				msgs := []*push.Message{push.NewMessage([]byte("a")), push.NewMessage([]byte("b"))}
+				if err := s.Add(ctx, topic, msgs); err != nil {
+					t.Error(err)
+					return
+				}
+				lock.Lock()
+				for _, m := range msgs {
+					if seen[m.Offset] {
+						t.Errorf("offset [%d] allocated twice", m.Offset)
+					}
+					seen[m.Offset] = true
+				}
+				lock.Unlock()
+			}
+		}(storages[i%2])
+	}
+	wg.Wait()
+	msgs, err := storages[1].Get(ctx, topic, 0, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, 160, len(msgs))
+	for i, m := range msgs {
+		assert.Equal(t, int64(i), m.Offset)
+	}
+}
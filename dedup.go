@@ -0,0 +1,108 @@
+package push
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultDedupWindow is the number of batches remembered by default
+const defaultDedupWindow = 10000
+
+// WithDedupWindow sets how many of the last batches pushed with a batch id
+// are remembered, a batch pushed again within the window isn't added twice.
+// A batch failing on some partitions of a topic is completed by pushing it
+// again, which adds the other partitions only. Zero turns deduplication off
+func WithDedupWindow(n int) HTTPOption {
+	return func(b *httpBroker) {
+		b.batches = newPushBatches(n)
+	}
+}
+
+// PushResult tells where each message pushed was added, in the order of
+// the messages
+type PushResult struct {
+	Partitions []int   `json:"partitions"`
+	Offsets    []int64 `json:"offsets"`
+}
+
+// pushBatches remembers the results of the last batches pushed, so that a
+// batch pushed again, as a producer retrying it does, is added once
+type pushBatches struct {
+	window  int
+	lock    sync.Mutex
+	batches map[string]*pushBatch
+	// order holds the keys of the batches pushed, oldest first
+	order []string
+}
+
+type pushBatch struct {
+	// adding tells the batch is being added, done is closed once it's
+	// added or failed
+	adding bool
+	done   chan struct{}
+	result *PushResult
+	// added holds the offsets of the messages of each partition added, a
+	// batch failing on a partition is completed by adding the others only
+	added map[int][]int64
+}
+
+func newPushBatches(window int) *pushBatches {
+	if window <= 0 {
+		return nil
+	}
+	return &pushBatches{window: window, batches: make(map[string]*pushBatch)}
+}
+
+func batchKey(tenant *Tenant, topic, id string) string {
+	name := ""
+	if tenant != nil {
+		name = tenant.Name
+	}
+	return name + "\x00" + topic + "\x00" + id
+}
+
+// begin returns the batch of key. Its result is set when it was added
+// already. Otherwise the caller adds the partitions of the batch not in its
+// added ones and calls end, the batch pushed again meanwhile waits for it
+func (ps *pushBatches) begin(ctx context.Context, key string) (*pushBatch, error) {
+	for {
+		ps.lock.Lock()
+		b, ok := ps.batches[key]
+		if !ok {
+			b = &pushBatch{added: make(map[int][]int64)}
+			ps.batches[key] = b
+			ps.order = append(ps.order, key)
+			for len(ps.order) > ps.window {
+				delete(ps.batches, ps.order[0])
+				ps.order = ps.order[1:]
+			}
+		}
+		if b.result != nil {
+			ps.lock.Unlock()
+			return b, nil
+		}
+		if !b.adding {
+			b.adding = true
+			b.done = make(chan struct{})
+			ps.lock.Unlock()
+			return b, nil
+		}
+		done := b.done
+		ps.lock.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// end records the result of adding b, nil when it failed. The partitions
+// added by a batch failing are kept for it to be completed
+func (ps *pushBatches) end(b *pushBatch, result *PushResult) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	b.result = result
+	b.adding = false
+	close(b.done)
+}
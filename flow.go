@@ -0,0 +1,111 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSubscriberLagging ends the subscription of a subscriber too far
+	// behind the latest message of a partition
+	ErrSubscriberLagging = errors.New("subscriber is lagging")
+	ErrSubscriptionGone  = errors.New("subscription gone")
+)
+
+// defaultSubscribeWriteTimeout bounds the write of a batch to a subscriber
+// unless FlowControl sets another timeout
+const defaultSubscribeWriteTimeout = 30 * time.Second
+
+// FlowControl sets how the broker deals with slow subscribers
+type FlowControl struct {
+	// WriteTimeout bounds the write of a batch to a subscriber, which is
+	// disconnected when it doesn't read the batch in time
+	WriteTimeout time.Duration
+	// MaxLag is the number of messages a subscriber can be behind the
+	// latest message of a partition before it's disconnected, zero is
+	// unlimited
+	MaxLag int64
+}
+
+// credit counts the batches a subscriber is ready to receive
+type credit struct {
+	lock    sync.Mutex
+	n       int
+	granted chan struct{}
+}
+
+func newCredit(n int) *credit {
+	return &credit{n: n, granted: make(chan struct{}, 1)}
+}
+
+// take waits for a batch of credit and takes it
+func (c *credit) take(ctx context.Context) error {
+	for {
+		c.lock.Lock()
+		if c.n > 0 {
+			c.n--
+			c.lock.Unlock()
+			return nil
+		}
+		c.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.granted:
+		}
+	}
+}
+
+func (c *credit) grant(n int) {
+	c.lock.Lock()
+	c.n += n
+	c.lock.Unlock()
+	select {
+	case c.granted <- struct{}{}:
+	default:
+	}
+}
+
+// credits holds the credit of the subscriptions receiving batches on credit
+type credits struct {
+	lock sync.Mutex
+	subs map[string]*credit
+}
+
+func newCredits() *credits {
+	return &credits{subs: make(map[string]*credit)}
+}
+
+func creditKey(topic, subscriber string) string {
+	return topic + "\x00" + subscriber
+}
+
+// open starts counting the credit of a subscription, done must be called
+// once it ends
+func (cs *credits) open(topic, subscriber string, n int) (c *credit, done func()) {
+	key := creditKey(topic, subscriber)
+	c = newCredit(n)
+	cs.lock.Lock()
+	cs.subs[key] = c
+	cs.lock.Unlock()
+	return c, func() {
+		cs.lock.Lock()
+		defer cs.lock.Unlock()
+		if cs.subs[key] == c {
+			delete(cs.subs, key)
+		}
+	}
+}
+
+func (cs *credits) grant(topic, subscriber string, n int) error {
+	cs.lock.Lock()
+	c, ok := cs.subs[creditKey(topic, subscriber)]
+	cs.lock.Unlock()
+	if !ok {
+		return ErrSubscriptionGone
+	}
+	c.grant(n)
+	return nil
+}
@@ -0,0 +1,158 @@
+package push_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+// readEvent reads the next event of an event stream, as its lines
+func readEvent(r *bufio.Reader) ([]string, error) {
+	lines := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line = strings.TrimSuffix(line, "\n"); line == "" {
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestHTTPServer_credit(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("credited", [][]byte{[]byte("0"), []byte("1"), []byte("2")}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/credited/subscribe?subscriber=s&batch_size=1&credit=1", nil)
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	events := make(chan []string)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		for {
+			e, err := readEvent(r)
+			if err != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+	assert.Equal(t, []string{"event:start", `data:{"offsets":{"0":0}}`}, <-events)
+	assert.Equal(t, `data:{"partition":0,"start_offset":0,"data":["0"],"offsets":[0]}`, (<-events)[0])
+	select {
+	case e := <-events:
+		t.Fatalf("batch %v sent without credit", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	grant, err := http.Post(srv.URL+"/credited/credit", "application/json", strings.NewReader(`{"subscriber":"s","credit":2}`))
+	assert.Nil(t, err)
+	grant.Body.Close()
+	assert.Equal(t, `data:{"partition":0,"start_offset":1,"data":["1"],"offsets":[1]}`, (<-events)[0])
+	assert.Equal(t, `data:{"partition":0,"start_offset":2,"data":["2"],"offsets":[2]}`, (<-events)[0])
+}
+
+func TestHTTPServer_maxLag(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithFlowControl(push.FlowControl{
+		WriteTimeout: time.Second,
+		MaxLag:       1,
+	})))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("lagging", [][]byte{[]byte("0"), []byte("1"), []byte("2"), []byte("3")}))
+	resp, err := http.Get(srv.URL + "/lagging/subscribe?subscriber=s&batch_size=1")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	_, err = readEvent(r)
+	assert.Nil(t, err)
+	e, err := readEvent(r)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`data:{"partition":0,"start_offset":0,"data":["0"],"offsets":[0]}`}, e)
+	disconnect, err := readEvent(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "event:disconnect", disconnect[0])
+	assert.True(t, strings.Contains(disconnect[1], "subscriber is lagging: 3 messages behind partition [0]"))
+}
+
+func TestHTTPServer_writeTimeout(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithFlowControl(push.FlowControl{
+		WriteTimeout: 100 * time.Millisecond,
+	})))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	big := bytes.Repeat([]byte("x"), 1<<16)
+	for i := 0; i < 16; i++ {
+		batch := make([][]byte, 16)
+		for j := range batch {
+			batch[j] = big
+		}
+		assert.Nil(t, c.Push("slow-reader", batch))
+	}
+	// a subscriber never reading what it's sent
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, conn.(*net.TCPConn).SetReadBuffer(4096))
+	_, err = fmt.Fprintf(conn, "GET /slow-reader/subscribe?subscriber=s&batch_size=1 HTTP/1.1\r\nHost: push\r\n\r\n")
+	assert.Nil(t, err)
+
+	// the broker gives up on it, so that it can subscribe again
+	subscribed := func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/slow-reader/subscribe?subscriber=s&offset=latest", nil)
+		assert.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		// a subscription refused ends right away, an accepted one lasts
+		_, err = io.Copy(io.Discard, resp.Body)
+		return errors.Is(err, context.DeadlineExceeded)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !subscribed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the subscriber not reading is still subscribed")
+		}
+	}
+}
+
+func TestHTTPClient_credit(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, c.Push("client-credited", [][]byte{[]byte("a")}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	received := 0
+	go c.Subscribe(ctx, "client-credited", "s", func(msg push.SubMessage) int64 {
+		if received += len(msg.Data); received == 3 {
+			cancel()
+		}
+		return msg.NextOffset()
+	}, push.SubscribeCredit(1))
+	<-ctx.Done()
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
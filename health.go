@@ -0,0 +1,133 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+)
+
+const (
+	healthzPath     = "/healthz"
+	readyzPath      = "/readyz"
+	pprofPathPrefix = "/debug/pprof/"
+	// readyTimeout bounds the checks of a readiness probe
+	readyTimeout = 5 * time.Second
+)
+
+// HealthCheck checks a dependency the broker needs to serve
+type HealthCheck func(ctx context.Context) error
+
+// WithHealthCheck adds check, under name, to the checks of readiness
+func WithHealthCheck(name string, check HealthCheck) HTTPOption {
+	return func(b *httpBroker) {
+		b.checks = append(b.checks, namedCheck{name: name, check: check})
+	}
+}
+
+// WithPprof serves the profiles of net/http/pprof under /debug/pprof/, to
+// requests carrying the admin key when there is one
+func WithPprof(enabled bool) HTTPOption {
+	return func(b *httpBroker) {
+		b.pprof = enabled
+	}
+}
+
+type namedCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// CheckResult is the result of a check of a readiness probe
+type CheckResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Health is the detailed answer of the health endpoints
+type Health struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks,omitempty"`
+}
+
+// readiness runs the checks of readiness: the storage is reachable and the
+// server isn't shutting down, then the checks added with WithHealthCheck
+func (b httpBroker) readiness(ctx context.Context) Health {
+	checks := append([]namedCheck{
+		{name: "storage", check: b.storage.Ping},
+		{name: "shutdown", check: func(context.Context) error {
+			if b.drainer.isClosing() {
+				return ErrServerClosing
+			}
+			return nil
+		}},
+	}, b.checks...)
+	h := Health{Status: "ok", Checks: make([]CheckResult, len(checks))}
+	for i, c := range checks {
+		h.Checks[i] = CheckResult{Name: c.name, OK: true}
+		if err := c.check(ctx); err != nil {
+			h.Checks[i] = CheckResult{Name: c.name, Error: err.Error()}
+			h.Status = "unavailable"
+		}
+	}
+	return h
+}
+
+// serveHealth answers the health endpoints, with a plain status for probes
+// or the detailed checks in JSON when verbose is asked
+func (b httpBroker) serveHealth(w http.ResponseWriter, req *http.Request) {
+	h := Health{Status: "ok"}
+	if req.URL.Path == readyzPath {
+		ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+		defer cancel()
+		h = b.readiness(ctx)
+	}
+	status := http.StatusOK
+	if h.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	if _, verbose := req.URL.Query()["verbose"]; !verbose {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		w.Write([]byte(h.Status))
+		return
+	}
+	bs, err := json.Marshal(h)
+	if err != nil {
+		b.Logf(logf.Error, "marshal health: %s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(bs); err != nil {
+		b.Logf(logf.Error, "write health: %s", err.Error())
+	}
+}
+
+func (b httpBroker) servePprof(w http.ResponseWriter, req *http.Request) {
+	if !b.pprof {
+		b.writeResp(req, w, message(codeNotFound, "not found"))
+		return
+	}
+	if b.adminKey != "" && !b.isAdmin(req) {
+		b.writeResp(req, w, message(codeUnauthorized, ErrUnauthorized.Error()))
+		return
+	}
+	switch strings.TrimPrefix(req.URL.Path, pprofPathPrefix) {
+	case "cmdline":
+		pprof.Cmdline(w, req)
+	case "profile":
+		pprof.Profile(w, req)
+	case "symbol":
+		pprof.Symbol(w, req)
+	case "trace":
+		pprof.Trace(w, req)
+	default:
+		pprof.Index(w, req)
+	}
+}
@@ -0,0 +1,94 @@
+package push_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+func TestHTTPHandler_health(t *testing.T) {
+	failing := errors.New("down")
+	var check error
+	h := push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithHealthCheck("dependency", func(context.Context) error {
+		return check
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		bs, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return resp.StatusCode, string(bs)
+	}
+	status, body := get("/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", body)
+	status, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, status)
+
+	check = failing
+	status, body = get("/readyz?verbose")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	var health push.Health
+	assert.Nil(t, json.Unmarshal([]byte(body), &health))
+	assert.Equal(t, push.Health{Status: "unavailable", Checks: []push.CheckResult{
+		{Name: "storage", OK: true},
+		{Name: "shutdown", OK: true},
+		{Name: "dependency", Error: "down"},
+	}}, health)
+
+	check = nil
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, h.Shutdown(ctx))
+	status, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	// the process is still alive while draining
+	status, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestHTTPHandler_pprof(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/debug/pprof/")
+	assert.Nil(t, err)
+	var r push.Resp
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+	resp.Body.Close()
+	assert.Equal(t, "notfound", r.Code)
+
+	srv = httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithPprof(true), push.WithAdminKey("admin")))
+	defer srv.Close()
+	resp, err = http.Get(srv.URL + "/debug/pprof/cmdline")
+	assert.Nil(t, err)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+	resp.Body.Close()
+	assert.Equal(t, "unauthorized", r.Code)
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/debug/pprof/cmdline", nil)
+	assert.Nil(t, err)
+	// the key is taken from the Bearer scheme only
+	req.Header.Set("Authorization", "admin")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+	resp.Body.Close()
+	assert.Equal(t, "unauthorized", r.Code)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+}
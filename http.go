@@ -1,22 +1,111 @@
 package push
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dev-mockingbird/logf"
 )
 
 type httpBroker struct {
-	storage Storage
+	storage   Storage
+	queueOpts []QueueOption
+	// storages holds the storages of the tenants isolated from the others
+	storages map[string]Storage
+	// tenants authenticate requests when not nil
+	tenants        *Tenants
+	adminKey       string
+	principalLimit *rateLimiter
+	topicLimit     *rateLimiter
+	flow           FlowControl
+	credits        *credits
+	drainer        *drainer
+	checks         []namedCheck
+	pprof          bool
+	cors           *CORS
+	batches        *pushBatches
 	logf.Logger
 }
 
+// HTTPHandler serves the broker over http
+type HTTPHandler interface {
+	http.Handler
+	// Shutdown refuses new pushes and subscriptions, ends the subscriptions
+	// with a closing event telling the offsets to resume from, and waits
+	// for the pushes in flight until ctx is done
+	Shutdown(ctx context.Context) error
+	// Reload applies opts on top of the current options, atomically for the
+	// requests coming next. Tenants kept by WithTenants keep their usage,
+	// and queue options only apply to the queues created next
+	Reload(opts ...HTTPOption)
+}
+
+type HTTPOption func(b *httpBroker)
+
+// WithQueueOptions applies opts to every queue the handler creates
+func WithQueueOptions(opts ...QueueOption) HTTPOption {
+	return func(b *httpBroker) {
+		b.queueOpts = append(b.queueOpts, opts...)
+	}
+}
+
+// WithTenantStorage keeps the messages of the topics of tenant, named
+// tenant/topic, in s instead of the storage of the handler
+func WithTenantStorage(tenant string, s Storage) HTTPOption {
+	return func(b *httpBroker) {
+		if b.storages == nil {
+			b.storages = make(map[string]Storage)
+		}
+		b.storages[tenant] = s
+	}
+}
+
+// WithTenants requires every request to carry the key of one of tenants, as
+// a bearer token. Topics of requests are then scoped to the tenant of the
+// key, and its quotas enforced
+func WithTenants(tenants *Tenants) HTTPOption {
+	return func(b *httpBroker) {
+		b.tenants = tenants
+	}
+}
+
+// WithAdminKey enables the admin API, served under /_admin/ to requests
+// carrying key as a bearer token
+func WithAdminKey(key string) HTTPOption {
+	return func(b *httpBroker) {
+		b.adminKey = key
+	}
+}
+
+// WithRateLimit limits the rate of pushes, the pushes over the limit are
+// answered with 429 Too Many Requests and a Retry-After header
+func WithRateLimit(limit RateLimit) HTTPOption {
+	return func(b *httpBroker) {
+		b.principalLimit = newRateLimiter(limit.PrincipalRate, limit.PrincipalBurst)
+		b.topicLimit = newRateLimiter(limit.TopicRate, limit.TopicBurst)
+	}
+}
+
+// WithFlowControl sets how the handler deals with slow subscribers
+func WithFlowControl(fc FlowControl) HTTPOption {
+	return func(b *httpBroker) {
+		b.flow = fc
+	}
+}
+
 type Resp struct {
 	Code    string `json:"code"`
 	Message string `json:"message,omitempty"`
@@ -27,9 +116,16 @@ const (
 	codeInvalidParams = "invalid.params"
 	codeServerError   = "error.server"
 	codeNotFound      = "notfound"
+	codeUnauthorized  = "unauthorized"
+	codeQuotaExceeded = "quota.exceeded"
+	codeRateLimited   = "rate.limited"
+	codeServerClosing = "server.closing"
+	codeNotAllowed    = "method.notallowed"
 	codeOK            = "ok"
 )
 
+const adminPathPrefix = "/_admin/"
+
 func message(code, message string) Resp {
 	return Resp{
 		Code:    code,
@@ -37,36 +133,252 @@ func message(code, message string) Resp {
 	}
 }
 
-func NewHTTPHandler(s Storage, logger logf.Logger) http.Handler {
-	return httpBroker{storage: s, Logger: logger}
+func NewHTTPHandler(s Storage, logger logf.Logger, opts ...HTTPOption) HTTPHandler {
+	b := httpBroker{
+		storage: s,
+		Logger:  logger,
+		flow:    FlowControl{WriteTimeout: defaultSubscribeWriteTimeout},
+		credits: newCredits(),
+		drainer: newDrainer(),
+		batches: newPushBatches(defaultDedupWindow),
+	}
+	for _, opt := range opts {
+		opt(&b)
+	}
+	h := &httpHandler{}
+	h.broker.Store(&b)
+	return h
+}
+
+// httpHandler serves with its broker, which reloading replaces
+type httpHandler struct {
+	broker atomic.Pointer[httpBroker]
+	// lock serializes reloads
+	lock sync.Mutex
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.broker.Load().ServeHTTP(w, req)
+}
+
+func (h *httpHandler) Shutdown(ctx context.Context) error {
+	return h.broker.Load().drainer.shutdown(ctx)
+}
+
+func (h *httpHandler) Reload(opts ...HTTPOption) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	current := h.broker.Load()
+	b := *current
+	for _, opt := range opts {
+		opt(&b)
+	}
+	b.tenants = current.tenants.update(b.tenants)
+	b.principalLimit = current.principalLimit.update(b.principalLimit)
+	b.topicLimit = current.topicLimit.update(b.topicLimit)
+	h.broker.Store(&b)
 }
 
 func (b httpBroker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Method", "POST")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
-	if req.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusNoContent)
+	if b.cors != nil && b.cors.handle(w, req) {
+		return
+	}
+	// no route serves OPTIONS, only the preflights the CORS policy allows
+	if req.Method == http.MethodOptions {
+		w.Header().Set("Allow", "GET, POST")
+		b.writeJsonStatus(w, http.StatusMethodNotAllowed, message(codeNotAllowed, "method not allowed"))
 		return
 	}
 	if len(req.URL.Path) == 0 {
 		b.writeResp(req, w, message(codeNotFound, "not found"))
 		return
 	}
-	ps := strings.Split(req.URL.Path[1:], "/")
-	if len(ps) < 2 {
+	switch {
+	case req.URL.Path == healthzPath || req.URL.Path == readyzPath:
+		b.serveHealth(w, req)
+		return
+	case strings.HasPrefix(req.URL.Path, pprofPathPrefix):
+		b.servePprof(w, req)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, adminPathPrefix) {
+		b.admin(strings.TrimPrefix(req.URL.Path, adminPathPrefix), req, w)
+		return
+	}
+	// the path is /<topic>/<action>, where topic may be namespaced as tenant/topic
+	i := strings.LastIndex(req.URL.Path, "/")
+	if i <= 0 {
 		b.writeResp(req, w, message(codeNotFound, "not found"))
 		return
 	}
-	logger := b.Prefix(fmt.Sprintf("topic [%s]:", ps[0]))
-	switch ps[1] {
+	topic, action := req.URL.Path[1:i], req.URL.Path[i+1:]
+	if err := ValidateTopicName(topic); err != nil {
+		b.writeResp(req, w, message(codeInvalidParams, err.Error()))
+		return
+	}
+	var tenant *Tenant
+	if b.tenants != nil {
+		var err error
+		if tenant, err = b.authenticate(req); err != nil {
+			b.writeResp(req, w, message(codeUnauthorized, err.Error()))
+			return
+		}
+		// a tenant names its topics without its namespace
+		if t, _ := SplitTopic(topic); t != "" {
+			b.writeResp(req, w, message(codeInvalidParams, fmt.Sprintf("topic [%s] is namespaced", topic)))
+			return
+		}
+		topic = tenant.Scope(topic)
+		if err := ValidateTopicName(topic); err != nil {
+			b.writeResp(req, w, message(codeInvalidParams, err.Error()))
+			return
+		}
+	}
+	logger := b.Prefix(fmt.Sprintf("topic [%s]:", topic))
+	switch action {
 	case "subscribe":
-		b.subscribe(ps[0], req, w, logger)
+		b.subscribe(tenant, topic, req, w, logger)
 	case "unsubscribe":
-		b.unsubscribe(ps[0], w, req, logger)
+		b.unsubscribe(topic, w, req, logger)
+	case "credit":
+		b.credit(topic, w, req, logger)
 	case "push":
-		b.push(ps[0], req, w, logger)
+		b.push(tenant, topic, req, w, logger)
+	case "meta":
+		b.meta(topic, req, w)
+	default:
+		b.writeResp(req, w, message(codeNotFound, "not found"))
+	}
+}
+
+// authenticate returns the tenant of the key of req, or else of the client
+// certificate of req
+func (b httpBroker) authenticate(req *http.Request) (*Tenant, error) {
+	if key := bearerToken(req); key != "" {
+		return b.tenants.Authenticate(key)
+	}
+	return b.tenants.AuthenticateSubject(certSubject(req))
+}
+
+// principal identifies who pushes, for rate limiting
+func principal(tenant *Tenant, req *http.Request) string {
+	if tenant != nil {
+		return "tenant:" + tenant.Name
+	}
+	if subject := certSubject(req); subject != "" {
+		return "cert:" + subject
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// limit takes n tokens of the principal and the topic limits, answering
+// 429 when there aren't enough of them
+func (b httpBroker) limit(tenant *Tenant, topic string, n int, req *http.Request, w http.ResponseWriter) bool {
+	for _, l := range []struct {
+		limiter *rateLimiter
+		key     string
+		what    string
+	}{
+		{b.principalLimit, principal(tenant, req), "principal"},
+		{b.topicLimit, topic, fmt.Sprintf("topic [%s]", topic)},
+	} {
+		ok, wait, err := l.limiter.take(l.key, n)
+		if err != nil {
+			b.writeResp(req, w, message(codeInvalidParams, fmt.Sprintf("%s: %s", l.what, err.Error())))
+			return false
+		}
+		if !ok {
+			b.writeRateLimited(w, l.what, wait)
+			return false
+		}
+	}
+	return true
+}
+
+func (b httpBroker) writeRateLimited(w http.ResponseWriter, what string, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	b.writeJsonStatus(w, http.StatusTooManyRequests, message(codeRateLimited, what+" pushes too fast"))
+}
+
+// bearerToken returns the token of the Bearer authorization of req, empty
+// without one
+func bearerToken(req *http.Request) string {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// isAdmin tells whether req carries the admin key, comparing the digests
+// so that the time taken tells nothing of the key, not even its length
+func (b httpBroker) isAdmin(req *http.Request) bool {
+	token := bearerToken(req)
+	if token == "" || b.adminKey == "" {
+		return false
+	}
+	got, want := sha256.Sum256([]byte(token)), sha256.Sum256([]byte(b.adminKey))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// storageOf returns the storage keeping the messages of topic
+func (b httpBroker) storageOf(topic string) Storage {
+	tenant, _ := SplitTopic(topic)
+	if s, ok := b.storages[tenant]; ok && tenant != "" {
+		return s
+	}
+	return b.storage
+}
+
+// topic returns the topic of name, accounting it to tenant when not nil.
+// The expired messages of the topic are routed to topics resolved alike
+func (b httpBroker) topic(tenant *Tenant, name string, autoCreate bool) (*Topic, error) {
+	opts := append(b.queueOpts[:len(b.queueOpts):len(b.queueOpts)], withExpiredTopics(func(name string) (*Topic, error) {
+		return b.topic(nil, name, true)
+	}))
+	if tenant != nil {
+		if err := tenant.useTopic(name); err != nil {
+			return nil, err
+		}
+		opts = append(opts[:len(opts):len(opts)], WithTenant(tenant))
+	}
+	return GetTopic(name, b.storageOf(name), autoCreate, opts...)
+}
+
+// errorCode returns the code of the response to err
+func errorCode(err error, code string) string {
+	switch {
+	case errors.Is(err, ErrQuotaExceeded):
+		return codeQuotaExceeded
+	case errors.Is(err, ErrUnauthorized):
+		return codeUnauthorized
+	}
+	return code
+}
+
+func (b httpBroker) admin(path string, req *http.Request, w http.ResponseWriter) {
+	if b.adminKey == "" {
+		b.writeResp(req, w, message(codeNotFound, "not found"))
+		return
+	}
+	if !b.isAdmin(req) {
+		b.writeResp(req, w, message(codeUnauthorized, ErrUnauthorized.Error()))
+		return
+	}
+	switch path {
+	case "tenants":
+		var usage []TenantUsage
+		if b.tenants != nil {
+			usage = b.tenants.Usage()
+		}
+		b.writeResp(req, w, Resp{Code: codeOK, Data: usage})
+	default:
+		b.writeResp(req, w, message(codeNotFound, "not found"))
 	}
 }
 
@@ -80,15 +392,43 @@ func (b httpBroker) unsubscribe(topic string, w http.ResponseWriter, req *http.R
 		return
 	}
 	logger.Logf(logf.Info, "unsubscribe: %s", logf.JSON(data))
-	q := GetQueue(topic, b.storage, false)
-	q.Unsubscribe(data.Subscriber)
+	if t, ok := lookupTopic(topic, b.storageOf(topic)); ok {
+		t.Unsubscribe(data.Subscriber)
+	}
+	b.writeResp(req, w, message(codeOK, "ok"))
+}
+
+// credit grants a subscription receiving batches on credit more batches
+func (b httpBroker) credit(topic string, w http.ResponseWriter, req *http.Request, logger logf.Logger) {
+	var data struct {
+		Subscriber string `json:"subscriber"`
+		Credit     int    `json:"credit"`
+	}
+	if err := b.readParams(req, &data); err != nil {
+		logger.Logf(logf.Info, "credit: readParams: %s", err.Error())
+		b.writeResp(req, w, message(codeInvalidParams, err.Error()))
+		return
+	}
+	if data.Credit <= 0 {
+		b.writeResp(req, w, message(codeInvalidParams, fmt.Sprintf("invalid credit [%d]", data.Credit)))
+		return
+	}
+	if err := b.credits.grant(topic, data.Subscriber, data.Credit); err != nil {
+		b.writeResp(req, w, message(codeNotFound, err.Error()))
+		return
+	}
 	b.writeResp(req, w, message(codeOK, "ok"))
 }
 
-func (b httpBroker) push(topic string, req *http.Request, w http.ResponseWriter, logger logf.Logger) {
+func (b httpBroker) push(tenant *Tenant, topic string, req *http.Request, w http.ResponseWriter, logger logf.Logger) {
 	var body struct {
-		Body       []string `json:"body"`
-		AutoCreate bool     `json:"auto_create"`
+		Body       []string      `json:"body"`
+		Messages   []PushMessage `json:"messages"`
+		AutoCreate bool          `json:"auto_create"`
+		TTL        int64         `json:"ttl"`
+		// BatchID identifies the batch for it to be added once, however
+		// many times it's pushed
+		BatchID string `json:"batch_id"`
 	}
 	if err := b.readParams(req, &body); err != nil {
 		logger.Logf(logf.Error, "pushing message: read message: %s", err.Error())
@@ -96,16 +436,68 @@ func (b httpBroker) push(topic string, req *http.Request, w http.ResponseWriter,
 		return
 	}
 	logger.Logf(logf.Info, "pushing message: %s", logf.JSON(body))
-	q := GetQueue(topic, b.storage, body.AutoCreate)
-	data := make([][]byte, len(body.Body))
-	for i, d := range body.Body {
-		data[i] = []byte(d)
+	if !b.drainer.begin(&b.drainer.pushes) {
+		b.writeJsonStatus(w, http.StatusServiceUnavailable, message(codeServerClosing, ErrServerClosing.Error()))
+		return
 	}
-	if err := q.Add(context.Background(), data...); err != nil {
+	defer b.drainer.pushes.Done()
+	msgs := make([]*Message, 0, len(body.Body)+len(body.Messages))
+	for _, d := range body.Body {
+		msgs = append(msgs, NewMessage([]byte(d)).WithTTL(time.Duration(body.TTL)*time.Second))
+	}
+	for _, m := range body.Messages {
+		ttl := body.TTL
+		if m.TTL != 0 {
+			ttl = m.TTL
+		}
+		msg := NewMessage([]byte(m.Data)).WithTTL(time.Duration(ttl) * time.Second).WithKey(m.Key)
+		if m.Tombstone {
+			msg.AsTombstone()
+		}
+		msgs = append(msgs, msg)
+	}
+	// the topic quota and the batch are accounted only once the push is
+	// let through
+	if !b.limit(tenant, topic, len(msgs), req, w) {
+		logger.Logf(logf.Info, "pushing message: rate limited")
+		return
+	}
+	t, err := b.topic(tenant, topic, body.AutoCreate)
+	if err != nil {
+		logger.Logf(logf.Error, "pushing message: get topic: %s", err.Error())
+		b.writeResp(req, w, message(errorCode(err, codeInvalidParams), err.Error()))
+		return
+	}
+	var result *PushResult
+	var added map[int][]int64
+	if body.BatchID != "" && b.batches != nil {
+		batch, err := b.batches.begin(req.Context(), batchKey(tenant, topic, body.BatchID))
+		if err != nil {
+			logger.Logf(logf.Error, "pushing message: batch [%s]: %s", body.BatchID, err.Error())
+			b.writeResp(req, w, message(codeServerError, err.Error()))
+			return
+		}
+		if batch.result != nil {
+			logger.Logf(logf.Info, "pushing message: batch [%s] added already", body.BatchID)
+			b.writeResp(req, w, Resp{Code: codeOK, Data: *batch.result})
+			return
+		}
+		added = batch.added
+		defer func() { b.batches.end(batch, result) }()
+	}
+	// the add ends with the request: a client gone or timed out gets no
+	// answer, and retrying the batch adds the partitions not added yet
+	partitions, err := t.addMessages(req.Context(), msgs, added)
+	if err != nil {
 		logger.Logf(logf.Error, "pushing message: add message: %s", err.Error())
+		b.writeResp(req, w, message(errorCode(err, codeServerError), err.Error()))
 		return
 	}
-	b.writeJson(w, message(codeOK, ""))
+	result = &PushResult{Partitions: partitions, Offsets: make([]int64, len(msgs))}
+	for i, m := range msgs {
+		result.Offsets[i] = m.Offset
+	}
+	b.writeJson(w, Resp{Code: codeOK, Data: result})
 }
 
 func (b httpBroker) readParams(req *http.Request, data any) error {
@@ -125,103 +517,329 @@ func (b httpBroker) writeResp(_ *http.Request, w http.ResponseWriter, resp Resp)
 	b.writeJson(w, resp)
 }
 
-func (b httpBroker) subscribeParams(req *http.Request) (
-	subscriber string,
-	offset int,
-	batchSize int,
-	autoCreate bool,
-	err error,
-) {
-	subscriber = req.FormValue("subscriber")
+const (
+	positionEarliest = "earliest"
+	positionLatest   = "latest"
+)
+
+type subscribeParams struct {
+	subscriber string
+	offset     int64
+	// position is either positionEarliest or positionLatest, overriding offset
+	position string
+	// since overrides offset when not zero
+	since time.Time
+	// offsets holds offsets of partitions given explicitly, as "partition:offset" pairs
+	offsets    map[int]int64
+	partitions []int
+	batchSize  int
+	autoCreate bool
+	// credit is the number of batches sent before the subscriber grants
+	// more, zero means batches are sent without waiting for credit
+	credit int
+}
+
+func (b httpBroker) subscribeParams(req *http.Request) (p subscribeParams, err error) {
+	p.subscriber = req.FormValue("subscriber")
 	offsetStr := req.FormValue("offset")
 	batchSizeStr := req.FormValue("batch_size")
-	offset = 0
-	if offsetStr != "" {
-		if offset, err = strconv.Atoi(offsetStr); err != nil {
+	switch offsetStr {
+	case "":
+	case positionEarliest, positionLatest:
+		p.position = offsetStr
+	default:
+		if p.offset, err = strconv.ParseInt(offsetStr, 10, 64); err != nil {
 			err = fmt.Errorf("parse offset: %w", err)
 			return
 		}
 	}
-	batchSize = 20
+	if sinceStr := req.FormValue("since"); sinceStr != "" {
+		if p.since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			err = fmt.Errorf("parse since: %w", err)
+			return
+		}
+	}
+	if offsetsStr := req.FormValue("offsets"); offsetsStr != "" {
+		p.offsets = make(map[int]int64)
+		for _, pair := range strings.Split(offsetsStr, ",") {
+			var (
+				partition int
+				offset    int64
+			)
+			if _, err = fmt.Sscanf(pair, "%d:%d", &partition, &offset); err != nil {
+				err = fmt.Errorf("parse offsets [%s]: %w", pair, err)
+				return
+			}
+			p.offsets[partition] = offset
+		}
+	}
+	if partitionsStr := req.FormValue("partitions"); partitionsStr != "" {
+		for _, ps := range strings.Split(partitionsStr, ",") {
+			var partition int
+			if partition, err = strconv.Atoi(ps); err != nil {
+				err = fmt.Errorf("parse partitions: %w", err)
+				return
+			}
+			p.partitions = append(p.partitions, partition)
+		}
+	}
+	p.batchSize = 20
 	if batchSizeStr != "" {
-		if batchSize, err = strconv.Atoi(batchSizeStr); err != nil {
+		if p.batchSize, err = strconv.Atoi(batchSizeStr); err != nil {
 			err = fmt.Errorf("parse batch size: %w", err)
 			return
 		}
 	}
-	if subscriber == "" {
+	if p.subscriber == "" {
 		err = errors.New("subscriber should not be empty")
 		return
 	}
+	if creditStr := req.FormValue("credit"); creditStr != "" {
+		if p.credit, err = strconv.Atoi(creditStr); err != nil || p.credit < 0 {
+			err = fmt.Errorf("invalid credit [%s]", creditStr)
+			return
+		}
+	}
 	ac := req.FormValue("auto_create")
-	autoCreate = ac != "" && ac != "0"
+	p.autoCreate = ac != "" && ac != "0"
 	return
 }
 
-func (b httpBroker) subscribe(topic string, req *http.Request, w http.ResponseWriter, logger logf.Logger) {
-	subscriber, offset, batchSize, autoCreate, err := b.subscribeParams(req)
+// topicOffsets returns the offset to subscribe each partition of t from.
+// Without partitions given, every partition is subscribed
+func (p subscribeParams) topicOffsets(ctx context.Context, t *Topic) (map[int]int64, error) {
+	partitions := p.partitions
+	if len(partitions) == 0 {
+		for i := 0; i < t.Partitions(); i++ {
+			partitions = append(partitions, i)
+		}
+	}
+	ret := make(map[int]int64, len(partitions))
+	for _, partition := range partitions {
+		if offset, ok := p.offsets[partition]; ok {
+			ret[partition] = offset
+			continue
+		}
+		q, err := t.Queue(partition)
+		if err != nil {
+			return nil, err
+		}
+		offset := p.offset
+		switch {
+		case !p.since.IsZero():
+			if offset, err = q.OffsetAt(ctx, p.since); err != nil {
+				return nil, fmt.Errorf("partition [%d]: offset at [%s]: %w", partition, p.since, err)
+			}
+		case p.position == positionEarliest:
+			if offset, _, err = q.Bounds(ctx); err != nil {
+				return nil, fmt.Errorf("partition [%d]: bounds: %w", partition, err)
+			}
+		case p.position == positionLatest:
+			if _, offset, err = q.Bounds(ctx); err != nil {
+				return nil, fmt.Errorf("partition [%d]: bounds: %w", partition, err)
+			}
+		}
+		ret[partition] = offset
+	}
+	return ret, nil
+}
+
+func (b httpBroker) subscribe(tenant *Tenant, topic string, req *http.Request, w http.ResponseWriter, logger logf.Logger) {
+	params, err := b.subscribeParams(req)
 	if err != nil {
 		logger.Logf(logf.Error, "subscribe: read params:  %s", err.Error())
 		b.writeResp(req, w, message(codeInvalidParams, err.Error()))
 		return
 	}
+	if !b.drainer.begin(&b.drainer.subs) {
+		b.writeJsonStatus(w, http.StatusServiceUnavailable, message(codeServerClosing, ErrServerClosing.Error()))
+		return
+	}
+	defer b.drainer.subs.Done()
+	t, err := b.topic(tenant, topic, params.autoCreate)
+	if err != nil {
+		logger.Logf(logf.Error, "subscribe: get topic: %s", err.Error())
+		b.writeResp(req, w, message(errorCode(err, codeInvalidParams), err.Error()))
+		return
+	}
+	if tenant != nil {
+		release, err := tenant.subscribe()
+		if err != nil {
+			logger.Logf(logf.Error, "subscribe: %s", err.Error())
+			b.writeResp(req, w, message(codeQuotaExceeded, err.Error()))
+			return
+		}
+		defer release()
+	}
+	offsets, err := params.topicOffsets(req.Context(), t)
+	if err != nil {
+		logger.Logf(logf.Error, "subscribe: %s", err.Error())
+		b.writeResp(req, w, message(codeInvalidParams, err.Error()))
+		return
+	}
 	logger.Logf(
-		logf.Error,
-		"subscribe: subscriber [%s], offset [%d], batch size [%s], auto create [%v]",
-		subscriber, offset, batchSize, autoCreate,
+		logf.Info,
+		"subscribe: subscriber [%s], offsets %v, batch size [%d], auto create [%v]",
+		params.subscriber, offsets, params.batchSize, params.autoCreate,
 	)
-	q := GetQueue(topic, b.storage, autoCreate)
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.WriteHeader(http.StatusOK)
 	rc := http.NewResponseController(w)
-	err = q.Subscribe(
-		req.Context(),
-		subscriber,
-		int64(offset),
-		batchSize,
-		func(d [][]byte, startOffset int64) error {
-			bs, err := json.Marshal(struct {
-				Data        []string `json:"data"`
-				StartOffset int64    `json:"start_offset"`
-			}{
-				Data: func() []string {
-					ret := make([]string, len(d))
-					for i, v := range d {
-						ret[i] = string(v)
-					}
-					return ret
-				}(),
-				StartOffset: startOffset,
-			})
+	// the subscriber knows it's connected, and where each partition starts
+	// from, before any message comes
+	bs, _ := json.Marshal(Start{Offsets: offsets})
+	if err := b.writeEvent(rc, w, eventStart, bs); err != nil {
+		logger.Logf(logf.Error, "subscribe: write start: %s", err.Error())
+		return
+	}
+	var c *credit
+	if params.credit > 0 {
+		var done func()
+		c, done = b.credits.open(topic, params.subscriber, params.credit)
+		defer done()
+	}
+	drainCtx, cancel := b.drainer.subscribeContext(req.Context())
+	defer cancel()
+	// the subscription is ended by cancelling its context with the cause,
+	// for the partition subscriptions to stop alike
+	ctx, stop := context.WithCancelCause(drainCtx)
+	defer stop(nil)
+	// resume holds the offset each partition resumes from
+	resume := make(map[int]int64, len(offsets))
+	for p, offset := range offsets {
+		resume[p] = offset
+	}
+	err = t.Subscribe(
+		ctx,
+		params.subscriber,
+		offsets,
+		params.batchSize,
+		func(partition int, msgs []*Message) error {
+			if c != nil {
+				if err := c.take(ctx); err != nil {
+					return nil
+				}
+			}
+			sm := newSubMessage(msgs)
+			sm.Partition = partition
+			bs, err := json.Marshal(sm)
 			if err != nil {
 				logger.Logf(logf.Error, "subscribe: marshal data: %s", err.Error())
 				return nil
 			}
-			if _, err = w.Write(append(append([]byte("data:"), bs...), []byte("\n\n")...)); err != nil {
-				logger.Logf(logf.Error, "subscribe: write data: %s", err.Error())
+			if err := b.writeEvent(rc, w, "", bs); err != nil {
+				stop(err)
 				return nil
 			}
-			if err := rc.Flush(); err != nil {
-				logger.Logf(logf.Error, "subscribe: flush: %s", err.Error())
-				return nil
+			if len(msgs) > 0 {
+				resume[partition] = msgs[len(msgs)-1].Offset + 1
+			}
+			if err := b.checkLag(ctx, t, partition, msgs); err != nil {
+				stop(err)
 			}
 			return nil
 		})
-	if err != nil {
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+	switch {
+	case b.drainer.isClosing() && req.Context().Err() == nil:
+		logger.Logf(logf.Info, "subscribe: server closing, resume offsets %v", resume)
+		bs, _ := json.Marshal(Closing{Reason: ErrServerClosing.Error(), Offsets: resume})
+		if err := b.writeEvent(rc, w, eventClosing, bs); err != nil {
+			logger.Logf(logf.Error, "subscribe: write closing: %s", err.Error())
+		}
+	case errors.Is(err, ErrSubscriberLagging):
+		logger.Logf(logf.Error, "subscribe: %s", err.Error())
+		bs, _ := json.Marshal(Disconnect{Reason: err.Error()})
+		if err := b.writeEvent(rc, w, eventDisconnect, bs); err != nil {
+			logger.Logf(logf.Error, "subscribe: write disconnect: %s", err.Error())
+		}
+	case err != nil:
 		logger.Logf(logf.Error, "subscribe: %s", err.Error())
 	}
 }
 
+// eventDisconnect is the event telling a subscriber why it's disconnected
+const eventDisconnect = "disconnect"
+
+// eventStart is the first event of a subscription
+const eventStart = "start"
+
+// Start is the data of the start event, Offsets holds the offset each
+// subscribed partition starts from, as a start position or time resolves
+type Start struct {
+	Offsets map[int]int64 `json:"offsets"`
+}
+
+// Disconnect is the data of the disconnect event
+type Disconnect struct {
+	Reason string `json:"reason"`
+}
+
+// writeEvent writes an event to a subscriber within the write timeout, an
+// error means the subscriber is gone or too slow to read
+func (b httpBroker) writeEvent(rc *http.ResponseController, w http.ResponseWriter, event string, data []byte) error {
+	if b.flow.WriteTimeout > 0 {
+		if err := rc.SetWriteDeadline(time.Now().Add(b.flow.WriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return fmt.Errorf("set write deadline: %w", err)
+		}
+		defer rc.SetWriteDeadline(time.Time{})
+	}
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event:" + event + "\n")
+	}
+	buf.WriteString("data:")
+	buf.Write(data)
+	buf.WriteString("\n\n")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write data: %w", err)
+	}
+	if err := rc.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return nil
+}
+
+// checkLag ends the subscription when the last message sent is more than
+// the max lag behind the latest message of the partition
+func (b httpBroker) checkLag(ctx context.Context, t *Topic, partition int, msgs []*Message) error {
+	if b.flow.MaxLag <= 0 || len(msgs) == 0 {
+		return nil
+	}
+	q, err := t.Queue(partition)
+	if err != nil {
+		return err
+	}
+	_, next, err := q.Bounds(ctx)
+	if err != nil {
+		return fmt.Errorf("bounds: %w", err)
+	}
+	if lag := next - msgs[len(msgs)-1].Offset - 1; lag > b.flow.MaxLag {
+		return fmt.Errorf("%w: %d messages behind partition [%d]", ErrSubscriberLagging, lag, partition)
+	}
+	return nil
+}
+
+func (b httpBroker) meta(topic string, req *http.Request, w http.ResponseWriter) {
+	b.writeResp(req, w, Resp{Code: codeOK, Data: TopicMeta{Partitions: TopicPartitions(topic)}})
+}
+
 func (b httpBroker) writeJson(w http.ResponseWriter, data Resp) {
+	b.writeJsonStatus(w, http.StatusOK, data)
+}
+
+func (b httpBroker) writeJsonStatus(w http.ResponseWriter, status int, data Resp) {
 	w.Header().Set("Content-Type", "application/json")
 	bs, err := json.Marshal(data)
 	if err != nil {
 		b.Logf(logf.Error, "marshal json: %s", err.Error())
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	if _, err := w.Write(bs); err != nil {
 		b.Logf(logf.Error, "write json: %s", err.Error())
 	}
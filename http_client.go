@@ -4,66 +4,487 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/dev-mockingbird/logf"
 	"github.com/r3labs/sse/v2"
+	"gopkg.in/cenkalti/backoff.v1"
 )
 
+// ErrInvalidParams is the error of requests the broker rejects as invalid
+var ErrInvalidParams = errors.New("invalid params")
+
 type HTTPClient struct {
-	Endpoint      string
+	Endpoint string
+	// APIKey authenticates the client as a tenant of the broker
+	APIKey        string
 	OffsetStorage OffsetStorage
-	Underlying    http.Client
+	// TLS sets up the transport of Underlying when it has none
+	TLS        *TLSOptions
+	Underlying http.Client
 	logf.Logfer
-	init          sync.Once
-	subscribeLock sync.Mutex
+	init    sync.Once
+	initErr error
+}
+
+type subscribeOptions struct {
+	partitions []int
+	// position is the start position sent as offset, overriding stored offsets
+	position  string
+	since     time.Time
+	credit    int
+	reconnect Reconnect
+	workers   int
+	byKey     bool
+}
+
+type SubscribeOption func(o *subscribeOptions)
+
+// SubscribePartitions subscribes only the given partitions of the topic
+// instead of all of them
+func SubscribePartitions(partitions ...int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.partitions = append(o.partitions, partitions...)
+	}
+}
+
+// SubscribeSince consumes the messages created since t, whatever the
+// offsets stored are
+func SubscribeSince(t time.Time) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.since = t
+	}
+}
+
+// SubscribeFromEarliest consumes from the earliest message kept, whatever the
+// offsets stored are
+func SubscribeFromEarliest() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.position = positionEarliest
+	}
+}
+
+// SubscribeFromLatest consumes only the messages pushed from now on, whatever
+// the offsets stored are
+func SubscribeFromLatest() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.position = positionLatest
+	}
+}
+
+// SubscribeCredit lets the broker send at most n batches ahead of the ones
+// handled, the client grants a batch of credit back once it handled one
+func SubscribeCredit(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.credit = n
+	}
+}
+
+// PartitionOffsetKey is the key the offset of a topic partition is kept
+// under in OffsetStorage. Partition 0 uses the topic itself so that the
+// offsets of single partition topics are plain topic offsets
+func PartitionOffsetKey(topic string, partition int) string {
+	if partition == 0 {
+		return topic
+	}
+	return fmt.Sprintf("%s#%d", topic, partition)
+}
+
+// Subscribe consumes topic as subscriber, committing the offset handle
+// returns to OffsetStorage under the topic and subscriber, so that a client
+// can run many subscriptions at once. It reconnects as set by
+// SubscribeReconnect when the stream fails or ends, and returns when ctx is
+// done or on an error it doesn't retry
+func (c *HTTPClient) Subscribe(
+	ctx context.Context,
+	topic string,
+	subscriber string,
+	handle SubscribeHandler,
+	opts ...SubscribeOption,
+) error {
+	return c.consume(ctx, topic, subscriber, opts, func(_ context.Context, _ context.CancelCauseFunc, _ *subscribeOptions, offsets *committer) batchHandler {
+		return &sequentialHandler{handler: handle, offsets: offsets}
+	})
+}
+
+// SubscribeMessages consumes topic as subscriber like Subscribe, handling
+// its messages one by one, by as many goroutines as SubscribeWorkers sets.
+// Offsets are committed up to the first message not handled yet, so that
+// messages are handled at least once. A handle error ends the stream, which
+// reconnects from the message failing
+func (c *HTTPClient) SubscribeMessages(
+	ctx context.Context,
+	topic string,
+	subscriber string,
+	handle MessageHandler,
+	opts ...SubscribeOption,
+) error {
+	return c.consume(ctx, topic, subscriber, opts, func(ctx context.Context, cancel context.CancelCauseFunc, o *subscribeOptions, offsets *committer) batchHandler {
+		return newWorkerPool(ctx, cancel, o.workers, o.byKey, handle, offsets)
+	})
+}
+
+// batchHandler handles the batches of a stream
+type batchHandler interface {
+	// handle is called on the goroutine reading the stream, done is called
+	// once the messages of msg are handled and their offsets committed
+	handle(msg SubMessage, done func())
+	// wait waits for the batches in flight once the stream ended, it
+	// returns the error of handling them
+	wait() error
+}
+
+// newBatchHandler returns the batchHandler of a stream, cancel ends the
+// stream
+type newBatchHandler func(ctx context.Context, cancel context.CancelCauseFunc, o *subscribeOptions, offsets *committer) batchHandler
+
+type sequentialHandler struct {
+	handler SubscribeHandler
+	offsets *committer
+}
+
+func (h *sequentialHandler) handle(msg SubMessage, done func()) {
+	h.offsets.commit(msg.Partition, h.handler(msg))
+	done()
+}
+
+func (h *sequentialHandler) wait() error {
+	return nil
+}
+
+// committer commits the offsets of a subscription, and keeps the ones
+// committed last for reconnections to resume from
+type committer struct {
+	ctx        context.Context
+	c          *HTTPClient
+	topic      string
+	subscriber string
+	lock       sync.Mutex
+	acked      map[int]int64
+	// persisting serializes storing offsets, so that an offset stored never
+	// overwrites a later one
+	persisting sync.Mutex
+	stored     map[int]int64
 }
 
-func (c *HTTPClient) Subscribe(ctx context.Context, topic string, subscriber string, handle SubscribeHandler) error {
+func (cm *committer) commit(partition int, offset int64) {
+	cm.record(partition, offset)
+	cm.persist(partition)
+}
+
+// record sets the offset committed last of partition
+func (cm *committer) record(partition int, offset int64) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.acked[partition] = offset
+}
+
+// persist stores the offset recorded last of partition in OffsetStorage,
+// unless it's stored already
+func (cm *committer) persist(partition int) {
+	cm.persisting.Lock()
+	defer cm.persisting.Unlock()
+	cm.lock.Lock()
+	offset := cm.acked[partition]
+	cm.lock.Unlock()
+	if stored, ok := cm.stored[partition]; ok && stored == offset {
+		return
+	}
+	if err := cm.c.OffsetStorage.SetOffset(cm.ctx, PartitionOffsetKey(cm.topic, partition), cm.subscriber, offset); err != nil {
+		cm.c.Logf(logf.Error, "subscribe: set offset: %s", err.Error())
+		return
+	}
+	cm.stored[partition] = offset
+}
+
+// pin sets the offset partition resumes from as long as none is committed,
+// so that reconnections don't resolve the start position again
+func (cm *committer) pin(offsets map[int]int64) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	for partition, offset := range offsets {
+		if _, ok := cm.acked[partition]; !ok {
+			cm.acked[partition] = offset
+		}
+	}
+}
+
+// offset returns the offset committed last of partition, or the one it
+// started from, false when there's none yet
+func (cm *committer) offset(partition int) (int64, bool) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	offset, ok := cm.acked[partition]
+	return offset, ok
+}
+
+// handleError is the error of a handler ending a stream
+type handleError struct {
+	err error
+}
+
+func (e handleError) Error() string {
+	return "subscribe: handle: " + e.err.Error()
+}
+
+func (e handleError) Unwrap() error {
+	return e.err
+}
+
+// consume runs the streams of a subscription until ctx is done or an
+// error isn't retried
+func (c *HTTPClient) consume(
+	ctx context.Context,
+	topic string,
+	subscriber string,
+	opts []SubscribeOption,
+	newHandler newBatchHandler,
+) error {
 	if err := c.doInit(); err != nil {
 		return err
 	}
-	c.subscribeLock.Lock()
-	defer c.subscribeLock.Unlock()
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
+	var o subscribeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	offsets := &committer{
+		ctx:        ctx,
+		c:          c,
+		topic:      topic,
+		subscriber: subscriber,
+		acked:      make(map[int]int64),
+		stored:     make(map[int]int64),
+	}
+	retry := newReconnectBackoff(o.reconnect)
+	for {
+		connected, err := c.subscribe(ctx, topic, subscriber, &o, offsets, newHandler)
+		if connected && retry.OnDisconnect != nil {
+			retry.OnDisconnect(err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// a handler failing again doesn't reconnect sooner for connecting
+		delay, ok := retry.next(connected && !errors.As(err, &handleError{}), err)
+		if !ok {
+			return err
+		}
+		if err != nil {
+			c.Logf(logf.Warn, "subscribe: reconnect in %s: %s", delay, err.Error())
+		} else {
+			c.Logf(logf.Info, "subscribe: stream ended, reconnect in %s", delay)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// subscribe consumes the stream of topic once, it tells whether the stream
+// was established
+func (c *HTTPClient) subscribe(
+	ctx context.Context,
+	topic string,
+	subscriber string,
+	o *subscribeOptions,
+	committed *committer,
+	newHandler newBatchHandler,
+) (connected bool, err error) {
 	u, err := url.Parse(c.Endpoint)
 	if err != nil {
-		return err
+		return false, err
 	}
-	var offset int64
-	if err := c.OffsetStorage.GetOffset(ctx, topic, &offset); err != nil {
-		return err
+	partitions := o.partitions
+	if len(partitions) == 0 {
+		meta, err := c.Meta(ctx, topic)
+		if err != nil {
+			return false, err
+		}
+		for i := 0; i < meta.Partitions; i++ {
+			partitions = append(partitions, i)
+		}
+	}
+	ps := make([]string, len(partitions))
+	var offsets []string
+	for i, p := range partitions {
+		ps[i] = strconv.Itoa(p)
+		offset, ok := committed.offset(p)
+		if !ok {
+			// the start position applies to the partitions not started yet
+			if !o.since.IsZero() || o.position != "" {
+				continue
+			}
+			if err := c.OffsetStorage.GetOffset(ctx, PartitionOffsetKey(topic, p), subscriber, &offset); err != nil {
+				return false, err
+			}
+		}
+		offsets = append(offsets, fmt.Sprintf("%d:%d", p, offset))
 	}
 	u.Path = fmt.Sprintf("/%s/subscribe", topic)
 	q := u.Query()
 	q.Set("subscriber", subscriber)
-	q.Set("offset", fmt.Sprintf("%d", offset))
+	q.Set("partitions", strings.Join(ps, ","))
+	switch {
+	case !o.since.IsZero():
+		q.Set("since", o.since.Format(time.RFC3339Nano))
+	case o.position != "":
+		q.Set("offset", o.position)
+	}
+	if len(offsets) > 0 {
+		q.Set("offsets", strings.Join(offsets, ","))
+	}
+	if o.credit > 0 {
+		q.Set("credit", strconv.Itoa(o.credit))
+	}
 	u.RawQuery = q.Encode()
 	client := sse.NewClient(u.String())
-	return client.SubscribeWithContext(ctx, subscriber, func(msg *sse.Event) {
+	client.Connection.Transport = c.Underlying.Transport
+	// reconnections are up to Subscribe, which resumes from the offsets
+	// handled instead of the ones of the first request
+	client.ReconnectStrategy = &backoff.StopBackOff{}
+	client.ResponseValidator = func(_ *sse.Client, resp *http.Response) error {
+		if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			connected = true
+			if o.reconnect.OnConnect != nil {
+				o.reconnect.OnConnect()
+			}
+			return nil
+		}
+		defer resp.Body.Close()
+		var r Resp
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			return fmt.Errorf("subscribe: %s", resp.Status)
+		}
+		if err := respError("subscribe", r); err != nil {
+			return err
+		}
+		return fmt.Errorf("subscribe: %s", resp.Status)
+	}
+	if c.APIKey != "" {
+		client.Headers["Authorization"] = "Bearer " + c.APIKey
+	}
+	streamCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	h := newHandler(streamCtx, cancel, o, committed)
+	err = client.SubscribeWithContext(streamCtx, subscriber, func(msg *sse.Event) {
+		switch string(msg.Event) {
+		case eventStart:
+			var start Start
+			if err := json.Unmarshal(msg.Data, &start); err != nil {
+				c.Logf(logf.Error, "subscribe: unmarshal start: %s", err.Error())
+				return
+			}
+			committed.pin(start.Offsets)
+			return
+		case eventDisconnect:
+			var d Disconnect
+			if err := json.Unmarshal(msg.Data, &d); err != nil {
+				c.Logf(logf.Error, "subscribe: unmarshal disconnect: %s", err.Error())
+				return
+			}
+			c.Logf(logf.Warn, "subscribe: disconnected by broker: %s", d.Reason)
+			return
+		case eventClosing:
+			var closing Closing
+			if err := json.Unmarshal(msg.Data, &closing); err != nil {
+				c.Logf(logf.Error, "subscribe: unmarshal closing: %s", err.Error())
+				return
+			}
+			c.Logf(logf.Info, "subscribe: broker closing, resume offsets %v", closing.Offsets)
+			return
+		}
 		var e SubMessage
 		if err := json.Unmarshal(msg.Data, &e); err != nil {
 			c.Logf(logf.Error, "subscribe: unmarshal data: %s", err.Error())
 			return
 		}
-		offset = handle(e)
-		if err := c.OffsetStorage.SetOffset(ctx, topic, offset); err != nil {
-			c.Logf(logf.Error, "subscribe: set offset: %s", err.Error())
-		}
+		// the credit of a batch is granted back once it's handled
+		h.handle(e, func() {
+			if o.credit > 0 {
+				if err := c.grantCredit(streamCtx, topic, subscriber, 1); err != nil {
+					c.Logf(logf.Error, "subscribe: grant credit: %s", err.Error())
+				}
+			}
+		})
 	})
+	if herr := h.wait(); herr != nil {
+		return connected, herr
+	}
+	return connected, err
 }
 
-func (c *HTTPClient) Push(topic string, data [][]byte) error {
-	if err := c.doInit(); err != nil {
+// grantCredit lets the broker send n more batches to subscriber
+func (c *HTTPClient) grantCredit(ctx context.Context, topic, subscriber string, n int) error {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
 		return err
 	}
-	u, err := url.Parse(c.Endpoint)
+	u.Path = fmt.Sprintf("/%s/credit", topic)
+	bs, err := json.Marshal(map[string]any{"subscriber": subscriber, "credit": n})
 	if err != nil {
 		return err
 	}
-	u.Path = fmt.Sprintf("/%s/push", topic)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	c.authorize(req)
+	resp, err := c.Underlying.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var r Resp
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("credit: decode response: %w", err)
+	}
+	return respError("credit", r)
+}
+
+// Meta returns the metadata of topic, such as its number of partitions
+func (c *HTTPClient) Meta(ctx context.Context, topic string) (TopicMeta, error) {
+	var meta TopicMeta
+	if err := c.doInit(); err != nil {
+		return meta, err
+	}
+	if err := ValidateTopicName(topic); err != nil {
+		return meta, err
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return meta, err
+	}
+	u.Path = fmt.Sprintf("/%s/meta", topic)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return meta, err
+	}
+	c.authorize(req)
+	resp, err := c.Underlying.Do(req)
+	if err != nil {
+		return meta, err
+	}
+	defer resp.Body.Close()
+	r := Resp{Data: &meta}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return meta, fmt.Errorf("meta: decode response: %w", err)
+	}
+	return meta, respError("meta", r)
+}
+
+func (c *HTTPClient) Push(topic string, data [][]byte) error {
 	body := struct {
 		Body       []string `json:"body"`
 		AutoCreate bool     `json:"auto_create"`
@@ -74,34 +495,112 @@ func (c *HTTPClient) Push(topic string, data [][]byte) error {
 	for i, v := range data {
 		body.Body[i] = string(v)
 	}
+	_, err := c.push(context.Background(), topic, body)
+	return err
+}
+
+// PushMessages pushes messages carrying their own options, such as TTL
+func (c *HTTPClient) PushMessages(topic string, msgs []PushMessage) error {
+	_, err := c.PushBatch(context.Background(), topic, "", msgs)
+	return err
+}
+
+// PushBatch pushes msgs as the batch of id, which the broker adds once
+// however many times it's pushed within its dedup window, an empty id is
+// no batch. It returns where the messages were added
+func (c *HTTPClient) PushBatch(ctx context.Context, topic, id string, msgs []PushMessage) (PushResult, error) {
+	return c.push(ctx, topic, struct {
+		Messages   []PushMessage `json:"messages"`
+		AutoCreate bool          `json:"auto_create"`
+		BatchID    string        `json:"batch_id,omitempty"`
+	}{
+		Messages:   msgs,
+		AutoCreate: true,
+		BatchID:    id,
+	})
+}
+
+func (c *HTTPClient) push(ctx context.Context, topic string, body any) (PushResult, error) {
+	var result PushResult
+	if err := c.doInit(); err != nil {
+		return result, err
+	}
+	if err := ValidateTopicName(topic); err != nil {
+		return result, err
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return result, err
+	}
+	u.Path = fmt.Sprintf("/%s/push", topic)
 	bs, err := json.Marshal(body)
 	if err != nil {
-		return err
+		return result, err
 	}
-	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(bs))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(bs))
 	if err != nil {
-		return err
+		return result, err
 	}
-	_, err = c.Underlying.Do(req)
+	c.authorize(req)
+	resp, err := c.Underlying.Do(req)
 	if err != nil {
-		return err
+		return result, err
+	}
+	defer resp.Body.Close()
+	r := Resp{Data: &result}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return result, fmt.Errorf("push: decode response: %w", err)
+	}
+	return result, respError("push", r)
+}
+
+// respError returns the error of an unsuccessful response r of op
+func respError(op string, r Resp) error {
+	switch r.Code {
+	case codeOK:
+		return nil
+	case codeQuotaExceeded:
+		return fmt.Errorf("%s: %w: %s", op, ErrQuotaExceeded, r.Message)
+	case codeUnauthorized:
+		return fmt.Errorf("%s: %w", op, ErrUnauthorized)
+	case codeRateLimited:
+		return fmt.Errorf("%s: %w: %s", op, ErrRateLimited, r.Message)
+	case codeInvalidParams:
+		return fmt.Errorf("%s: %w: %s", op, ErrInvalidParams, r.Message)
+	case codeServerClosing:
+		return fmt.Errorf("%s: %w", op, ErrServerClosing)
+	}
+	return fmt.Errorf("%s: %s: %s", op, r.Code, r.Message)
+}
+
+func (c *HTTPClient) authorize(req *http.Request) {
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
 	}
-	return nil
 }
 
 func (c *HTTPClient) doInit() error {
-	var err error
 	c.init.Do(func() {
-		if c.Endpoint == "" {
-			err = fmt.Errorf("invalid endpoint [%s]", err.Error())
-			return
-		}
 		if c.Logfer == nil {
 			c.Logfer = logf.New()
 		}
+		if c.Endpoint == "" {
+			c.initErr = fmt.Errorf("invalid endpoint [%s]", c.Endpoint)
+			return
+		}
 		if c.OffsetStorage == nil {
 			c.OffsetStorage = NewMemoryOffsetStorage()
 		}
+		if c.TLS != nil && c.Underlying.Transport == nil {
+			cfg, err := c.TLS.ClientConfig()
+			if err != nil {
+				c.initErr = fmt.Errorf("tls: %w", err)
+				return
+			}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = cfg
+			c.Underlying.Transport = transport
+		}
 	})
-	return err
+	return c.initErr
 }
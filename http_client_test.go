@@ -0,0 +1,140 @@
+package push_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+func TestHTTPClient_partitions(t *testing.T) {
+	assert.Nil(t, push.DeclareTopic("http-partitioned", 3))
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	meta, err := c.Meta(ctx, "http-partitioned")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, meta.Partitions)
+	err = c.PushMessages("http-partitioned", []push.PushMessage{
+		{Data: "a1", Key: "a"},
+		{Data: "b1", Key: "b"},
+		{Data: "a2", Key: "a"},
+		{Data: "c1", Key: "c"},
+	})
+	assert.Nil(t, err)
+	var (
+		lock     sync.Mutex
+		received []string
+	)
+	go c.Subscribe(ctx, "http-partitioned", "s", func(msg push.SubMessage) int64 {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, msg.Data...)
+		if len(received) == 4 {
+			cancel()
+		}
+		return msg.NextOffset()
+	})
+	<-ctx.Done()
+	lock.Lock()
+	defer lock.Unlock()
+	sort.Strings(received)
+	assert.Equal(t, []string{"a1", "a2", "b1", "c1"}, received)
+	var offset int64
+	topic, err := push.GetTopic("http-partitioned", nil, false)
+	assert.Nil(t, err)
+	p := topic.Partition("a")
+	// the handler committed the offset of the partition of "a"
+	assert.Nil(t, c.OffsetStorage.GetOffset(context.Background(), push.PartitionOffsetKey("http-partitioned", p), "s", &offset))
+	assert.True(t, offset >= 2)
+}
+
+func TestHTTPClient_since(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("http-replay", [][]byte{[]byte("old")}))
+	time.Sleep(20 * time.Millisecond)
+	since := time.Now()
+	assert.Nil(t, c.Push("http-replay", [][]byte{[]byte("new")}))
+	subscribe := func(subscriber string, opt push.SubscribeOption) []string {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var received []string
+		go c.Subscribe(ctx, "http-replay", subscriber, func(msg push.SubMessage) int64 {
+			received = append(received, msg.Data...)
+			cancel()
+			return msg.NextOffset()
+		}, opt)
+		<-ctx.Done()
+		return received
+	}
+	assert.Equal(t, []string{"new"}, subscribe("since", push.SubscribeSince(since)))
+	assert.Equal(t, []string{"old", "new"}, subscribe("earliest", push.SubscribeFromEarliest()))
+}
+
+func TestHTTPClient_tenant(t *testing.T) {
+	shared, tenant := push.NewMemoryStorage(), push.NewMemoryStorage()
+	srv := httptest.NewServer(push.NewHTTPHandler(shared, logf.New(), push.WithTenantStorage("team-a", tenant)))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("team-a/orders", [][]byte{[]byte("a")}))
+	assert.Nil(t, c.Push("team-b/orders", [][]byte{[]byte("b")}))
+	ctx := context.Background()
+	msgs, err := tenant.Get(ctx, "team-a/orders", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+	_, err = shared.Get(ctx, "team-a/orders", 0, 10)
+	assert.True(t, errors.Is(err, push.ErrQueueNotFound))
+	msgs, err = shared.Get(ctx, "team-b/orders", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+	assert.True(t, errors.Is(c.Push("_sys-expired", [][]byte{[]byte("x")}), push.ErrInvalidTopicName))
+	resp, err := http.Get(srv.URL + "/_sys-expired/meta")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var r push.Resp
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+	assert.Equal(t, "invalid.params", r.Code)
+}
+
+func TestHTTPClient_concurrentSubscribers(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("http-shared", [][]byte{[]byte("a"), []byte("b"), []byte("c")}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	// each subscriber handles its own number of messages
+	for subscriber, n := range map[string]int{"first": 1, "all": 3} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			c.Subscribe(ctx, "http-shared", subscriber, func(msg push.SubMessage) int64 {
+				cancel()
+				return msg.Offset(n-1) + 1
+			})
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, ctx.Err())
+	for subscriber, want := range map[string]int64{"first": 1, "all": 3} {
+		var offset int64
+		assert.Nil(t, c.OffsetStorage.GetOffset(context.Background(), "http-shared", subscriber, &offset))
+		assert.Equal(t, want, offset, subscriber)
+	}
+}
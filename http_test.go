@@ -1,12 +1,17 @@
 package push_test
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net/http"
-	"os"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
 	"github.com/yang-zzhong/go-push"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -14,16 +19,47 @@ import (
 )
 
 func TestHTTPServer(t *testing.T) {
-	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{Logger: logger.New(
-		log.New(os.Stdout, "\r\n", log.LstdFlags),
-		logger.Config{LogLevel: logger.Info}),
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	assert.Nil(t, err)
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewDBStorage(db), logf.New()))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("http-server", [][]byte{[]byte("a"), []byte("b")}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got []string
+	c.Subscribe(ctx, "http-server", "s1", func(msg push.SubMessage) int64 {
+		got = append(got, msg.Data...)
+		if len(got) == 2 {
+			cancel()
+		}
+		return msg.NextOffset()
 	})
-	if err != nil {
-		t.Fatal(err)
+	assert.Equal(t, []string{"a", "b"}, got)
+}
+
+// ctxStorage fails adding once the context of the add is done
+type ctxStorage struct {
+	push.Storage
+}
+
+func (s ctxStorage) Add(ctx context.Context, name string, msgs []*push.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	s := http.Server{
-		Addr:    ":8081",
-		Handler: push.NewHTTPHandler(push.NewDBStorage(db), logf.New()),
+	return s.Storage.Add(ctx, name, msgs)
+}
+
+func TestHTTPServer_pushCancelled(t *testing.T) {
+	mem := push.NewMemoryStorage()
+	h := push.NewHTTPHandler(ctxStorage{mem}, logf.New())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/push-cancelled/push", strings.NewReader(`{"body":["a"],"auto_create":true}`)).WithContext(ctx)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	msgs, err := mem.Get(context.Background(), "push-cancelled", 0, 10)
+	if !errors.Is(err, push.ErrQueueNotFound) {
+		assert.Nil(t, err)
 	}
-	s.ListenAndServe()
+	assert.Equal(t, 0, len(msgs))
 }
@@ -2,50 +2,149 @@ package push
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 )
 
+type memorytopic struct {
+	msgs []*Message
+	next int64
+}
+
 type memorystorage struct {
-	data map[string][][]byte
+	data map[string]*memorytopic
 	lock sync.RWMutex
 }
 
 func NewMemoryStorage() Storage {
-	return &memorystorage{data: make(map[string][][]byte)}
+	return &memorystorage{data: make(map[string]*memorytopic)}
+}
+
+func (q *memorystorage) Ping(ctx context.Context) error {
+	return nil
 }
 
 func (q *memorystorage) Create(ctx context.Context, name string) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 	if _, ok := q.data[name]; !ok {
-		q.data[name] = [][]byte{}
+		q.data[name] = &memorytopic{msgs: []*Message{}}
 	}
 	return nil
 }
 
-func (q *memorystorage) Add(ctx context.Context, name string, data [][]byte) error {
+func (q *memorystorage) Add(ctx context.Context, name string, msgs []*Message) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	if _, ok := q.data[name]; !ok {
+	t, ok := q.data[name]
+	if !ok {
 		return ErrQueueNotFound
 	}
-	q.data[name] = append(q.data[name], data...)
+	now := time.Now()
+	for _, m := range msgs {
+		m.Offset = t.next
+		m.CreatedAt = now
+		stored := *m
+		t.msgs = append(t.msgs, &stored)
+		t.next++
+	}
 	return nil
 }
 
-func (q *memorystorage) Get(ctx context.Context, name string, offset, limit int64) ([][]byte, error) {
+func (q *memorystorage) Get(ctx context.Context, name string, offset, limit int64) ([]*Message, error) {
 	q.lock.RLock()
 	defer q.lock.RUnlock()
-	if _, ok := q.data[name]; !ok {
+	t, ok := q.data[name]
+	if !ok {
 		return nil, ErrQueueNotFound
 	}
-	start := int(offset)
-	if start >= len(q.data[name]) {
+	// offsets are ascending but not contiguous once the topic is compacted
+	start := sort.Search(len(t.msgs), func(i int) bool {
+		return t.msgs[i].Offset >= offset
+	})
+	if start >= len(t.msgs) {
 		return nil, nil
 	}
 	end := start + int(limit)
-	if end > len(q.data[name]) {
-		end = len(q.data[name])
+	if end > len(t.msgs) {
+		end = len(t.msgs)
+	}
+	ret := make([]*Message, end-start)
+	copy(ret, t.msgs[start:end])
+	return ret, nil
+}
+
+func (q *memorystorage) OffsetAt(ctx context.Context, name string, at time.Time) (int64, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	t, ok := q.data[name]
+	if !ok {
+		return 0, ErrQueueNotFound
+	}
+	i := sort.Search(len(t.msgs), func(i int) bool {
+		return !t.msgs[i].CreatedAt.Before(at)
+	})
+	if i >= len(t.msgs) {
+		return t.next, nil
+	}
+	return t.msgs[i].Offset, nil
+}
+
+func (q *memorystorage) Bounds(ctx context.Context, name string) (first, next int64, err error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	t, ok := q.data[name]
+	if !ok {
+		return 0, 0, ErrQueueNotFound
+	}
+	if len(t.msgs) == 0 {
+		return t.next, t.next, nil
+	}
+	return t.msgs[0].Offset, t.next, nil
+}
+
+func (q *memorystorage) Compact(ctx context.Context, name string, tombstoneBefore time.Time) (int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	t, ok := q.data[name]
+	if !ok {
+		return 0, ErrQueueNotFound
+	}
+	latest := make(map[string]int64)
+	for _, m := range t.msgs {
+		if m.Key != "" {
+			latest[m.Key] = m.Offset
+		}
+	}
+	kept := make([]*Message, 0, len(t.msgs))
+	for i, m := range t.msgs {
+		// like the db storage, the last message is never compacted
+		if m.Key != "" && i < len(t.msgs)-1 {
+			if latest[m.Key] != m.Offset {
+				continue
+			}
+			if m.Tombstone && m.CreatedAt.Before(tombstoneBefore) {
+				continue
+			}
+		}
+		kept = append(kept, m)
+	}
+	removed := int64(len(t.msgs) - len(kept))
+	t.msgs = kept
+	return removed, nil
+}
+
+func (q *memorystorage) Size(ctx context.Context, name string) (int64, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	t, ok := q.data[name]
+	if !ok {
+		return 0, ErrQueueNotFound
+	}
+	var size int64
+	for _, m := range t.msgs {
+		size += int64(len(m.Data))
 	}
-	return q.data[name][start:end], nil
+	return size, nil
 }
@@ -0,0 +1,89 @@
+package push
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryTransport carries the messages of typed topics within the
+// process, as a single partition log of each topic
+type memoryTransport struct {
+	lock   sync.Mutex
+	topics map[string]*memoryTopic
+}
+
+type memoryTopic struct {
+	msgs []ReceivedMessage
+	// offsets holds the offset each subscriber handles next
+	offsets map[string]int64
+	// published is closed once a message is published
+	published chan struct{}
+}
+
+// NewMemoryTransport returns a transport within the process, as for tests.
+// Each subscriber handles the messages of a topic from the first one not
+// handled yet, a handler failing ends Subscribe with its error and the
+// message is handled again by the next Subscribe
+func NewMemoryTransport() Transport {
+	return &memoryTransport{topics: make(map[string]*memoryTopic)}
+}
+
+// topic returns the topic of name, the lock is held
+func (m *memoryTransport) topic(name string) *memoryTopic {
+	t, ok := m.topics[name]
+	if !ok {
+		t = &memoryTopic{offsets: make(map[string]int64), published: make(chan struct{})}
+		m.topics[name] = t
+	}
+	return t
+}
+
+func (m *memoryTransport) Publish(ctx context.Context, topic string, msgs []PushMessage) error {
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t := m.topic(topic)
+	for _, msg := range msgs {
+		t.msgs = append(t.msgs, ReceivedMessage{Offset: int64(len(t.msgs)), Key: msg.Key, Data: msg.Data})
+	}
+	close(t.published)
+	t.published = make(chan struct{})
+	return nil
+}
+
+func (m *memoryTransport) Subscribe(ctx context.Context, topic, subscriber string, handle MessageHandler) error {
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
+	for {
+		m.lock.Lock()
+		t := m.topic(topic)
+		offset := t.offsets[subscriber]
+		if offset == int64(len(t.msgs)) {
+			published := t.published
+			m.lock.Unlock()
+			select {
+			case <-published:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		msg := t.msgs[offset]
+		m.lock.Unlock()
+		if err := handle(msg); err != nil {
+			return handleError{err}
+		}
+		m.lock.Lock()
+		t.offsets[subscriber] = offset + 1
+		m.lock.Unlock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package push
+
+import "time"
+
+// Message is a single entry of a topic as kept by a Storage. Offset and
+// CreatedAt are assigned by the storage when the message is added.
+type Message struct {
+	Offset int64
+	// Key identifies the entity the message is about, compaction keeps
+	// only the latest message of each key
+	Key  string
+	Data []byte
+	// Tombstone marks the key as deleted, compaction removes the key once
+	// the tombstone is older than the grace period
+	Tombstone bool
+	CreatedAt time.Time
+	// ExpiresAt is the zero time for messages which never expire
+	ExpiresAt time.Time
+	// keep adds the message without the default ttl of the queue
+	keep bool
+}
+
+func NewMessage(data []byte) *Message {
+	return &Message{Data: data}
+}
+
+// WithTTL sets the expiry of the message ttl after now, a non positive ttl
+// means the message never expires
+func (m *Message) WithTTL(ttl time.Duration) *Message {
+	if ttl > 0 {
+		m.ExpiresAt = time.Now().Add(ttl)
+	} else {
+		m.ExpiresAt = time.Time{}
+	}
+	return m
+}
+
+func (m *Message) WithKey(key string) *Message {
+	m.Key = key
+	return m
+}
+
+func (m *Message) AsTombstone() *Message {
+	m.Tombstone = true
+	return m
+}
+
+func (m *Message) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+func messages(data [][]byte) []*Message {
+	ret := make([]*Message, len(data))
+	for i, d := range data {
+		ret[i] = NewMessage(d)
+	}
+	return ret
+}
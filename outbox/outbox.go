@@ -0,0 +1,91 @@
+// Package outbox publishes the messages of a gorm application reliably: the
+// messages are written to the outbox table in the transaction of the
+// writes they're about, and a relay publishes them once committed
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/yang-zzhong/go-push"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Message is a row of the outbox table
+type Message struct {
+	ID    int64  `gorm:"column:id;primarykey;autoIncrement"`
+	Topic string `gorm:"column:topic;type:VARCHAR(191)"`
+	Key   string `gorm:"column:msg_key;type:VARCHAR(255)"`
+	Data  []byte `gorm:"column:data"`
+	// TTL is in seconds from publishing, zero never expires
+	TTL       int64 `gorm:"column:ttl"`
+	Tombstone bool  `gorm:"column:tombstone"`
+	// IdempotencyKey identifies the message, it's written once
+	IdempotencyKey string `gorm:"column:idempotency_key;type:VARCHAR(191);uniqueIndex"`
+	// BatchID is the batch the message is published with once claimed by
+	// a relay, publishing it again is publishing the same batch
+	BatchID string     `gorm:"column:batch_id;type:VARCHAR(64);index:idx_outbox_pending,priority:1"`
+	SentAt  *time.Time `gorm:"column:sent_at;index:idx_outbox_pending,priority:2"`
+	// ClaimedBy is the relay publishing the batch until ClaimedAt is older
+	// than its claim timeout, another relay takes the batch over then
+	ClaimedBy string     `gorm:"column:claimed_by;type:VARCHAR(64)"`
+	ClaimedAt *time.Time `gorm:"column:claimed_at"`
+	CreatedAt time.Time  `gorm:"column:created_at;autoCreate"`
+}
+
+func (Message) TableName() string {
+	return "outbox"
+}
+
+// Entry is a message to publish to Topic
+type Entry struct {
+	Topic string
+	push.PushMessage
+	// IdempotencyKey identifies the message, writing an entry with the key
+	// of one written already does nothing. A random key is given when it's
+	// empty
+	IdempotencyKey string
+}
+
+// Migrate creates or updates the outbox table
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Message{})
+}
+
+// Write adds entries to the outbox with tx, the transaction of the writes
+// they're about, so that they're published once tx commits
+func Write(tx *gorm.DB, entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	msgs := make([]Message, len(entries))
+	for i, e := range entries {
+		if err := push.ValidateTopicName(e.Topic); err != nil {
+			return err
+		}
+		if e.IdempotencyKey == "" {
+			e.IdempotencyKey = randomID()
+		}
+		msgs[i] = Message{
+			Topic:          e.Topic,
+			Key:            e.Key,
+			Data:           []byte(e.Data),
+			TTL:            e.TTL,
+			Tombstone:      e.Tombstone,
+			IdempotencyKey: e.IdempotencyKey,
+		}
+	}
+	return tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "idempotency_key"}}, DoNothing: true}).Create(&msgs).Error
+}
+
+func (m Message) pushMessage() push.PushMessage {
+	return push.PushMessage{Data: string(m.Data), TTL: m.TTL, Key: m.Key, Tombstone: m.Tombstone}
+}
+
+func randomID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,191 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+	"github.com/yang-zzhong/go-push/outbox"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type order struct {
+	ID     int64 `gorm:"primarykey"`
+	Amount int
+}
+
+func setup(t *testing.T) (*gorm.DB, push.Storage, *push.HTTPClient) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "app.db")))
+	assert.Nil(t, err)
+	assert.Nil(t, outbox.Migrate(db))
+	assert.Nil(t, db.AutoMigrate(&order{}))
+	s := push.NewMemoryStorage()
+	srv := httptest.NewServer(push.NewHTTPHandler(s, logf.New()))
+	t.Cleanup(srv.Close)
+	return db, s, &push.HTTPClient{Endpoint: srv.URL}
+}
+
+func published(t *testing.T, s push.Storage, topic string) []string {
+	msgs, err := s.Get(context.Background(), topic, 0, 100)
+	if errors.Is(err, push.ErrQueueNotFound) {
+		return nil
+	}
+	assert.Nil(t, err)
+	var data []string
+	for _, m := range msgs {
+		data = append(data, string(m.Data))
+	}
+	return data
+}
+
+func TestRelay(t *testing.T) {
+	db, s, c := setup(t)
+	write := func(amount int, key string) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			o := order{Amount: amount}
+			if err := tx.Create(&o).Error; err != nil {
+				return err
+			}
+			return outbox.Write(tx, outbox.Entry{
+				Topic:          "outbox-orders",
+				PushMessage:    push.PushMessage{Data: "created", Key: key},
+				IdempotencyKey: key,
+			})
+		})
+	}
+	assert.Nil(t, write(1, "order-1"))
+	assert.Nil(t, write(2, "order-2"))
+	// written again, as by a request retried
+	assert.Nil(t, write(2, "order-2"))
+	// a transaction rolled back publishes nothing
+	failed := errors.New("failed")
+	assert.Equal(t, failed, db.Transaction(func(tx *gorm.DB) error {
+		assert.Nil(t, outbox.Write(tx, outbox.Entry{Topic: "outbox-orders", PushMessage: push.PushMessage{Data: "rolled back"}}))
+		return failed
+	}))
+
+	r := outbox.NewRelay(db, c, outbox.WithKeepSent(-1))
+	n, err := r.Relay(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"created", "created"}, published(t, s, "outbox-orders"))
+	var msgs []outbox.Message
+	assert.Nil(t, db.Order("id").Find(&msgs).Error)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, "order-1", msgs[0].Key)
+	assert.NotNil(t, msgs[0].SentAt)
+	n, err = r.Relay(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// sent messages are deleted once kept long enough
+	_, err = outbox.NewRelay(db, c, outbox.WithKeepSent(0)).Relay(context.Background())
+	assert.Nil(t, err)
+	var left int64
+	assert.Nil(t, db.Model(&outbox.Message{}).Count(&left).Error)
+	assert.Equal(t, int64(0), left)
+}
+
+// lostResponses publishes, but fails as if the responses were lost while
+// lose is true
+type lostResponses struct {
+	outbox.Publisher
+	lose bool
+}
+
+func (p *lostResponses) PushBatch(ctx context.Context, topic, id string, msgs []push.PushMessage) (push.PushResult, error) {
+	result, err := p.Publisher.PushBatch(ctx, topic, id, msgs)
+	if p.lose {
+		return push.PushResult{}, errors.New("connection reset")
+	}
+	return result, err
+}
+
+func TestRelay_publishOnce(t *testing.T) {
+	db, s, c := setup(t)
+	assert.Nil(t, outbox.Write(db,
+		outbox.Entry{Topic: "outbox-a", PushMessage: push.PushMessage{Data: "a1"}},
+		outbox.Entry{Topic: "outbox-b", PushMessage: push.PushMessage{Data: "b1"}},
+		outbox.Entry{Topic: "outbox-a", PushMessage: push.PushMessage{Data: "a2"}},
+	))
+	p := &lostResponses{Publisher: c, lose: true}
+	r := outbox.NewRelay(db, p)
+	n, err := r.Relay(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+	// the messages written meanwhile wait for the batches claimed
+	assert.Nil(t, outbox.Write(db, outbox.Entry{Topic: "outbox-a", PushMessage: push.PushMessage{Data: "a3"}}))
+	p.lose = false
+	n, err = r.Relay(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	n, err = r.Relay(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"a1", "a2", "a3"}, published(t, s, "outbox-a"))
+	assert.Equal(t, []string{"b1"}, published(t, s, "outbox-b"))
+}
+
+func TestRelay_run(t *testing.T) {
+	db, s, c := setup(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- outbox.NewRelay(db, c, outbox.WithPollInterval(10*time.Millisecond), outbox.WithBatchSize(2)).Run(ctx)
+	}()
+	for _, data := range []string{"1", "2", "3"} {
+		assert.Nil(t, outbox.Write(db, outbox.Entry{Topic: "outbox-run", PushMessage: push.PushMessage{Data: data}}))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(published(t, s, "outbox-run")) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	assert.True(t, errors.Is(<-done, context.Canceled))
+	assert.Equal(t, []string{"1", "2", "3"}, published(t, s, "outbox-run"))
+}
+
+// down fails to publish anything
+type down struct{}
+
+func (down) PushBatch(ctx context.Context, topic, id string, msgs []push.PushMessage) (push.PushResult, error) {
+	return push.PushResult{}, errors.New("connection refused")
+}
+
+func TestRelay_claims(t *testing.T) {
+	db, s, c := setup(t)
+	assert.Nil(t, outbox.Write(db,
+		outbox.Entry{Topic: "outbox-a", PushMessage: push.PushMessage{Data: "a1"}},
+		outbox.Entry{Topic: "outbox-b", PushMessage: push.PushMessage{Data: "b1"}},
+	))
+	failing := outbox.NewRelay(db, down{}, outbox.WithBatchSize(1))
+	_, err := failing.Relay(context.Background())
+	assert.NotNil(t, err)
+	assert.Nil(t, outbox.Write(db, outbox.Entry{Topic: "outbox-a", PushMessage: push.PushMessage{Data: "a2"}}))
+
+	// the batch claimed by the failing relay is left to it, as its topic
+	r := outbox.NewRelay(db, c)
+	n, err := r.Relay(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"b1"}, published(t, s, "outbox-b"))
+	assert.Nil(t, published(t, s, "outbox-a"))
+
+	// until its claim times out
+	r = outbox.NewRelay(db, c, outbox.WithClaimTimeout(time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+	n, err = r.Relay(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	n, err = r.Relay(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"a1", "a2"}, published(t, s, "outbox-a"))
+}
@@ -0,0 +1,251 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/yang-zzhong/go-push"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultBatchSize    = 100
+	defaultPollInterval = time.Second
+	defaultKeepSent     = 24 * time.Hour
+	defaultClaimTimeout = time.Minute
+)
+
+// Publisher publishes the batches of the outbox, as push.HTTPClient does.
+// A batch published again with the same id must be published once
+type Publisher interface {
+	PushBatch(ctx context.Context, topic, id string, msgs []push.PushMessage) (push.PushResult, error)
+}
+
+// Relay publishes the messages of the outbox at least once. A relay claims
+// the messages it publishes as batches, which are published again as the
+// same batches after a failure, or by another relay once the claim timed
+// out. The broker adds a batch published again once only while it
+// remembers its id, consumers must bear duplicates otherwise.
+//
+// Messages are claimed in the order of their ids, which is the order of
+// the commits only when the writes of a topic are serialized: a message of
+// a transaction committing after one with a greater id is published after
+// it. Relays may run concurrently, a relay doesn't claim the messages of a
+// topic with a batch in flight, but relays claiming at the same time may
+// still publish the messages of a topic out of order
+type Relay struct {
+	db           *gorm.DB
+	publisher    Publisher
+	id           string
+	batchSize    int
+	interval     time.Duration
+	keepSent     time.Duration
+	claimTimeout time.Duration
+	logf.Logfer
+}
+
+type RelayOption func(r *Relay)
+
+// WithBatchSize sets the number of messages claimed at once, 100 by default
+func WithBatchSize(n int) RelayOption {
+	return func(r *Relay) {
+		if n > 0 {
+			r.batchSize = n
+		}
+	}
+}
+
+// WithPollInterval sets how long the relay waits once the outbox is empty
+// or relaying failed, a second by default
+func WithPollInterval(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		if d > 0 {
+			r.interval = d
+		}
+	}
+}
+
+// WithKeepSent sets how long messages are kept once sent, a day by
+// default. Messages are kept forever with a negative d
+func WithKeepSent(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.keepSent = d
+	}
+}
+
+// WithClaimTimeout sets how long the batches claimed by a relay not
+// publishing them anymore wait to be taken over, a minute by default. A
+// relay renews its claims each round, d is much longer than a round then
+func WithClaimTimeout(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		if d > 0 {
+			r.claimTimeout = d
+		}
+	}
+}
+
+// WithLogger sets the logger of the relay
+func WithLogger(logger logf.Logfer) RelayOption {
+	return func(r *Relay) {
+		r.Logfer = logger
+	}
+}
+
+func NewRelay(db *gorm.DB, publisher Publisher, opts ...RelayOption) *Relay {
+	r := &Relay{
+		db:           db,
+		publisher:    publisher,
+		id:           randomID(),
+		batchSize:    defaultBatchSize,
+		interval:     defaultPollInterval,
+		keepSent:     defaultKeepSent,
+		claimTimeout: defaultClaimTimeout,
+		Logfer:       logf.New(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run relays the outbox until ctx is done
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.Relay(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.Logf(logf.Error, "outbox: relay: %s", err.Error())
+		}
+		// more messages may be waiting after a full round
+		if err == nil && n > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// batch is messages of a topic published at once
+type batch struct {
+	id    string
+	topic string
+	msgs  []push.PushMessage
+}
+
+// Relay publishes the batches it claimed and not sent yet, or the ones it
+// took over, or claims the next messages and publishes them. It returns the number of messages
+// sent, and stops at the first batch failing so that order is kept
+func (r *Relay) Relay(ctx context.Context) (int, error) {
+	batches, err := r.claimed(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(batches) == 0 {
+		if err := r.claim(ctx); err != nil {
+			return 0, err
+		}
+		if batches, err = r.claimed(ctx); err != nil {
+			return 0, err
+		}
+	}
+	sent := 0
+	for _, b := range batches {
+		if _, err := r.publisher.PushBatch(ctx, b.topic, b.id, b.msgs); err != nil {
+			return sent, fmt.Errorf("publish batch [%s] to [%s]: %w", b.id, b.topic, err)
+		}
+		err := r.db.WithContext(ctx).Model(&Message{}).
+			Where("batch_id = ?", b.id).
+			Update("sent_at", time.Now()).Error
+		if err != nil {
+			return sent, fmt.Errorf("mark batch [%s] sent: %w", b.id, err)
+		}
+		sent += len(b.msgs)
+	}
+	if r.keepSent >= 0 {
+		err := r.db.WithContext(ctx).
+			Where("sent_at < ?", time.Now().Add(-r.keepSent)).
+			Delete(&Message{}).Error
+		if err != nil {
+			return sent, fmt.Errorf("delete sent: %w", err)
+		}
+	}
+	return sent, nil
+}
+
+// claimed renews the claims of the relay on the batches not sent yet,
+// takes over the ones whose claim timed out, and returns them in order
+func (r *Relay) claimed(ctx context.Context) ([]*batch, error) {
+	now := time.Now()
+	err := r.db.WithContext(ctx).Model(&Message{}).
+		Where("batch_id <> '' AND sent_at IS NULL").
+		Where("claimed_by = ? OR claimed_at IS NULL OR claimed_at < ?", r.id, now.Add(-r.claimTimeout)).
+		Updates(map[string]any{"claimed_by": r.id, "claimed_at": now}).Error
+	if err != nil {
+		return nil, fmt.Errorf("renew claims: %w", err)
+	}
+	var msgs []Message
+	err = r.db.WithContext(ctx).
+		Where("batch_id <> '' AND sent_at IS NULL AND claimed_by = ?", r.id).
+		Order("id").
+		Find(&msgs).Error
+	if err != nil {
+		return nil, fmt.Errorf("read claimed: %w", err)
+	}
+	var batches []*batch
+	byID := make(map[string]*batch)
+	for _, m := range msgs {
+		b, ok := byID[m.BatchID]
+		if !ok {
+			b = &batch{id: m.BatchID, topic: m.Topic}
+			byID[m.BatchID] = b
+			batches = append(batches, b)
+		}
+		b.msgs = append(b.msgs, m.pushMessage())
+	}
+	return batches, nil
+}
+
+// claim gives the next messages pending a batch for each topic without a
+// batch in flight. The messages another relay is claiming are skipped
+func (r *Relay) claim(ctx context.Context) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		q := tx.Select("id", "topic").
+			Where("batch_id = '' AND sent_at IS NULL").
+			Where("topic NOT IN (?)", tx.Model(&Message{}).Select("topic").Where("batch_id <> '' AND sent_at IS NULL")).
+			Order("id").
+			Limit(r.batchSize)
+		switch tx.Dialector.Name() {
+		case "mysql", "postgres":
+			q = q.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+		var msgs []Message
+		err := q.Find(&msgs).Error
+		if err != nil {
+			return fmt.Errorf("read pending: %w", err)
+		}
+		ids := make(map[string][]int64)
+		var topics []string
+		for _, m := range msgs {
+			if _, ok := ids[m.Topic]; !ok {
+				topics = append(topics, m.Topic)
+			}
+			ids[m.Topic] = append(ids[m.Topic], m.ID)
+		}
+		now := time.Now()
+		for _, topic := range topics {
+			// messages claimed by another relay meanwhile are left to it
+			err := tx.Model(&Message{}).
+				Where("id IN ? AND batch_id = ''", ids[topic]).
+				Updates(map[string]any{"batch_id": randomID(), "claimed_by": r.id, "claimed_at": now}).Error
+			if err != nil {
+				return fmt.Errorf("claim: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,331 @@
+package push
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+)
+
+var (
+	// ErrProducerClosed is returned sending with a closed producer
+	ErrProducerClosed = errors.New("producer closed")
+	// ErrProducerFull is returned sending with a full producer dropping
+	// the messages it has no room for
+	ErrProducerFull = errors.New("producer full")
+)
+
+// Overflow is what sending does when the producer holds as many messages
+// as it can
+type Overflow int
+
+const (
+	// OverflowBlock waits for room
+	OverflowBlock Overflow = iota
+	// OverflowDrop fails with ErrProducerFull
+	OverflowDrop
+)
+
+const (
+	defaultProducerBatchSize = 100
+	defaultProducerLinger    = 10 * time.Millisecond
+	defaultProducerBuffer    = 10000
+	defaultProducerRetries   = 5
+)
+
+// Delivery is the result of sending a message with an AsyncProducer
+type Delivery struct {
+	Topic   string
+	Message PushMessage
+	// Partition and Offset tell where the message was added
+	Partition int
+	Offset    int64
+	// Err is the error the batch of the message failed with, the message
+	// wasn't added then
+	Err error
+}
+
+// AsyncProducer pushes messages with its HTTPClient in the background. The
+// messages of each topic are pushed in batches, in the order they're sent
+type AsyncProducer struct {
+	client     *HTTPClient
+	batchSize  int
+	linger     time.Duration
+	overflow   Overflow
+	retry      Reconnect
+	deliveries chan Delivery
+	// report tells whether deliveries are sent to the deliveries channel
+	report bool
+	// slots holds a token for each message sent and not delivered yet
+	slots   chan struct{}
+	closing chan struct{}
+	// ctx cancels the pushes in flight when closing times out
+	ctx    context.Context
+	cancel context.CancelFunc
+	lock   sync.Mutex
+	topics map[string]*topicBatcher
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type ProducerOption func(p *AsyncProducer)
+
+// ProducerBatchSize sets the number of messages of a topic pushed at once,
+// 100 by default
+func ProducerBatchSize(n int) ProducerOption {
+	return func(p *AsyncProducer) {
+		if n > 0 {
+			p.batchSize = n
+		}
+	}
+}
+
+// ProducerLinger sets how long the messages of a topic wait for others to
+// fill a batch before they're pushed, 10ms by default. Zero pushes them
+// without waiting
+func ProducerLinger(d time.Duration) ProducerOption {
+	return func(p *AsyncProducer) {
+		p.linger = d
+	}
+}
+
+// ProducerBuffer sets the number of messages sent and not delivered yet
+// the producer holds, 10000 by default, and what sending does beyond
+func ProducerBuffer(n int, overflow Overflow) ProducerOption {
+	return func(p *AsyncProducer) {
+		if n > 0 {
+			p.slots = make(chan struct{}, n)
+		}
+		p.overflow = overflow
+	}
+}
+
+// ProducerRetry sets how a batch failing is pushed again, as a
+// subscription reconnects, but giving up after 5 retries by default. The
+// broker adds a batch pushed again once
+func ProducerRetry(r Reconnect) ProducerOption {
+	return func(p *AsyncProducer) {
+		p.retry = r
+	}
+}
+
+// ProducerDeliveries sends the delivery of each message to Deliveries,
+// which must be read then. Otherwise the messages failing are only logged.
+// The deliveries nobody reads once closing timed out are dropped
+func ProducerDeliveries() ProducerOption {
+	return func(p *AsyncProducer) {
+		p.report = true
+	}
+}
+
+// NewAsyncProducer returns a producer pushing with c, or the error c is
+// configured with, as an invalid endpoint or TLS config
+func NewAsyncProducer(c *HTTPClient, opts ...ProducerOption) (*AsyncProducer, error) {
+	if err := c.doInit(); err != nil {
+		return nil, fmt.Errorf("producer: %w", err)
+	}
+	p := &AsyncProducer{
+		client:    c,
+		batchSize: defaultProducerBatchSize,
+		linger:    defaultProducerLinger,
+		retry:     Reconnect{MaxRetries: defaultProducerRetries},
+		slots:     make(chan struct{}, defaultProducerBuffer),
+		closing:   make(chan struct{}),
+		topics:    make(map[string]*topicBatcher),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.deliveries = make(chan Delivery, cap(p.slots))
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p, nil
+}
+
+// Deliveries returns the deliveries of the messages sent, when the producer
+// reports them. It's closed once the producer is
+func (p *AsyncProducer) Deliveries() <-chan Delivery {
+	return p.deliveries
+}
+
+// Send queues msg to be pushed to topic. It waits for room as long as ctx
+// isn't done, or fails with ErrProducerFull, as the overflow policy says
+func (p *AsyncProducer) Send(ctx context.Context, topic string, msg PushMessage) error {
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
+	if p.overflow == OverflowDrop {
+		select {
+		case <-p.closing:
+			return ErrProducerClosed
+		case p.slots <- struct{}{}:
+		default:
+			return ErrProducerFull
+		}
+	} else {
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.closing:
+			return ErrProducerClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		<-p.slots
+		return ErrProducerClosed
+	}
+	t, ok := p.topics[topic]
+	if !ok {
+		t = &topicBatcher{topic: topic, batches: make(chan []PushMessage, cap(p.slots))}
+		p.topics[topic] = t
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for batch := range t.batches {
+				p.push(t.topic, batch)
+			}
+		}()
+	}
+	t.pending = append(t.pending, msg)
+	switch {
+	case len(t.pending) >= p.batchSize || p.linger <= 0:
+		t.cut()
+	case len(t.pending) == 1:
+		var timer *time.Timer
+		timer = time.AfterFunc(p.linger, func() {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			if t.timer == timer {
+				t.cut()
+			}
+		})
+		t.timer = timer
+	}
+	return nil
+}
+
+// Close pushes the messages sent and waits for their deliveries until ctx
+// is done. Then it returns ctx.Err(), the messages not pushed fail and
+// Deliveries is closed once the pushes in flight give up
+func (p *AsyncProducer) Close(ctx context.Context) error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return ErrProducerClosed
+	}
+	p.closed = true
+	close(p.closing)
+	for _, t := range p.topics {
+		t.cut()
+		close(t.batches)
+	}
+	p.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		p.cancel()
+		close(p.deliveries)
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		go func() {
+			<-done
+			close(p.deliveries)
+		}()
+		return ctx.Err()
+	}
+}
+
+// push pushes batch to topic, retrying it as the same batch for the
+// broker to add it once
+func (p *AsyncProducer) push(topic string, batch []PushMessage) {
+	id := newBatchID()
+	retry := newReconnectBackoff(p.retry)
+	for {
+		result, err := p.client.PushBatch(p.ctx, topic, id, batch)
+		if err == nil && (len(result.Offsets) != len(batch) || len(result.Partitions) != len(batch)) {
+			err = errors.New("push: no offset of the messages in the response")
+		}
+		if err == nil {
+			p.deliver(topic, batch, result, nil)
+			return
+		}
+		delay, ok := retry.next(false, err)
+		if !ok || p.ctx.Err() != nil {
+			p.deliver(topic, batch, result, err)
+			return
+		}
+		p.client.Logf(logf.Warn, "producer: push to [%s] again in %s: %s", topic, delay, err.Error())
+		select {
+		case <-p.ctx.Done():
+			p.deliver(topic, batch, result, p.ctx.Err())
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (p *AsyncProducer) deliver(topic string, batch []PushMessage, result PushResult, err error) {
+	if err != nil {
+		p.client.Logf(logf.Error, "producer: push %d messages to [%s]: %s", len(batch), topic, err.Error())
+	}
+	for i, msg := range batch {
+		<-p.slots
+		if !p.report {
+			continue
+		}
+		d := Delivery{Topic: topic, Message: msg, Err: err}
+		if err == nil {
+			d.Partition, d.Offset = result.Partitions[i], result.Offsets[i]
+		}
+		select {
+		case p.deliveries <- d:
+		case <-p.ctx.Done():
+			// closing timed out, nobody may read the deliveries anymore
+			select {
+			case p.deliveries <- d:
+			default:
+			}
+		}
+	}
+}
+
+// topicBatcher gathers the messages sent to a topic into batches
+type topicBatcher struct {
+	topic   string
+	pending []PushMessage
+	// timer cuts the pending messages once they lingered
+	timer *time.Timer
+	// batches are pushed in order by the goroutine of the topic
+	batches chan []PushMessage
+}
+
+// cut queues the pending messages as a batch, the producer lock is held
+func (t *topicBatcher) cut() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if len(t.pending) == 0 {
+		return
+	}
+	t.batches <- t.pending
+	t.pending = nil
+}
+
+func newBatchID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
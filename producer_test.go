@@ -0,0 +1,220 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+// pushServer serves h, counting the push requests, which before handles
+// first unless it returns false
+type pushServer struct {
+	h      http.Handler
+	before func(n int, w http.ResponseWriter, req *http.Request) bool
+	lock   sync.Mutex
+	pushes int
+}
+
+func (s *pushServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/push") {
+		s.lock.Lock()
+		s.pushes++
+		n := s.pushes
+		s.lock.Unlock()
+		if s.before != nil && !s.before(n, w, req) {
+			return
+		}
+	}
+	s.h.ServeHTTP(w, req)
+}
+
+func (s *pushServer) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pushes
+}
+
+func newProducer(t *testing.T, c *push.HTTPClient, opts ...push.ProducerOption) *push.AsyncProducer {
+	p, err := push.NewAsyncProducer(c, opts...)
+	assert.Nil(t, err)
+	return p
+}
+
+func send(t *testing.T, p *push.AsyncProducer, topic string, n int) {
+	for i := 0; i < n; i++ {
+		assert.Nil(t, p.Send(context.Background(), topic, push.PushMessage{Data: fmt.Sprint(i)}))
+	}
+}
+
+func TestAsyncProducer_batches(t *testing.T) {
+	srv := &pushServer{h: push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	p := newProducer(t, &push.HTTPClient{Endpoint: ts.URL},
+		push.ProducerBatchSize(10), push.ProducerLinger(20*time.Millisecond), push.ProducerDeliveries())
+	send(t, p, "produced", 25)
+	for i := 0; i < 25; i++ {
+		d := <-p.Deliveries()
+		assert.Nil(t, d.Err)
+		assert.Equal(t, fmt.Sprint(i), d.Message.Data)
+		assert.Equal(t, int64(i), d.Offset)
+	}
+	// two full batches, and the rest once it lingered
+	assert.Equal(t, 3, srv.count())
+	assert.Nil(t, p.Close(context.Background()))
+	_, ok := <-p.Deliveries()
+	assert.False(t, ok)
+	assert.True(t, errors.Is(p.Send(context.Background(), "produced", push.PushMessage{}), push.ErrProducerClosed))
+}
+
+func TestAsyncProducer_retryOnce(t *testing.T) {
+	s := push.NewMemoryStorage()
+	srv := &pushServer{h: push.NewHTTPHandler(s, logf.New())}
+	srv.before = func(n int, w http.ResponseWriter, req *http.Request) bool {
+		if n > 1 {
+			return true
+		}
+		// the batch is added, but the response is lost
+		srv.h.ServeHTTP(httptest.NewRecorder(), req)
+		panic(http.ErrAbortHandler)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	p := newProducer(t, &push.HTTPClient{Endpoint: ts.URL}, push.ProducerLinger(0),
+		push.ProducerRetry(push.Reconnect{InitialInterval: 10 * time.Millisecond}), push.ProducerDeliveries())
+	send(t, p, "produced-retried", 1)
+	d := <-p.Deliveries()
+	assert.Nil(t, d.Err)
+	assert.Equal(t, int64(0), d.Offset)
+	assert.Equal(t, 2, srv.count())
+	msgs, err := s.Get(context.Background(), "produced-retried", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+	assert.Nil(t, p.Close(context.Background()))
+}
+
+// failOnce fails adding to the queue named fail the first time
+type failOnce struct {
+	push.Storage
+	fail   string
+	lock   sync.Mutex
+	failed bool
+}
+
+func (s *failOnce) Add(ctx context.Context, name string, msgs []*push.Message) error {
+	s.lock.Lock()
+	fail := name == s.fail && !s.failed
+	s.failed = s.failed || fail
+	s.lock.Unlock()
+	if fail {
+		return errors.New("storage down")
+	}
+	return s.Storage.Add(ctx, name, msgs)
+}
+
+func TestAsyncProducer_retryPartitions(t *testing.T) {
+	assert.Nil(t, push.DeclareTopic("produced-partitioned", 2))
+	mem := push.NewMemoryStorage()
+	s := &failOnce{Storage: mem, fail: push.PartitionName("produced-partitioned", 1, 2)}
+	ts := httptest.NewServer(push.NewHTTPHandler(s, logf.New()))
+	defer ts.Close()
+	p := newProducer(t, &push.HTTPClient{Endpoint: ts.URL}, push.ProducerLinger(time.Hour), push.ProducerBatchSize(8),
+		push.ProducerRetry(push.Reconnect{InitialInterval: 10 * time.Millisecond}), push.ProducerDeliveries())
+	for i := 0; i < 8; i++ {
+		assert.Nil(t, p.Send(context.Background(), "produced-partitioned", push.PushMessage{Data: fmt.Sprint(i), Key: fmt.Sprint(i)}))
+	}
+	for i := 0; i < 8; i++ {
+		assert.Nil(t, (<-p.Deliveries()).Err)
+	}
+	assert.Nil(t, p.Close(context.Background()))
+	// the retry adds the partition failing only
+	total := 0
+	for partition := 0; partition < 2; partition++ {
+		msgs, err := mem.Get(context.Background(), push.PartitionName("produced-partitioned", partition, 2), 0, 100)
+		assert.Nil(t, err)
+		assert.True(t, len(msgs) > 0)
+		total += len(msgs)
+	}
+	assert.Equal(t, 8, total)
+}
+
+func TestAsyncProducer_overflow(t *testing.T) {
+	release := make(chan struct{})
+	srv := &pushServer{h: push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())}
+	srv.before = func(int, http.ResponseWriter, *http.Request) bool {
+		<-release
+		return true
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	p := newProducer(t, &push.HTTPClient{Endpoint: ts.URL}, push.ProducerLinger(0), push.ProducerBuffer(2, push.OverflowDrop))
+	send(t, p, "produced-full", 2)
+	assert.True(t, errors.Is(p.Send(context.Background(), "produced-full", push.PushMessage{}), push.ErrProducerFull))
+
+	blocking := newProducer(t, &push.HTTPClient{Endpoint: ts.URL}, push.ProducerLinger(0), push.ProducerBuffer(1, push.OverflowBlock))
+	send(t, blocking, "produced-full", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(blocking.Send(ctx, "produced-full", push.PushMessage{}), context.DeadlineExceeded))
+	close(release)
+	assert.Nil(t, p.Close(context.Background()))
+	assert.Nil(t, blocking.Close(context.Background()))
+}
+
+func TestAsyncProducer_closeFlushes(t *testing.T) {
+	s := push.NewMemoryStorage()
+	ts := httptest.NewServer(push.NewHTTPHandler(s, logf.New()))
+	defer ts.Close()
+	p := newProducer(t, &push.HTTPClient{Endpoint: ts.URL}, push.ProducerLinger(time.Hour))
+	send(t, p, "produced-flushed", 3)
+	assert.Nil(t, p.Close(context.Background()))
+	msgs, err := s.Get(context.Background(), "produced-flushed", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(msgs))
+}
+
+func TestAsyncProducer_closeTimeout(t *testing.T) {
+	ts := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer ts.Close()
+	p := newProducer(t, &push.HTTPClient{Endpoint: ts.URL},
+		push.ProducerBuffer(1, push.OverflowBlock), push.ProducerLinger(0), push.ProducerDeliveries())
+	// the second delivery finds the deliveries full, nobody reads them
+	send(t, p, "produced-unread", 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(p.Close(ctx), context.DeadlineExceeded))
+	n := 0
+	for range p.Deliveries() {
+		n++
+	}
+	assert.True(t, n >= 1)
+}
+
+func TestAsyncProducer_invalidClient(t *testing.T) {
+	_, err := push.NewAsyncProducer(&push.HTTPClient{})
+	assert.NotNil(t, err)
+	_, err = push.NewAsyncProducer(&push.HTTPClient{Endpoint: "https://localhost", TLS: &push.TLSOptions{CAFile: "missing.pem"}})
+	assert.NotNil(t, err)
+}
+
+func TestAsyncProducer_permanentError(t *testing.T) {
+	srv := &pushServer{h: push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithTenants(mustTenants(t)))}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	p := newProducer(t, &push.HTTPClient{Endpoint: ts.URL, APIKey: "wrong"}, push.ProducerLinger(0), push.ProducerDeliveries())
+	send(t, p, "produced-denied", 1)
+	d := <-p.Deliveries()
+	assert.True(t, errors.Is(d.Err, push.ErrUnauthorized))
+	assert.Equal(t, 1, srv.count())
+	assert.Nil(t, p.Close(context.Background()))
+}
@@ -49,14 +49,14 @@ func (s *subscriber) Subscribe(ctx context.Context, handler func(e *events.Event
 			var e events.Event
 			if err := json.NewDecoder(strings.NewReader(m)).Decode(&e); err != nil {
 				// handle error
-				return int64(msg.StartOffset + i)
+				return msg.Offset(i)
 			}
 			if err := handler(&e); err != nil {
 				// handle error
-				return int64(msg.StartOffset + i)
+				return msg.Offset(i)
 			}
 		}
-		return int64(msg.StartOffset + len(msg.Data))
+		return msg.NextOffset()
 	})
 }
 
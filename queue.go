@@ -2,23 +2,40 @@ package push
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
-
-	"github.com/yang-zzhong/go-pipeline"
+	"time"
 )
 
 var (
 	ErrQueueNotFound = errors.New("queue not found")
-	queue            = make(map[string]*Queue)
+	queue            = make(map[registryKey]*Queue)
 	queueLock        sync.RWMutex
 )
 
+// registryKey identifies the shared queues and topics, a name is shared
+// only by the callers using the same storage
+type registryKey struct {
+	storage Storage
+	name    string
+}
+
 type Storage interface {
-	Add(ctx context.Context, name string, data [][]byte) error
-	Get(ctx context.Context, name string, offset, limit int64) ([][]byte, error)
+	// Add appends msgs to the topic, setting Offset and CreatedAt of each
+	Add(ctx context.Context, name string, msgs []*Message) error
+	// Get returns at most limit messages with offset not less than the given one, in offset order
+	Get(ctx context.Context, name string, offset, limit int64) ([]*Message, error)
 	Create(ctx context.Context, name string) error
+	// OffsetAt returns the offset of the first message created at or after t,
+	// or the next offset when there is no such message
+	OffsetAt(ctx context.Context, name string, t time.Time) (int64, error)
+	// Bounds returns the offset of the first message kept and the offset
+	// the next added message will get
+	Bounds(ctx context.Context, name string) (first, next int64, err error)
+	// Ping checks the storage is reachable
+	Ping(ctx context.Context) error
 }
 
 type ClientServerStorage interface {
@@ -27,62 +44,240 @@ type ClientServerStorage interface {
 }
 
 type Queue struct {
-	name        string
-	storage     Storage
-	autoCreate  bool
-	sublock     sync.RWMutex
-	subscribers map[string]chan struct{}
+	name         string
+	storage      Storage
+	autoCreate   bool
+	expiredTopic string
+	tenant       *Tenant
+	defaultTTL   time.Duration
+	retention    *Retention
+	sublock      sync.RWMutex
+	subscribers  map[string]chan struct{}
+	// expiredTopics returns the topic expired messages are routed to
+	expiredTopics func(name string) (*Topic, error)
+	expiry        expiry
+}
+
+// expiry tracks the expired messages of a queue routed already
+type expiry struct {
+	lock   sync.Mutex
+	loaded bool
+	// routed is the offset the messages routed or being routed are before
+	routed int64
+	// persisted is the offset last handed to the storage of the queue
+	persisted int64
+}
+
+// expiryRouter is the subscriber the offset of the expired messages routed
+// is kept as, when the storage of the queue keeps offsets
+const expiryRouter = "_sys-expiry"
+
+type QueueOption func(q *Queue)
+
+// WithExpiredTopic routes the messages a subscriber skipped because they
+// were expired to topic, as ExpiredMessage records
+func WithExpiredTopic(topic string) QueueOption {
+	return func(q *Queue) {
+		q.expiredTopic = topic
+	}
+}
+
+// WithTenant enforces the quotas of tenant on the messages added to the queue
+func WithTenant(tenant *Tenant) QueueOption {
+	return func(q *Queue) {
+		q.tenant = tenant
+	}
+}
+
+// WithDefaultTTL sets the expiry of the messages added without one to ttl
+// after they're added, a non positive ttl keeps them forever
+func WithDefaultTTL(ttl time.Duration) QueueOption {
+	return func(q *Queue) {
+		q.defaultTTL = ttl
+	}
+}
+
+// withExpiredTopics resolves the topic expired messages are routed to with
+// topics instead of taking it from the storage of the queue
+func withExpiredTopics(topics func(name string) (*Topic, error)) QueueOption {
+	return func(q *Queue) {
+		q.expiredTopics = topics
+	}
+}
+
+// WithRetention makes the queue follow the defaults of r, which take over
+// those of WithExpiredTopic and WithDefaultTTL
+func WithRetention(r *Retention) QueueOption {
+	return func(q *Queue) {
+		q.retention = r
+	}
+}
+
+// Retention holds retention defaults shared by queues, the changes of which
+// apply to the queues right away
+type Retention struct {
+	lock         sync.RWMutex
+	defaultTTL   time.Duration
+	expiredTopic string
+}
+
+func NewRetention(defaultTTL time.Duration, expiredTopic string) *Retention {
+	return &Retention{defaultTTL: defaultTTL, expiredTopic: expiredTopic}
+}
+
+// Set replaces the default ttl of messages and the topic expired messages
+// are routed to
+func (r *Retention) Set(defaultTTL time.Duration, expiredTopic string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.defaultTTL = defaultTTL
+	r.expiredTopic = expiredTopic
 }
 
-func GetQueue(name string, storage Storage, autoCreate bool) *Queue {
+func (r *Retention) get() (time.Duration, string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.defaultTTL, r.expiredTopic
+}
+
+// ExpiredMessage is the audit record written to the expired topic of a
+// queue, once per message whatever the number of subscribers. Subscriber
+// is the one which found it expired first
+type ExpiredMessage struct {
+	Topic      string    `json:"topic"`
+	Subscriber string    `json:"subscriber"`
+	Offset     int64     `json:"offset"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Data       string    `json:"data"`
+}
+
+// GetQueue returns the queue of name in storage, the name of a topic or of
+// one of its partitions, shared by the callers using the same storage. The
+// queue is created by the first call, later ones get it as autoCreate and
+// opts of the first call set it. Storages must be comparable, as pointers
+// are. It fails when name breaks the topic naming policy
+func GetQueue(name string, storage Storage, autoCreate bool, opts ...QueueOption) (*Queue, error) {
+	key := registryKey{storage: storage, name: name}
 	queueLock.RLock()
-	if q, ok := queue[name]; ok {
+	if q, ok := queue[key]; ok {
 		queueLock.RUnlock()
-		return q
+		return q, nil
 	}
 	queueLock.RUnlock()
-	q := NewQueue(name, storage, autoCreate)
+	if err := validateQueueName(name); err != nil {
+		return nil, err
+	}
 	queueLock.Lock()
 	defer queueLock.Unlock()
-	queue[name] = q
-	return q
+	if q, ok := queue[key]; ok {
+		return q, nil
+	}
+	q := NewQueue(name, storage, autoCreate, opts...)
+	queue[key] = q
+	return q, nil
 }
 
-func NewQueue(name string, storage Storage, autoCreate bool) *Queue {
-	return &Queue{
+func NewQueue(name string, storage Storage, autoCreate bool, opts ...QueueOption) *Queue {
+	q := &Queue{
 		name:        name,
 		autoCreate:  autoCreate,
 		storage:     storage,
 		subscribers: make(map[string]chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// retentionDefaults returns the default ttl of messages and the topic
+// expired messages are routed to
+func (q *Queue) retentionDefaults() (time.Duration, string) {
+	if q.retention != nil {
+		return q.retention.get()
+	}
+	return q.defaultTTL, q.expiredTopic
+}
+
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// OffsetAt returns the offset to consume the messages created since t from
+func (q *Queue) OffsetAt(ctx context.Context, t time.Time) (int64, error) {
+	offset, err := q.storage.OffsetAt(ctx, q.name, t)
+	if errors.Is(err, ErrQueueNotFound) {
+		return 0, nil
+	}
+	return offset, err
+}
+
+// Bounds returns the offset of the earliest message kept and the offset of
+// the next message added
+func (q *Queue) Bounds(ctx context.Context) (first, next int64, err error) {
+	first, next, err = q.storage.Bounds(ctx, q.name)
+	if errors.Is(err, ErrQueueNotFound) {
+		return 0, 0, nil
+	}
+	return
 }
 
 func (q *Queue) Add(ctx context.Context, data ...[]byte) error {
-	if err := q.storage.Add(ctx, q.name, data); err != nil {
-		if !errors.Is(err, ErrQueueNotFound) || !q.autoCreate {
+	return q.AddMessages(ctx, messages(data)...)
+}
+
+func (q *Queue) AddMessages(ctx context.Context, msgs ...*Message) error {
+	if ttl, _ := q.retentionDefaults(); ttl > 0 {
+		for _, m := range msgs {
+			if m.ExpiresAt.IsZero() && !m.keep {
+				m.WithTTL(ttl)
+			}
+		}
+	}
+	if q.tenant != nil {
+		size, err := q.tenant.admit(ctx, q, msgs)
+		if err != nil {
 			return err
 		}
-		if err := q.storage.Create(ctx, q.name); err != nil {
-			return fmt.Errorf("add: %w", err)
+		if err := q.add(ctx, msgs); err != nil {
+			q.tenant.free(size)
+			return err
 		}
+	} else if err := q.add(ctx, msgs); err != nil {
+		return err
 	}
+	q.notify()
+	return nil
+}
+
+// notify wakes the subscribers up without waiting for them. A subscriber
+// has room for a single pending wakeup, so the wakeups of the messages
+// added while it consumes are coalesced into one
+func (q *Queue) notify() {
 	q.sublock.RLock()
 	defer q.sublock.RUnlock()
-	var wg sync.WaitGroup
 	for _, c := range q.subscribers {
-		wg.Add(1)
-		go func(c chan struct{}) {
-			c <- struct{}{}
-			wg.Done()
-		}(c)
+		select {
+		case c <- struct{}{}:
+		default:
+		}
 	}
-	wg.Wait()
-	return nil
 }
 
-type dataWithOffset struct {
-	data   []byte
-	offset int64
+func (q *Queue) add(ctx context.Context, msgs []*Message) error {
+	if err := q.storage.Add(ctx, q.name, msgs); err != nil {
+		if !errors.Is(err, ErrQueueNotFound) || !q.autoCreate {
+			return err
+		}
+		if err := q.storage.Create(ctx, q.name); err != nil {
+			return fmt.Errorf("add: %w", err)
+		}
+		if err := q.storage.Add(ctx, q.name, msgs); err != nil {
+			return fmt.Errorf("add: %w", err)
+		}
+	}
+	return nil
 }
 
 func (q *Queue) Unsubscribe(name string) {
@@ -99,7 +294,7 @@ func (q *Queue) Subscribe(
 	name string,
 	offset int64,
 	batchSize int,
-	consume func(data [][]byte, startOffset int64) error,
+	consume func(msgs []*Message) error,
 ) error {
 	q.sublock.Lock()
 	if _, ok := q.subscribers[name]; ok {
@@ -108,14 +303,14 @@ func (q *Queue) Subscribe(
 	}
 	q.subscribers[name] = make(chan struct{}, 1)
 	q.sublock.Unlock()
-	if err := q.consume(ctx, &offset, batchSize, consume); err != nil {
-		return err
-	}
 	defer func() {
 		q.sublock.Lock()
 		delete(q.subscribers, name)
 		q.sublock.Unlock()
 	}()
+	if err := q.consume(ctx, name, &offset, batchSize, consume); err != nil {
+		return err
+	}
 	for {
 		q.sublock.RLock()
 		ch, ok := q.subscribers[name]
@@ -130,51 +325,166 @@ func (q *Queue) Subscribe(
 			if !ok {
 				return nil
 			}
-			if err := q.consume(ctx, &offset, batchSize, consume); err != nil {
+			if err := q.consume(ctx, name, &offset, batchSize, consume); err != nil {
 				return err
 			}
 		}
 	}
 }
 
+// consume hands the messages from offset on to consume in batches of
+// batchSize, until there's no message left, ctx is done or consume fails.
+// Messages are read and handed on by the calling goroutine, so that ending
+// the subscription leaves nothing behind
 func (q *Queue) consume(
 	ctx context.Context,
+	subscriber string,
 	offset *int64,
 	batchSize int,
-	consume func(data [][]byte, startOffset int64) error,
+	consume func(msgs []*Message) error,
 ) error {
-	p := pipeline.New1[dataWithOffset]()
-	p.Start(func() ([]dataWithOffset, bool, error) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	var batch []*Message
+	for ctx.Err() == nil {
 		dt, err := q.storage.Get(ctx, q.name, *offset, 20)
 		if err != nil {
 			if !errors.Is(err, ErrQueueNotFound) || !q.autoCreate {
-				return nil, false, err
+				return err
 			}
 			if err := q.storage.Create(ctx, q.name); err != nil {
-				return nil, false, fmt.Errorf("consume: %w", err)
+				return fmt.Errorf("consume: %w", err)
 			}
 		}
 		if len(dt) == 0 {
-			return nil, true, nil
+			break
 		}
-		ret := make([]dataWithOffset, len(dt))
-		for i, item := range dt {
-			ret[i] = dataWithOffset{
-				data:   item,
-				offset: *offset + int64(i),
+		*offset = dt[len(dt)-1].Offset + 1
+		now := time.Now()
+		expired := []*Message{}
+		for _, m := range dt {
+			if m.Expired(now) {
+				expired = append(expired, m)
+				continue
+			}
+			if batch = append(batch, m); len(batch) >= batchSize {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if err := consume(batch); err != nil {
+					return err
+				}
+				batch = nil
 			}
 		}
-		*offset += int64(len(dt))
-		return ret, false, nil
-	}).Next1(func(data []dataWithOffset) ([]pipeline.E, error) {
-		if len(data) == 0 {
-			return nil, nil
+		if err := q.routeExpired(ctx, subscriber, expired, *offset); err != nil {
+			return fmt.Errorf("consume: %w", err)
 		}
-		ret := make([][]byte, len(data))
-		for i, item := range data {
-			ret[i] = item.data
+	}
+	if len(batch) == 0 || ctx.Err() != nil {
+		return nil
+	}
+	return consume(batch)
+}
+
+// routeExpired writes the records of the expired msgs subscriber found
+// reading up to next to the expired topic, unless a subscriber reading as
+// far already did. The offset read up to is kept in the storage of the
+// queue when it keeps offsets, so that a message is routed once by the
+// broker even across restarts. A subscriber starting past that offset, as
+// from the latest message, moves it on, so the messages expired it skips
+// aren't routed by subscribers reading them later.
+//
+// The range is claimed under the expiry lock and written without it, so a
+// slow expired topic stalls only the subscriber routing to it. A failed
+// write gives the range back, and the offset kept never moves past it: the
+// records may be routed again after a failure or restart, but aren't lost
+func (q *Queue) routeExpired(ctx context.Context, subscriber string, msgs []*Message, next int64) error {
+	_, expiredTopic := q.retentionDefaults()
+	if expiredTopic == "" || expiredTopic == q.name {
+		return nil
+	}
+	offsets, _ := q.storage.(OffsetStorage)
+	from, records, err := q.claimExpired(ctx, offsets, subscriber, msgs, next)
+	if err != nil || from >= next {
+		return err
+	}
+	if len(records) > 0 {
+		if err := q.addExpired(ctx, expiredTopic, records); err != nil {
+			q.expiry.lock.Lock()
+			q.expiry.routed = min(q.expiry.routed, from)
+			q.expiry.lock.Unlock()
+			return fmt.Errorf("route expired: %w", err)
 		}
-		return nil, consume(ret, data[0].offset)
-	}, batchSize)
-	return p.Do(ctx)
+	}
+	q.expiry.lock.Lock()
+	persist := offsets != nil && q.expiry.routed >= next && next > q.expiry.persisted
+	if persist {
+		q.expiry.persisted = next
+	}
+	q.expiry.lock.Unlock()
+	if persist {
+		if err := offsets.SetOffset(ctx, q.name, expiryRouter, next); err != nil {
+			return fmt.Errorf("route expired: %w", err)
+		}
+	}
+	return nil
+}
+
+// claimExpired marks the expired messages up to next as routed and returns
+// the records of those no subscriber routed yet, from being the offset they
+// were routed up to before. Nothing is left to route when from isn't
+// before next
+func (q *Queue) claimExpired(ctx context.Context, offsets OffsetStorage, subscriber string, msgs []*Message, next int64) (from int64, records []*Message, err error) {
+	q.expiry.lock.Lock()
+	defer q.expiry.lock.Unlock()
+	if !q.expiry.loaded && offsets != nil {
+		if err := offsets.GetOffset(ctx, q.name, expiryRouter, &q.expiry.routed); err != nil {
+			return 0, nil, fmt.Errorf("route expired: %w", err)
+		}
+		q.expiry.persisted = q.expiry.routed
+	}
+	q.expiry.loaded = true
+	from = q.expiry.routed
+	if next <= from {
+		return from, nil, nil
+	}
+	for _, m := range msgs {
+		if m.Offset < from {
+			continue
+		}
+		bs, err := json.Marshal(ExpiredMessage{
+			Topic:      q.name,
+			Subscriber: subscriber,
+			Offset:     m.Offset,
+			CreatedAt:  m.CreatedAt,
+			ExpiresAt:  m.ExpiresAt,
+			Data:       string(m.Data),
+		})
+		if err != nil {
+			return 0, nil, fmt.Errorf("route expired: %w", err)
+		}
+		// the records audit expired messages, they never expire themselves
+		record := NewMessage(bs)
+		record.keep = true
+		records = append(records, record)
+	}
+	q.expiry.routed = next
+	return from, records, nil
+}
+
+// addExpired adds the records of expired messages to topic
+func (q *Queue) addExpired(ctx context.Context, topic string, records []*Message) error {
+	topics := q.expiredTopics
+	if topics == nil {
+		topics = func(name string) (*Topic, error) {
+			return GetTopic(name, q.storage, true)
+		}
+	}
+	t, err := topics(topic)
+	if err != nil {
+		return err
+	}
+	return t.AddMessages(ctx, records...)
 }
@@ -2,11 +2,16 @@ package push_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
 	"github.com/yang-zzhong/go-push"
 )
 
@@ -20,7 +25,8 @@ func TestQueue(t *testing.T) {
 		for i := 0; i < 10; i++ {
 			time.Sleep(time.Millisecond * 50)
 			if err := q.Add(ctx, []byte(fmt.Sprintf("%d", i))); err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 		}
 		for i := 0; i < 10; i++ {
@@ -31,14 +37,15 @@ func TestQueue(t *testing.T) {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			err := q.Subscribe(ctx, fmt.Sprintf("consumer: %d", i), 0, 100, func(data [][]byte, startOffset int64) error {
-				for o, item := range data {
-					fmt.Printf("consumer: %d, offset: %d: data: %s\n", i, startOffset+int64(o), item)
+			err := q.Subscribe(ctx, fmt.Sprintf("consumer: %d", i), 0, 100, func(msgs []*push.Message) error {
+				for _, m := range msgs {
+					fmt.Printf("consumer: %d, offset: %d: data: %s\n", i, m.Offset, m.Data)
 				}
 				return nil
 			})
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 		}(i)
 	}
@@ -57,7 +64,8 @@ func TestQueue_batch(t *testing.T) {
 			data = append(data, []byte(fmt.Sprintf("%d", i)))
 		}
 		if err := q.Add(ctx, data...); err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 		time.Sleep(time.Millisecond * 100)
 		for i := 0; i < 10; i++ {
@@ -68,17 +76,248 @@ func TestQueue_batch(t *testing.T) {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			err := q.Subscribe(ctx, fmt.Sprintf("consumer: %d", i), 0, 100, func(data [][]byte, startOffset int64) error {
-				for o, item := range data {
+			err := q.Subscribe(ctx, fmt.Sprintf("consumer: %d", i), 0, 100, func(msgs []*push.Message) error {
+				for _, m := range msgs {
 					time.Sleep(time.Millisecond * 50)
-					fmt.Printf("consumer: %d, offset: %d: data: %s\n", i, startOffset+int64(o), item)
+					fmt.Printf("consumer: %d, offset: %d: data: %s\n", i, m.Offset, m.Data)
 				}
 				return nil
 			})
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 		}(i)
 	}
 	wg.Wait()
 }
+
+func TestQueue_expired(t *testing.T) {
+	s := push.NewMemoryStorage()
+	q := push.NewQueue("ttl", s, true, push.WithExpiredTopic("ttl-expired"))
+	ctx := context.Background()
+	err := q.AddMessages(
+		ctx,
+		push.NewMessage([]byte("0")),
+		push.NewMessage([]byte("1")).WithTTL(time.Millisecond),
+		push.NewMessage([]byte("2")).WithTTL(time.Hour),
+	)
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 10)
+	offsets := []int64{}
+	err = q.Subscribe(ctx, "s", 0, 10, func(msgs []*push.Message) error {
+		for _, m := range msgs {
+			offsets = append(offsets, m.Offset)
+		}
+		q.Unsubscribe("s")
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 2}, offsets)
+	expired, err := s.Get(ctx, "ttl-expired", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(expired))
+	var record push.ExpiredMessage
+	assert.Nil(t, json.Unmarshal(expired[0].Data, &record))
+	assert.Equal(t, int64(1), record.Offset)
+	assert.Equal(t, "s", record.Subscriber)
+	assert.Equal(t, "1", record.Data)
+}
+
+// consumeOnce consumes q as subscriber until its first batch
+func consumeOnce(t *testing.T, q *push.Queue, subscriber string) {
+	err := q.Subscribe(context.Background(), subscriber, 0, 10, func([]*push.Message) error {
+		q.Unsubscribe(subscriber)
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestQueue_expiredOnce(t *testing.T) {
+	s := sqliteStorage(t)
+	q := push.NewQueue("ttl-once", s, true, push.WithExpiredTopic("ttl-once-expired"))
+	ctx := context.Background()
+	expired := push.NewMessage([]byte("1"))
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	assert.Nil(t, q.AddMessages(ctx, push.NewMessage([]byte("0")), expired))
+	consumeOnce(t, q, "a")
+	consumeOnce(t, q, "b")
+	// the offset routed up to is kept by the storage
+	consumeOnce(t, push.NewQueue("ttl-once", s, true, push.WithExpiredTopic("ttl-once-expired")), "c")
+	records, err := s.Get(ctx, "ttl-once-expired", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	var record push.ExpiredMessage
+	assert.Nil(t, json.Unmarshal(records[0].Data, &record))
+	assert.Equal(t, "a", record.Subscriber)
+}
+
+func TestHTTPServer_expiredTopicStorage(t *testing.T) {
+	shared, tenant := push.NewMemoryStorage(), push.NewMemoryStorage()
+	srv := httptest.NewServer(push.NewHTTPHandler(
+		shared, logf.New(),
+		push.WithTenantStorage("team-a", tenant),
+		push.WithQueueOptions(push.WithExpiredTopic("_sys-expired")),
+	))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	expired := push.NewMessage([]byte("1"))
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	assert.Nil(t, tenant.Create(ctx, "team-a/ttl"))
+	assert.Nil(t, tenant.Add(ctx, "team-a/ttl", []*push.Message{push.NewMessage([]byte("0")), expired}))
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	c.Subscribe(ctx, "team-a/ttl", "s", func(msg push.SubMessage) int64 {
+		cancel()
+		return msg.NextOffset()
+	})
+	// the expired topic is kept where the broker keeps topics of its name
+	records, err := shared.Get(context.Background(), "_sys-expired", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	_, err = tenant.Get(context.Background(), "_sys-expired", 0, 10)
+	assert.True(t, errors.Is(err, push.ErrQueueNotFound))
+}
+
+func TestHTTPServer_expiredTopicTTL(t *testing.T) {
+	s := push.NewMemoryStorage()
+	srv := httptest.NewServer(push.NewHTTPHandler(
+		s, logf.New(),
+		push.WithQueueOptions(push.WithExpiredTopic("ttl-audit-expired"), push.WithDefaultTTL(time.Hour)),
+	))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	expired := push.NewMessage([]byte("1"))
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	assert.Nil(t, s.Create(ctx, "ttl-audit"))
+	assert.Nil(t, s.Add(ctx, "ttl-audit", []*push.Message{push.NewMessage([]byte("0")), expired}))
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	c.Subscribe(ctx, "ttl-audit", "s", func(msg push.SubMessage) int64 {
+		cancel()
+		return msg.NextOffset()
+	})
+	// the default ttl of the broker doesn't expire the records
+	records, err := s.Get(context.Background(), "ttl-audit-expired", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.True(t, records[0].ExpiresAt.IsZero())
+}
+
+// slowStorage blocks adding to the queue of name until release is closed
+type slowStorage struct {
+	push.Storage
+	name    string
+	adding  chan struct{}
+	release chan struct{}
+}
+
+func (s slowStorage) Add(ctx context.Context, name string, msgs []*push.Message) error {
+	if name == s.name {
+		close(s.adding)
+		<-s.release
+	}
+	return s.Storage.Add(ctx, name, msgs)
+}
+
+func TestQueue_expiredSlowTopic(t *testing.T) {
+	s := slowStorage{
+		Storage: push.NewMemoryStorage(),
+		name:    "ttl-slow-expired",
+		adding:  make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	q := push.NewQueue("ttl-slow", s, true, push.WithExpiredTopic("ttl-slow-expired"))
+	ctx := context.Background()
+	assert.Nil(t, s.Create(ctx, "ttl-slow-expired"))
+	expired := push.NewMessage([]byte("1"))
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	assert.Nil(t, q.AddMessages(ctx, push.NewMessage([]byte("0")), expired))
+	routed := make(chan struct{})
+	go func() {
+		defer close(routed)
+		consumeOnce(t, q, "a")
+	}()
+	<-s.adding
+	// another subscriber isn't held up by the records being written
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumeOnce(t, q, "b")
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscriber blocked by routing expired messages")
+	}
+	close(s.release)
+	<-routed
+	records, err := s.Get(ctx, "ttl-slow-expired", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+}
+
+func TestQueue_slowSubscriber(t *testing.T) {
+	q := push.NewQueue("slow", push.NewMemoryStorage(), true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	var (
+		lock     sync.Mutex
+		received int
+	)
+	go q.Subscribe(ctx, "slow", 0, 100, func(msgs []*push.Message) error {
+		<-release
+		lock.Lock()
+		defer lock.Unlock()
+		received += len(msgs)
+		return nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, q.Add(ctx, []byte(fmt.Sprintf("%d", i))))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("producer blocked by a slow subscriber")
+	}
+	close(release)
+	// the coalesced wakeups still deliver every message
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return received == 100
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestQueue_defaultTTL(t *testing.T) {
+	s := push.NewMemoryStorage()
+	q := push.NewQueue("default-ttl", s, true, push.WithDefaultTTL(time.Hour))
+	ctx := context.Background()
+	at := time.Now().Add(time.Minute)
+	assert.Nil(t, q.AddMessages(ctx, push.NewMessage([]byte("a")), &push.Message{Data: []byte("b"), ExpiresAt: at}))
+	msgs, err := s.Get(ctx, "default-ttl", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.True(t, msgs[0].ExpiresAt.After(time.Now().Add(59*time.Minute)))
+	assert.True(t, msgs[1].ExpiresAt.Equal(at))
+}
+
+func TestQueue_retention(t *testing.T) {
+	s := push.NewMemoryStorage()
+	r := push.NewRetention(0, "")
+	q := push.NewQueue("retention", s, true, push.WithDefaultTTL(time.Minute), push.WithRetention(r))
+	ctx := context.Background()
+	assert.Nil(t, q.Add(ctx, []byte("a")))
+	r.Set(time.Hour, "")
+	assert.Nil(t, q.Add(ctx, []byte("b")))
+	msgs, err := s.Get(ctx, "retention", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.True(t, msgs[0].ExpiresAt.IsZero())
+	assert.True(t, msgs[1].ExpiresAt.After(time.Now().Add(59*time.Minute)))
+}
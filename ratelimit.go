@@ -0,0 +1,154 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// errBurstExceeded is the error of taking more tokens than a bucket holds,
+// which no wait allows
+var errBurstExceeded = errors.New("more messages than the burst")
+
+// tokenBucket allows rate events per second on average, with bursts of up
+// to burst events
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take takes n tokens if there are enough of them, otherwise it takes none
+// and returns how long it takes until there are. More tokens than the burst
+// are never taken, it fails with errBurstExceeded
+func (b *tokenBucket) take(n int) (bool, time.Duration, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	need := float64(n)
+	if need > b.burst {
+		return false, 0, fmt.Errorf("%w: %d messages, burst of %g", errBurstExceeded, n, b.burst)
+	}
+	if need <= b.tokens {
+		b.tokens -= need
+		return true, 0, nil
+	}
+	return false, time.Duration((need - b.tokens) / b.rate * float64(time.Second)), nil
+}
+
+// refill adds the tokens earned since last, the lock is held
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// set changes the rate and the burst of the bucket, keeping the tokens it
+// holds up to the new burst
+func (b *tokenBucket) set(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	b.rate, b.burst = rate, float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// RateLimit limits how many messages per second are pushed by each
+// principal, the tenant or else the remote address of the request, and to
+// each topic. Zero rates are unlimited, bursts default to the rates
+type RateLimit struct {
+	PrincipalRate  float64
+	PrincipalBurst int
+	TopicRate      float64
+	TopicBurst     int
+}
+
+// rateLimiter keeps a token bucket per key
+type rateLimiter struct {
+	rate    float64
+	burst   int
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// maxIdleBuckets is the number of buckets above which the buckets of idle
+// keys are dropped
+const maxIdleBuckets = 4096
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(rate + 0.5)
+	}
+	return &rateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// take takes n tokens of the bucket of key, a nil limiter allows everything
+func (l *rateLimiter) take(key string, n int) (bool, time.Duration, error) {
+	if l == nil {
+		return true, 0, nil
+	}
+	l.lock.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.sweep()
+		}
+		b = newTokenBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	l.lock.Unlock()
+	return b.take(n)
+}
+
+// sweep drops the buckets idle long enough to be full again, as they're
+// the same as new ones
+func (l *rateLimiter) sweep() {
+	refill := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	now := time.Now()
+	for key, b := range l.buckets {
+		b.lock.Lock()
+		idle := now.Sub(b.last) > refill && b.tokens >= 0
+		b.lock.Unlock()
+		if idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// update makes the limiter take the rate and the burst of next, keeping the
+// tokens of its buckets. It returns the limiter to use from now on
+func (l *rateLimiter) update(next *rateLimiter) *rateLimiter {
+	if l == nil || next == nil {
+		return next
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate, l.burst = next.rate, next.burst
+	for _, b := range l.buckets {
+		b.set(l.rate, l.burst)
+	}
+	return l
+}
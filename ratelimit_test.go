@@ -0,0 +1,91 @@
+package push_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+func TestHTTPServer_rateLimit(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithRateLimit(push.RateLimit{
+		PrincipalRate: 1000,
+		TopicRate:     0.5,
+		TopicBurst:    2,
+	})))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("limited", [][]byte{[]byte("a"), []byte("b")}))
+	assert.True(t, errors.Is(c.Push("limited", [][]byte{[]byte("c")}), push.ErrRateLimited))
+	// other topics have their own bucket
+	assert.Nil(t, c.Push("unlimited", [][]byte{[]byte("a")}))
+	resp, err := http.Post(srv.URL+"/limited/push", "application/json", bytes.NewReader([]byte(`{"body":["d"]}`)))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+}
+
+func TestHTTPServer_principalRateLimit(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithRateLimit(push.RateLimit{
+		PrincipalRate: 1,
+	})))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("first", [][]byte{[]byte("a")}))
+	assert.True(t, errors.Is(c.Push("second", [][]byte{[]byte("a")}), push.ErrRateLimited))
+}
+
+func TestHTTPServer_rateLimitBeforeQuota(t *testing.T) {
+	tenant := &push.Tenant{Name: "limited", Keys: []string{"key"}, Quota: push.Quota{MaxTopics: 2}}
+	ts, err := push.NewTenants(tenant)
+	assert.Nil(t, err)
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithTenants(ts), push.WithRateLimit(push.RateLimit{
+		PrincipalRate:  20,
+		PrincipalBurst: 1,
+	})))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL, APIKey: "key"}
+	assert.Nil(t, c.Push("first", [][]byte{[]byte("a")}))
+	assert.True(t, errors.Is(c.Push("second", [][]byte{[]byte("a")}), push.ErrRateLimited))
+	// the push rate limited doesn't take a topic of the tenant
+	assert.Equal(t, 1, tenant.Usage().Topics)
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, c.Push("third", [][]byte{[]byte("a")}))
+	assert.Equal(t, 2, tenant.Usage().Topics)
+}
+
+func TestHTTPServer_rateLimitBurst(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithRateLimit(push.RateLimit{
+		TopicRate:  0.5,
+		TopicBurst: 2,
+	})))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	// a batch larger than the burst never fits, it is rejected without a debt
+	assert.True(t, errors.Is(c.Push("limited", [][]byte{[]byte("a"), []byte("b"), []byte("c")}), push.ErrInvalidParams))
+	assert.Nil(t, c.Push("limited", [][]byte{[]byte("a"), []byte("b")}))
+}
+
+func TestHTTPServer_rateLimitReload(t *testing.T) {
+	h := push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithRateLimit(push.RateLimit{
+		TopicRate:  0.5,
+		TopicBurst: 2,
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("limited", [][]byte{[]byte("a"), []byte("b")}))
+	h.Reload(push.WithRateLimit(push.RateLimit{
+		TopicRate:  0.5,
+		TopicBurst: 4,
+	}))
+	// the tokens taken before the reload still count
+	assert.True(t, errors.Is(c.Push("limited", [][]byte{[]byte("c")}), push.ErrRateLimited))
+}
@@ -0,0 +1,117 @@
+package push
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultReconnectInitialInterval = 500 * time.Millisecond
+	defaultReconnectMaxInterval     = 30 * time.Second
+	defaultReconnectJitter          = 0.5
+)
+
+// Reconnect is how Subscribe reconnects when its stream fails or ends.
+// Reconnections resume every partition from the last offset the handler
+// returned, the zero Reconnect reconnects forever with the defaults
+type Reconnect struct {
+	// InitialInterval is the delay before the first attempt to reconnect,
+	// doubled at each attempt failing up to MaxInterval. They default to
+	// 500ms and 30s
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// Jitter randomizes each delay by up to this fraction of it, so that
+	// subscribers dropped together don't come back together. It defaults
+	// to 0.5
+	Jitter float64
+	// MaxRetries is the number of attempts failing in a row before
+	// Subscribe gives up, zero retries forever and a negative number never
+	// reconnects
+	MaxRetries int
+	// Permanent tells the errors not worth retrying, IsPermanent by default
+	Permanent func(err error) bool
+	// OnConnect is called each time the stream is established
+	OnConnect func()
+	// OnDisconnect is called each time an established stream ends, with
+	// the error ending it, nil when the broker closed it
+	OnDisconnect func(err error)
+}
+
+// SubscribeReconnect sets how the subscription reconnects
+func SubscribeReconnect(r Reconnect) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.reconnect = r
+	}
+}
+
+// IsPermanent tells whether err fails every attempt to subscribe alike, as
+// being unauthorized or subscribing with invalid params, or fails every
+// attempt to handle a message alike, as a message not decodable does
+func IsPermanent(err error) bool {
+	return errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrInvalidParams) || errors.Is(err, ErrInvalidTopicName) ||
+		errors.Is(err, ErrUndecodable)
+}
+
+func (r Reconnect) withDefaults() Reconnect {
+	if r.InitialInterval <= 0 {
+		r.InitialInterval = defaultReconnectInitialInterval
+	}
+	if r.MaxInterval <= 0 {
+		r.MaxInterval = defaultReconnectMaxInterval
+	}
+	if r.MaxInterval < r.InitialInterval {
+		r.MaxInterval = r.InitialInterval
+	}
+	if r.Jitter <= 0 {
+		r.Jitter = defaultReconnectJitter
+	}
+	if r.Jitter > 1 {
+		r.Jitter = 1
+	}
+	if r.Permanent == nil {
+		r.Permanent = IsPermanent
+	}
+	return r
+}
+
+// reconnectBackoff is the delay between attempts to reconnect
+type reconnectBackoff struct {
+	Reconnect
+	interval time.Duration
+	failures int
+}
+
+func newReconnectBackoff(r Reconnect) *reconnectBackoff {
+	r = r.withDefaults()
+	return &reconnectBackoff{Reconnect: r, interval: r.InitialInterval}
+}
+
+// reset starts over once an attempt connected
+func (b *reconnectBackoff) reset() {
+	b.interval = b.InitialInterval
+	b.failures = 0
+}
+
+// next returns the delay before the next attempt, false when there's none
+// after err
+func (b *reconnectBackoff) next(connected bool, err error) (time.Duration, bool) {
+	if connected {
+		b.reset()
+	}
+	if b.MaxRetries < 0 || err != nil && b.Permanent(err) {
+		return 0, false
+	}
+	if !connected {
+		b.failures++
+	}
+	if b.MaxRetries > 0 && b.failures > b.MaxRetries {
+		return 0, false
+	}
+	delay := b.interval
+	if b.interval *= 2; b.interval > b.MaxInterval {
+		b.interval = b.MaxInterval
+	}
+	spread := float64(delay) * b.Jitter
+	return delay + time.Duration(spread*(2*rand.Float64()-1)), true
+}
@@ -0,0 +1,201 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+// flakyServer serves h, except the subscribe requests fail answers, given
+// their number
+type flakyServer struct {
+	h    http.Handler
+	fail func(n int, w http.ResponseWriter, req *http.Request) bool
+	lock sync.Mutex
+	// queries are the queries of the subscribe requests
+	queries []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/subscribe") {
+		s.lock.Lock()
+		s.queries = append(s.queries, req.URL.RawQuery)
+		n := len(s.queries)
+		s.lock.Unlock()
+		if s.fail(n, w, req) {
+			return
+		}
+	}
+	s.h.ServeHTTP(w, req)
+}
+
+func (s *flakyServer) requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+func closing(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(`{"code":"server.closing","message":"server closing"}`))
+}
+
+var fastReconnect = push.Reconnect{InitialInterval: 10 * time.Millisecond, MaxInterval: 50 * time.Millisecond}
+
+func TestHTTPClient_reconnect(t *testing.T) {
+	srv := &flakyServer{h: push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())}
+	srv.fail = func(n int, w http.ResponseWriter, req *http.Request) bool {
+		switch n {
+		case 1:
+			closing(w)
+			return true
+		case 2:
+			// the stream drops after a batch
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(`data:{"partition":0,"start_offset":0,"data":["a","b","c"],"offsets":[0,1,2]}` + "\n\n"))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		return false
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := &push.HTTPClient{Endpoint: ts.URL}
+	assert.Nil(t, c.Push("flaky", [][]byte{[]byte("a"), []byte("b"), []byte("c")}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var (
+		received    [][]string
+		connects    int
+		disconnects []error
+	)
+	r := fastReconnect
+	r.OnConnect = func() { connects++ }
+	r.OnDisconnect = func(err error) { disconnects = append(disconnects, err) }
+	err := c.Subscribe(ctx, "flaky", "s", func(msg push.SubMessage) int64 {
+		received = append(received, msg.Data)
+		if len(received) == 1 {
+			// only a is handled
+			return msg.Offset(1)
+		}
+		cancel()
+		return msg.NextOffset()
+	}, push.SubscribeReconnect(r))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, [][]string{{"a", "b", "c"}, {"b", "c"}}, received)
+	queries := srv.requests()
+	assert.Equal(t, 3, len(queries))
+	assert.True(t, strings.Contains(queries[0], "offsets=0%3A0"))
+	assert.True(t, strings.Contains(queries[2], "offsets=0%3A1"))
+	assert.Equal(t, 2, connects)
+	assert.Equal(t, 2, len(disconnects))
+	assert.NotNil(t, disconnects[0])
+	var offset int64
+	assert.Nil(t, c.OffsetStorage.GetOffset(context.Background(), "flaky", "s", &offset))
+	assert.Equal(t, int64(3), offset)
+}
+
+func TestHTTPClient_reconnectSince(t *testing.T) {
+	srv := &flakyServer{h: push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())}
+	srv.fail = func(n int, w http.ResponseWriter, req *http.Request) bool {
+		if n == 1 {
+			closing(w)
+			return true
+		}
+		return false
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := &push.HTTPClient{Endpoint: ts.URL}
+	assert.Nil(t, c.Push("flaky-since", [][]byte{[]byte("a")}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := fastReconnect
+	r.OnConnect = func() { go c.Push("flaky-since", [][]byte{[]byte("b")}) }
+	var received []string
+	c.Subscribe(ctx, "flaky-since", "s", func(msg push.SubMessage) int64 {
+		received = append(received, msg.Data...)
+		cancel()
+		return msg.NextOffset()
+	}, push.SubscribeFromLatest(), push.SubscribeReconnect(r))
+	assert.Equal(t, []string{"b"}, received)
+	// nothing handled before the retry, which starts from the latest again
+	queries := srv.requests()
+	assert.Equal(t, 2, len(queries))
+	assert.True(t, strings.Contains(queries[1], "offset=latest"))
+	assert.False(t, strings.Contains(queries[1], "offsets="))
+}
+
+func TestHTTPClient_reconnectFromStart(t *testing.T) {
+	srv := &flakyServer{h: push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := &push.HTTPClient{Endpoint: ts.URL}
+	srv.fail = func(n int, w http.ResponseWriter, req *http.Request) bool {
+		if n == 1 {
+			// the stream drops once started from the latest offset, and b
+			// is pushed before the subscriber is back
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("event:start\ndata:{\"offsets\":{\"0\":1}}\n\n"))
+			w.(http.Flusher).Flush()
+			assert.Nil(t, c.Push("flaky-start", [][]byte{[]byte("b")}))
+			panic(http.ErrAbortHandler)
+		}
+		return false
+	}
+	assert.Nil(t, c.Push("flaky-start", [][]byte{[]byte("a")}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var received []string
+	c.Subscribe(ctx, "flaky-start", "s", func(msg push.SubMessage) int64 {
+		received = append(received, msg.Data...)
+		cancel()
+		return msg.NextOffset()
+	}, push.SubscribeFromLatest(), push.SubscribeReconnect(fastReconnect))
+	assert.Equal(t, []string{"b"}, received)
+	queries := srv.requests()
+	assert.Equal(t, 2, len(queries))
+	assert.True(t, strings.Contains(queries[1], "offsets=0%3A1"))
+}
+
+func TestHTTPClient_reconnectGivesUp(t *testing.T) {
+	srv := &flakyServer{h: push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())}
+	srv.fail = func(_ int, w http.ResponseWriter, _ *http.Request) bool {
+		closing(w)
+		return true
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &push.HTTPClient{Endpoint: ts.URL}
+	r := fastReconnect
+	r.MaxRetries = 2
+	err := c.Subscribe(ctx, "flaky-down", "s", nil, push.SubscribePartitions(0), push.SubscribeReconnect(r))
+	assert.True(t, errors.Is(err, push.ErrServerClosing))
+	assert.Equal(t, 3, len(srv.requests()))
+
+	ts2 := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithTenants(mustTenants(t))))
+	defer ts2.Close()
+	c = &push.HTTPClient{Endpoint: ts2.URL, APIKey: "wrong"}
+	err = c.Subscribe(ctx, "flaky-auth", "s", nil, push.SubscribePartitions(0), push.SubscribeReconnect(fastReconnect))
+	assert.True(t, errors.Is(err, push.ErrUnauthorized))
+	assert.Nil(t, ctx.Err())
+}
+
+func mustTenants(t *testing.T) *push.Tenants {
+	ts, err := push.NewTenants(&push.Tenant{Name: "team", Keys: []string{"key"}})
+	assert.Nil(t, err)
+	return ts
+}
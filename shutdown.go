@@ -0,0 +1,89 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrServerClosing = errors.New("server closing")
+
+// eventClosing is the event telling a subscriber the server is closing
+const eventClosing = "closing"
+
+// Closing is the data of the closing event, Offsets holds the offset each
+// subscribed partition resumes from
+type Closing struct {
+	Reason  string        `json:"reason"`
+	Offsets map[int]int64 `json:"offsets"`
+}
+
+// drainer tracks the requests in flight, so that shutting down waits for them
+type drainer struct {
+	lock    sync.Mutex
+	closed  bool
+	closing chan struct{}
+	pushes  sync.WaitGroup
+	subs    sync.WaitGroup
+}
+
+func newDrainer() *drainer {
+	return &drainer{closing: make(chan struct{})}
+}
+
+// begin accounts a request of wg, unless the server is closing
+func (d *drainer) begin(wg *sync.WaitGroup) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return false
+	}
+	wg.Add(1)
+	return true
+}
+
+// subscribeContext returns a context of a subscription, done once ctx is
+// or the server closes
+func (d *drainer) subscribeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-d.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (d *drainer) isClosing() bool {
+	select {
+	case <-d.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown refuses new requests, ends the subscriptions and waits for the
+// requests in flight until ctx is done
+func (d *drainer) shutdown(ctx context.Context) error {
+	d.lock.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.closing)
+	}
+	d.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.pushes.Wait()
+		d.subs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,48 @@
+package push_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+func TestHTTPHandler_shutdown(t *testing.T) {
+	h := push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("draining", [][]byte{[]byte("0"), []byte("1")}))
+	resp, err := http.Get(srv.URL + "/draining/subscribe?subscriber=s")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	// the start event and the batch of the messages pushed
+	for i := 0; i < 2; i++ {
+		_, err = readEvent(r)
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, h.Shutdown(ctx))
+	closing, err := readEvent(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "event:closing", closing[0])
+	var data push.Closing
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(closing[1], "data:")), &data))
+	assert.Equal(t, map[int]int64{0: 2}, data.Offsets)
+
+	pushResp, err := http.Post(srv.URL+"/draining/push", "application/json", strings.NewReader(`{"body":["2"]}`))
+	assert.Nil(t, err)
+	defer pushResp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, pushResp.StatusCode)
+}
@@ -0,0 +1,202 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func sqliteStorage(t *testing.T, opts ...push.DBOption) push.ClientServerStorage {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "push.db")))
+	assert.Nil(t, err)
+	assert.Nil(t, push.MigrateDB(db, opts...))
+	return push.NewDBStorage(db, opts...)
+}
+
+func testOffsetAt(t *testing.T, s push.Storage) {
+	ctx := context.Background()
+	assert.Nil(t, s.Create(ctx, "replay"))
+	first, next, err := s.Bounds(ctx, "replay")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), first)
+	assert.Equal(t, int64(0), next)
+	assert.Nil(t, s.Add(ctx, "replay", []*push.Message{push.NewMessage([]byte("0")), push.NewMessage([]byte("1"))}))
+	time.Sleep(20 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, s.Add(ctx, "replay", []*push.Message{push.NewMessage([]byte("2"))}))
+	offset, err := s.OffsetAt(ctx, "replay", since)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), offset)
+	offset, err = s.OffsetAt(ctx, "replay", time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), offset)
+	first, next, err = s.Bounds(ctx, "replay")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), first)
+	assert.Equal(t, int64(3), next)
+	_, err = s.OffsetAt(ctx, "unknown", since)
+	assert.True(t, errors.Is(err, push.ErrQueueNotFound))
+}
+
+func TestOffsetAt_memory(t *testing.T) {
+	testOffsetAt(t, push.NewMemoryStorage())
+}
+
+func TestOffsetAt_sqlite(t *testing.T) {
+	testOffsetAt(t, sqliteStorage(t))
+}
+
+func TestOffsetAt_sqliteSingleTable(t *testing.T) {
+	testOffsetAt(t, sqliteStorage(t, push.WithDBLayout(push.DBLayoutSingleTable)))
+}
+
+func TestDBStorage_notMigrated(t *testing.T) {
+	for _, layout := range []push.DBLayout{push.DBLayoutTablePerTopic, push.DBLayoutSingleTable} {
+		t.Run(string(layout), func(t *testing.T) {
+			db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "push.db")))
+			assert.Nil(t, err)
+			// the shared tables are created as they are first needed
+			s := push.NewDBStorage(db, push.WithDBLayout(layout))
+			ctx := context.Background()
+			assert.Nil(t, s.SetOffset(ctx, "orders", "a", 1))
+			q, err := push.GetQueue("not-migrated-"+string(layout), s, true)
+			assert.Nil(t, err)
+			assert.Nil(t, q.Add(ctx, []byte("a"), []byte("b")))
+			msgs, err := s.Get(ctx, "not-migrated-"+string(layout), 0, 10)
+			assert.Nil(t, err)
+			assert.Equal(t, 2, len(msgs))
+			var offset int64
+			assert.Nil(t, s.GetOffset(ctx, "orders", "a", &offset))
+			assert.Equal(t, int64(1), offset)
+
+			other := push.NewDBStorage(db, push.WithDBLayout(layout))
+			_, err = other.Get(ctx, "unknown", 0, 10)
+			assert.True(t, errors.Is(err, push.ErrQueueNotFound))
+		})
+	}
+}
+
+func TestMigrateDB_catalogExistingTables(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "push.db")))
+	assert.Nil(t, err)
+	// a topic created before the catalog existed
+	assert.Nil(t, db.Table("q_legacy").AutoMigrate(&push.DBItem{}))
+	assert.Nil(t, db.Table("q_legacy").Create(&push.DBItem{Offset: 0, Data: []byte("old")}).Error)
+	s := push.NewDBStorage(db)
+	ctx := context.Background()
+	assert.Nil(t, push.MigrateDB(db))
+	msgs := []*push.Message{push.NewMessage([]byte("new"))}
+	assert.Nil(t, s.Add(ctx, "legacy", msgs))
+	assert.Equal(t, int64(1), msgs[0].Offset)
+}
+
+func TestMigrateToSingleTable(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "push.db")))
+	assert.Nil(t, err)
+	assert.Nil(t, push.MigrateDB(db))
+	ctx := context.Background()
+	old := push.NewDBStorage(db)
+	for _, name := range []string{"a", "b"} {
+		assert.Nil(t, old.Create(ctx, name))
+		assert.Nil(t, old.Add(ctx, name, []*push.Message{push.NewMessage([]byte(name + "0")), push.NewMessage([]byte(name + "1"))}))
+	}
+	single := push.WithDBLayout(push.DBLayoutSingleTable)
+	assert.True(t, errors.Is(push.MigrateDB(db, single), push.ErrTopicTablesLeft))
+	assert.Nil(t, push.MigrateToSingleTable(db))
+	assert.False(t, db.Migrator().HasTable("q_a"))
+	assert.Nil(t, push.MigrateDB(db, single))
+	s := push.NewDBStorage(db, single)
+	msgs := []*push.Message{push.NewMessage([]byte("b2"))}
+	assert.Nil(t, s.Add(ctx, "b", msgs))
+	assert.Equal(t, int64(2), msgs[0].Offset)
+	for _, name := range []string{"a", "b"} {
+		msgs, err := s.Get(ctx, name, 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, name+"0", string(msgs[0].Data))
+		assert.Equal(t, name+"1", string(msgs[1].Data))
+	}
+	msgs, err = s.Get(ctx, "b", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(msgs))
+}
+
+func testReadOffsets(t *testing.T, s push.OffsetStorage) {
+	ctx := context.Background()
+	assert.Nil(t, s.SetOffset(ctx, "orders", "a", 3))
+	assert.Nil(t, s.SetOffset(ctx, "orders", "b", 5))
+	assert.Nil(t, s.SetOffset(ctx, "orders", "a", 4))
+	var offset int64
+	assert.Nil(t, s.GetOffset(ctx, "orders", "a", &offset))
+	assert.Equal(t, int64(4), offset)
+	assert.Nil(t, s.GetOffset(ctx, "orders", "b", &offset))
+	assert.Equal(t, int64(5), offset)
+	assert.Nil(t, s.GetOffset(ctx, "orders", "c", &offset))
+	assert.Equal(t, int64(0), offset)
+}
+
+func TestReadOffsets_memory(t *testing.T) {
+	testReadOffsets(t, push.NewMemoryOffsetStorage())
+}
+
+func TestReadOffsets_sqlite(t *testing.T) {
+	testReadOffsets(t, sqliteStorage(t))
+}
+
+func TestMigrateDB_legacyReadOffsets(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "push.db")))
+	assert.Nil(t, err)
+	// offsets kept by topic only
+	assert.Nil(t, db.Exec("CREATE TABLE topic_read_offsets (topic VARCHAR(64) PRIMARY KEY, `offset` BIGINT)").Error)
+	assert.Nil(t, db.Exec("INSERT INTO topic_read_offsets (topic, `offset`) VALUES ('orders', 7)").Error)
+	assert.Nil(t, push.MigrateDB(db))
+	assert.Nil(t, push.MigrateDB(db))
+	s := push.NewDBStorage(db)
+	ctx := context.Background()
+	var offset int64
+	// subscribers start from the offset of the topic
+	assert.Nil(t, s.GetOffset(ctx, "orders", "a", &offset))
+	assert.Equal(t, int64(7), offset)
+	assert.Nil(t, s.SetOffset(ctx, "orders", "a", 9))
+	assert.Nil(t, s.GetOffset(ctx, "orders", "a", &offset))
+	assert.Equal(t, int64(9), offset)
+	assert.Nil(t, s.GetOffset(ctx, "orders", "b", &offset))
+	assert.Equal(t, int64(7), offset)
+	assert.False(t, db.Migrator().HasTable("topic_read_offsets_legacy"))
+}
+
+func TestDBStorage_legacyReadOffsets(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "push.db")))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Exec("CREATE TABLE topic_read_offsets (topic VARCHAR(64) PRIMARY KEY, `offset` BIGINT)").Error)
+	assert.Nil(t, db.Exec("INSERT INTO topic_read_offsets (topic, `offset`) VALUES ('orders', 7)").Error)
+	// the table is upgraded as it's first used, without MigrateDB
+	s := push.NewDBStorage(db)
+	ctx := context.Background()
+	var offset int64
+	assert.Nil(t, s.GetOffset(ctx, "orders", "a", &offset))
+	assert.Equal(t, int64(7), offset)
+	assert.Nil(t, s.SetOffset(ctx, "orders", "a", 9))
+	assert.Nil(t, s.GetOffset(ctx, "orders", "a", &offset))
+	assert.Equal(t, int64(9), offset)
+	assert.True(t, db.Migrator().HasColumn(&push.TopicReadOffset{}, "subscriber"))
+}
+
+func TestDBStorage_noMigrationInTransaction(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "push.db")))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Transaction(func(tx *gorm.DB) error {
+		// no DDL runs in the transaction of the caller
+		err := push.NewDBStorage(tx).SetOffset(context.Background(), "orders", "a", 1)
+		assert.Equal(t, push.DBErrorNoSuchTable, push.ClassifyDBError("sqlite", err))
+		assert.False(t, tx.Migrator().HasTable(&push.TopicReadOffset{}))
+		return nil
+	}))
+}
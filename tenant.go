@@ -0,0 +1,294 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrUnauthorized  = errors.New("unauthorized")
+)
+
+// SizedStorage is implemented by storages able to tell how many bytes of
+// message data a topic keeps
+type SizedStorage interface {
+	Storage
+	Size(ctx context.Context, name string) (int64, error)
+}
+
+// Quota limits what a tenant can use of the broker, zero values are unlimited
+type Quota struct {
+	MaxTopics      int   `json:"max_topics"`
+	MaxStoredBytes int64 `json:"max_stored_bytes"`
+	// MaxPublishRate is in messages per second
+	MaxPublishRate float64 `json:"max_publish_rate"`
+	MaxSubscribers int     `json:"max_subscribers"`
+}
+
+// TenantUsage is what a tenant uses of its quota
+type TenantUsage struct {
+	Tenant      string `json:"tenant"`
+	Topics      int    `json:"topics"`
+	StoredBytes int64  `json:"stored_bytes"`
+	Subscribers int    `json:"subscribers"`
+	Quota       Quota  `json:"quota"`
+}
+
+// Tenant is a team sharing the broker. Its topics are named tenant/topic
+// and it authenticates with any of its keys, or with a client certificate
+// the common name of which is one of its subjects. Usage is accounted by this
+// process: topics count once used, and stored bytes are loaded from the
+// storage the first time a topic is pushed to, then grow with each push.
+// Usage isn't persisted nor shared, so brokers sharing a storage each
+// enforce the quota on their own, a restarted broker counts topics from
+// none again, and stored bytes don't shrink as messages are compacted
+type Tenant struct {
+	Name     string
+	Keys     []string
+	Subjects []string
+	Quota    Quota
+
+	lock        sync.Mutex
+	topics      map[string]struct{}
+	sized       map[string]struct{}
+	storedBytes atomic.Int64
+	subscribers atomic.Int64
+	publish     *tokenBucket
+	init        sync.Once
+}
+
+func (t *Tenant) doInit() {
+	t.init.Do(func() {
+		t.topics = make(map[string]struct{})
+		t.sized = make(map[string]struct{})
+		if t.Quota.MaxPublishRate > 0 {
+			t.publish = newTokenBucket(t.Quota.MaxPublishRate, int(math.Ceil(t.Quota.MaxPublishRate)))
+		}
+	})
+}
+
+// Scope returns the name topic of the tenant is kept under
+func (t *Tenant) Scope(topic string) string {
+	return t.Name + NamespaceSeparator + topic
+}
+
+// Usage returns what the tenant uses of its quota
+func (t *Tenant) Usage() TenantUsage {
+	t.doInit()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return TenantUsage{
+		Tenant:      t.Name,
+		Topics:      len(t.topics),
+		StoredBytes: t.storedBytes.Load(),
+		Subscribers: int(t.subscribers.Load()),
+		Quota:       t.Quota,
+	}
+}
+
+// useTopic accounts topic, the scoped name of a topic of the tenant
+func (t *Tenant) useTopic(topic string) error {
+	t.doInit()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.topics[topic]; ok {
+		return nil
+	}
+	if t.Quota.MaxTopics > 0 && len(t.topics) >= t.Quota.MaxTopics {
+		return fmt.Errorf("%w: tenant [%s] has %d topics", ErrQuotaExceeded, t.Name, len(t.topics))
+	}
+	t.topics[topic] = struct{}{}
+	return nil
+}
+
+// limits returns the quota of the tenant and the bucket of its publish rate
+func (t *Tenant) limits() (Quota, *tokenBucket) {
+	t.doInit()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.Quota, t.publish
+}
+
+// update replaces the credentials and the quota of the tenant, keeping its
+// usage
+func (t *Tenant) update(next *Tenant) {
+	t.doInit()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Keys = next.Keys
+	t.Subjects = next.Subjects
+	quota := next.Quota
+	switch {
+	case quota.MaxPublishRate <= 0:
+		t.publish = nil
+	case t.publish == nil:
+		t.publish = newTokenBucket(quota.MaxPublishRate, int(math.Ceil(quota.MaxPublishRate)))
+	default:
+		// the tokens taken already still count
+		t.publish.set(quota.MaxPublishRate, int(math.Ceil(quota.MaxPublishRate)))
+	}
+	t.Quota = quota
+}
+
+// subscribe accounts a subscriber, release must be called once it ends
+func (t *Tenant) subscribe() (release func(), err error) {
+	quota, _ := t.limits()
+	n := t.subscribers.Add(1)
+	if quota.MaxSubscribers > 0 && n > int64(quota.MaxSubscribers) {
+		t.subscribers.Add(-1)
+		return nil, fmt.Errorf("%w: tenant [%s] has %d subscribers", ErrQuotaExceeded, t.Name, n-1)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.subscribers.Add(-1) })
+	}, nil
+}
+
+// admit checks msgs added to queue q against the publish rate and the
+// stored bytes quotas, and accounts their bytes. The bytes must be given
+// back with free if the messages are not added in the end
+func (t *Tenant) admit(ctx context.Context, q *Queue, msgs []*Message) (int64, error) {
+	t.doInit()
+	if err := t.loadSize(ctx, q); err != nil {
+		return 0, err
+	}
+	quota, publish := t.limits()
+	if publish != nil {
+		if ok, _, err := publish.take(len(msgs)); err != nil || !ok {
+			return 0, fmt.Errorf("%w: tenant [%s] publishes more than %g messages per second", ErrQuotaExceeded, t.Name, quota.MaxPublishRate)
+		}
+	}
+	var size int64
+	for _, m := range msgs {
+		size += int64(len(m.Data))
+	}
+	if stored := t.storedBytes.Add(size); quota.MaxStoredBytes > 0 && stored > quota.MaxStoredBytes {
+		t.storedBytes.Add(-size)
+		return 0, fmt.Errorf("%w: tenant [%s] stores more than %d bytes", ErrQuotaExceeded, t.Name, quota.MaxStoredBytes)
+	}
+	return size, nil
+}
+
+func (t *Tenant) free(size int64) {
+	t.storedBytes.Add(-size)
+}
+
+// loadSize accounts the bytes queue q already keeps, once per queue and
+// process. A db storage sums the data of the whole topic to tell them
+func (t *Tenant) loadSize(ctx context.Context, q *Queue) error {
+	ss, ok := q.storage.(SizedStorage)
+	if !ok {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.sized[q.name]; ok {
+		return nil
+	}
+	size, err := ss.Size(ctx, q.name)
+	if err != nil && !errors.Is(err, ErrQueueNotFound) {
+		return fmt.Errorf("size of [%s]: %w", q.name, err)
+	}
+	t.storedBytes.Add(size)
+	t.sized[q.name] = struct{}{}
+	return nil
+}
+
+// Tenants holds the tenants of the broker, indexed by their credentials
+type Tenants struct {
+	tenants  []*Tenant
+	keys     map[string]*Tenant
+	subjects map[string]*Tenant
+}
+
+func NewTenants(tenants ...*Tenant) (*Tenants, error) {
+	ts := &Tenants{keys: make(map[string]*Tenant), subjects: make(map[string]*Tenant)}
+	names := make(map[string]struct{})
+	for _, t := range tenants {
+		if err := ValidateTopicName(t.Scope("topic")); err != nil {
+			return nil, fmt.Errorf("invalid tenant [%s]: %w", t.Name, err)
+		}
+		if _, ok := names[t.Name]; ok {
+			return nil, fmt.Errorf("tenant [%s] is duplicated", t.Name)
+		}
+		names[t.Name] = struct{}{}
+		for _, key := range t.Keys {
+			if key == "" {
+				return nil, fmt.Errorf("empty key of tenant [%s]", t.Name)
+			}
+			if _, ok := ts.keys[key]; ok {
+				return nil, fmt.Errorf("key of tenant [%s] is used by another tenant", t.Name)
+			}
+			ts.keys[key] = t
+		}
+		for _, subject := range t.Subjects {
+			if subject == "" {
+				return nil, fmt.Errorf("empty subject of tenant [%s]", t.Name)
+			}
+			if _, ok := ts.subjects[subject]; ok {
+				return nil, fmt.Errorf("subject [%s] of tenant [%s] is used by another tenant", subject, t.Name)
+			}
+			ts.subjects[subject] = t
+		}
+		ts.tenants = append(ts.tenants, t)
+	}
+	return ts, nil
+}
+
+// update returns the tenants of next, where the tenants of ts named as
+// tenants of next keep their usage and take their credentials and quota
+func (ts *Tenants) update(next *Tenants) *Tenants {
+	if ts == nil || next == nil {
+		return next
+	}
+	current := make(map[string]*Tenant, len(ts.tenants))
+	for _, t := range ts.tenants {
+		current[t.Name] = t
+	}
+	ret := &Tenants{keys: make(map[string]*Tenant, len(next.keys)), subjects: make(map[string]*Tenant, len(next.subjects))}
+	for _, t := range next.tenants {
+		if c, ok := current[t.Name]; ok {
+			c.update(t)
+			t = c
+		}
+		ret.tenants = append(ret.tenants, t)
+		for _, key := range t.Keys {
+			ret.keys[key] = t
+		}
+		for _, subject := range t.Subjects {
+			ret.subjects[subject] = t
+		}
+	}
+	return ret
+}
+
+// Authenticate returns the tenant key belongs to
+func (ts *Tenants) Authenticate(key string) (*Tenant, error) {
+	if t, ok := ts.keys[key]; ok && key != "" {
+		return t, nil
+	}
+	return nil, ErrUnauthorized
+}
+
+// AuthenticateSubject returns the tenant the client certificate with the
+// common name subject belongs to
+func (ts *Tenants) AuthenticateSubject(subject string) (*Tenant, error) {
+	if t, ok := ts.subjects[subject]; ok && subject != "" {
+		return t, nil
+	}
+	return nil, ErrUnauthorized
+}
+
+// Usage returns the usage of every tenant
+func (ts *Tenants) Usage() []TenantUsage {
+	ret := make([]TenantUsage, len(ts.tenants))
+	for i, t := range ts.tenants {
+		ret[i] = t.Usage()
+	}
+	return ret
+}
@@ -0,0 +1,154 @@
+package push_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+func tenantServer(t *testing.T, s push.Storage, tenants ...*push.Tenant) *httptest.Server {
+	ts, err := push.NewTenants(tenants...)
+	assert.Nil(t, err)
+	return httptest.NewServer(push.NewHTTPHandler(s, logf.New(), push.WithTenants(ts), push.WithAdminKey("admin")))
+}
+
+func TestTenants_invalid(t *testing.T) {
+	_, err := push.NewTenants(&push.Tenant{Name: "a/b"})
+	assert.NotNil(t, err)
+	_, err = push.NewTenants(&push.Tenant{Name: "a", Keys: []string{"k"}}, &push.Tenant{Name: "b", Keys: []string{"k"}})
+	assert.NotNil(t, err)
+}
+
+func TestTenant_scopeAndAuth(t *testing.T) {
+	s := push.NewMemoryStorage()
+	srv := tenantServer(t, s, &push.Tenant{Name: "scoped", Keys: []string{"key-a"}})
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL, APIKey: "key-a"}
+	assert.Nil(t, c.Push("orders", [][]byte{[]byte("a")}))
+	msgs, err := s.Get(context.Background(), "scoped/orders", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+	assert.NotNil(t, c.Push("other/orders", [][]byte{[]byte("a")}))
+	anonymous := &push.HTTPClient{Endpoint: srv.URL}
+	assert.True(t, errors.Is(anonymous.Push("orders", [][]byte{[]byte("a")}), push.ErrUnauthorized))
+	// the key is taken from the Bearer scheme only
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/orders/push", strings.NewReader(`{"body":["a"]}`))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "key-a")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var r push.Resp
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+	assert.Equal(t, "unauthorized", r.Code)
+}
+
+func TestTenant_quotas(t *testing.T) {
+	srv := tenantServer(t, push.NewMemoryStorage(), &push.Tenant{
+		Name: "quota",
+		Keys: []string{"key-q"},
+		Quota: push.Quota{
+			MaxTopics:      1,
+			MaxStoredBytes: 4,
+			MaxPublishRate: 100,
+			MaxSubscribers: 1,
+		},
+	})
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL, APIKey: "key-q"}
+	assert.Nil(t, c.Push("first", [][]byte{[]byte("abc")}))
+	assert.True(t, errors.Is(c.Push("second", [][]byte{[]byte("a")}), push.ErrQuotaExceeded))
+	assert.True(t, errors.Is(c.Push("first", [][]byte{[]byte("de")}), push.ErrQuotaExceeded))
+	assert.Nil(t, c.Push("first", [][]byte{[]byte("d")}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	subscribed := make(chan struct{})
+	go c.Subscribe(ctx, "first", "s1", func(msg push.SubMessage) int64 {
+		select {
+		case <-subscribed:
+		default:
+			close(subscribed)
+		}
+		return msg.NextOffset()
+	})
+	<-subscribed
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/first/subscribe?subscriber=s2", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer key-q")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	var r push.Resp
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+	resp.Body.Close()
+	assert.Equal(t, "quota.exceeded", r.Code)
+
+	req, err = http.NewRequest(http.MethodGet, srv.URL+"/_admin/tenants", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	usage := []push.TenantUsage{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&push.Resp{Data: &usage}))
+	assert.Equal(t, []push.TenantUsage{{
+		Tenant:      "quota",
+		Topics:      1,
+		StoredBytes: 4,
+		Subscribers: 1,
+		Quota:       push.Quota{MaxTopics: 1, MaxStoredBytes: 4, MaxPublishRate: 100, MaxSubscribers: 1},
+	}}, usage)
+}
+
+func TestTenant_publishRate(t *testing.T) {
+	tenant := &push.Tenant{Name: "rate", Quota: push.Quota{MaxPublishRate: 2}}
+	q := push.NewQueue("rate/events", push.NewMemoryStorage(), true, push.WithTenant(tenant))
+	ctx := context.Background()
+	assert.Nil(t, q.Add(ctx, []byte("a"), []byte("b")))
+	assert.True(t, errors.Is(q.Add(ctx, []byte("c")), push.ErrQuotaExceeded))
+}
+
+func TestTenant_reload(t *testing.T) {
+	s := push.NewMemoryStorage()
+	ts, err := push.NewTenants(&push.Tenant{Name: "reload", Keys: []string{"key-1"}, Quota: push.Quota{MaxStoredBytes: 4}})
+	assert.Nil(t, err)
+	h := push.NewHTTPHandler(s, logf.New(), push.WithTenants(ts))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL, APIKey: "key-1"}
+	assert.Nil(t, c.Push("orders", [][]byte{[]byte("abc")}))
+	assert.True(t, errors.Is(c.Push("orders", [][]byte{[]byte("de")}), push.ErrQuotaExceeded))
+
+	next, err := push.NewTenants(&push.Tenant{Name: "reload", Keys: []string{"key-2"}, Quota: push.Quota{MaxStoredBytes: 5}})
+	assert.Nil(t, err)
+	h.Reload(push.WithTenants(next), push.WithAdminKey("admin"))
+	assert.True(t, errors.Is(c.Push("orders", [][]byte{[]byte("a")}), push.ErrUnauthorized))
+	c.APIKey = "key-2"
+	// the stored bytes are kept across the reload
+	assert.Nil(t, c.Push("orders", [][]byte{[]byte("de")}))
+	assert.True(t, errors.Is(c.Push("orders", [][]byte{[]byte("f")}), push.ErrQuotaExceeded))
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/_admin/tenants", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var r struct {
+		Code string             `json:"code"`
+		Data []push.TenantUsage `json:"data"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+	assert.Equal(t, 1, len(r.Data))
+	assert.Equal(t, int64(5), r.Data[0].StoredBytes)
+	assert.Equal(t, int64(5), r.Data[0].Quota.MaxStoredBytes)
+}
@@ -0,0 +1,152 @@
+package push
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the files of a certificate are checked
+// for changes, at most
+const certCheckInterval = time.Second
+
+// TLSOptions sets up TLS from PEM files. The certificate is reloaded when
+// its files change, so that renewed certificates apply to new connections
+type TLSOptions struct {
+	// CertFile and KeyFile are the certificate of a server, or the
+	// certificate a client authenticates with
+	CertFile string
+	KeyFile  string
+	// CAFile holds the CAs verifying the certificates of the peers, the
+	// system CAs verify servers when it's empty
+	CAFile string
+	// ClientAuth is how a server verifies the certificates of clients
+	ClientAuth tls.ClientAuthType
+}
+
+// ServerConfig returns the TLS config of a server
+func (o TLSOptions) ServerConfig() (*tls.Config, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, errors.New("a server needs a certificate and its key")
+	}
+	cert, err := newCertFiles(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert.get(), nil },
+		ClientAuth:     o.ClientAuth,
+	}
+	if o.CAFile != "" {
+		if cfg.ClientCAs, err = loadCAs(o.CAFile); err != nil {
+			return nil, err
+		}
+	} else if o.ClientAuth >= tls.VerifyClientCertIfGiven {
+		return nil, errors.New("verifying client certificates needs a CA file")
+	}
+	return cfg, nil
+}
+
+// ClientConfig returns the TLS config of a client, which authenticates with
+// its certificate when there is one
+func (o TLSOptions) ClientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := newCertFiles(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert.get(), nil }
+	}
+	if o.CAFile != "" {
+		var err error
+		if cfg.RootCAs, err = loadCAs(o.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func loadCAs(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in CA file [%s]", file)
+	}
+	return pool, nil
+}
+
+// certFiles keeps the certificate of its files, reloading it when they
+// change. A certificate failing to load keeps the previous one in use
+type certFiles struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	checked  time.Time
+}
+
+func newCertFiles(certFile, keyFile string) (*certFiles, error) {
+	c := &certFiles{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certFiles) load() error {
+	var modTimes [2]time.Time
+	for i, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("load certificate: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modTimes = modTimes
+	c.checked = time.Now()
+	return nil
+}
+
+// get returns the certificate, reloaded first when its files changed
+func (c *certFiles) get() *tls.Certificate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert
+	}
+	c.checked = time.Now()
+	for i, file := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(c.modTimes[i]) {
+			// a certificate failing to load, as one half written, is
+			// loaded again at the next check
+			c.load()
+			break
+		}
+	}
+	return c.cert
+}
+
+// certSubject returns the common name of the subject of the verified
+// certificate of the client of req, empty when there's none
+func certSubject(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,140 @@
+package push_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, ca.path("ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// issue writes a certificate of name signed by the CA, with its key, and
+// returns the paths of the files
+func (ca *testCA) issue(t *testing.T, name string, serial int64, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	certFile, keyFile = ca.path(name+".pem"), ca.path(name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	assert.Nil(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+}
+
+func tlsServer(t *testing.T, h http.Handler, opts push.TLSOptions) string {
+	cfg, err := opts.ServerConfig()
+	assert.Nil(t, err)
+	srv := httptest.NewUnstartedServer(h)
+	srv.Listener = tls.NewListener(srv.Listener, cfg)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return "https://" + srv.Listener.Addr().String()
+}
+
+func TestTLS_clientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server", 2, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "team-cert", 3, x509.ExtKeyUsageClientAuth)
+	ts, err := push.NewTenants(&push.Tenant{Name: "cert", Subjects: []string{"team-cert"}})
+	assert.Nil(t, err)
+	endpoint := tlsServer(t, push.NewHTTPHandler(push.NewMemoryStorage(), logf.New(), push.WithTenants(ts)), push.TLSOptions{
+		CertFile:   serverCert,
+		KeyFile:    serverKey,
+		CAFile:     ca.path("ca.pem"),
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	})
+
+	c := &push.HTTPClient{Endpoint: endpoint, TLS: &push.TLSOptions{CAFile: ca.path("ca.pem"), CertFile: clientCert, KeyFile: clientKey}}
+	assert.Nil(t, c.Push("orders", [][]byte{[]byte("a")}))
+	meta, err := c.Meta(context.Background(), "orders")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, meta.Partitions)
+
+	anonymous := &push.HTTPClient{Endpoint: endpoint, TLS: &push.TLSOptions{CAFile: ca.path("ca.pem")}}
+	assert.True(t, errors.Is(anonymous.Push("orders", [][]byte{[]byte("a")}), push.ErrUnauthorized))
+	untrusted := &push.HTTPClient{Endpoint: endpoint}
+	assert.NotNil(t, untrusted.Push("orders", [][]byte{[]byte("a")}))
+}
+
+func TestTLS_certificateReload(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server", 2, x509.ExtKeyUsageServerAuth)
+	endpoint := tlsServer(t, push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()), push.TLSOptions{CertFile: certFile, KeyFile: keyFile})
+	serial := func() int64 {
+		cfg, err := push.TLSOptions{CAFile: ca.path("ca.pem")}.ClientConfig()
+		assert.Nil(t, err)
+		conn, err := tls.Dial("tcp", endpoint[len("https://"):], cfg)
+		assert.Nil(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(2), serial())
+	ca.issue(t, "server", 3, x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, later, later))
+	assert.Nil(t, os.Chtimes(keyFile, later, later))
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, int64(3), serial())
+}
@@ -0,0 +1,268 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	topics     = make(map[registryKey]*Topic)
+	partitions = make(map[string]int)
+	topicLock  sync.RWMutex
+)
+
+// Topic spreads its messages over partitions, each of them backed by its
+// own queue and storage stream. Messages of the same key always go to the
+// same partition, so their order is kept
+type Topic struct {
+	name       string
+	partitions []*Queue
+	next       atomic.Uint32
+}
+
+// DeclareTopic sets the number of partitions of a topic, undeclared topics
+// have a single partition. A topic can't be redeclared with another number
+// of partitions once it's in use
+func DeclareTopic(name string, n int) error {
+	if err := validateTopicName(name); err != nil {
+		return err
+	}
+	if n < 1 {
+		return fmt.Errorf("invalid partitions [%d] of topic [%s]", n, name)
+	}
+	topicLock.Lock()
+	defer topicLock.Unlock()
+	for key, t := range topics {
+		if key.name == name && len(t.partitions) != n {
+			return fmt.Errorf("topic [%s] is in use with %d partitions", name, len(t.partitions))
+		}
+	}
+	partitions[name] = n
+	return nil
+}
+
+// PartitionName returns the name of the storage stream backing partition p
+// of a topic with n partitions. A single partition topic is stored under
+// its own name
+func PartitionName(topic string, p, n int) string {
+	if n <= 1 {
+		return topic
+	}
+	return fmt.Sprintf("%s%s%d", topic, partitionSeparator, p)
+}
+
+// TopicPartitions returns the number of partitions of a topic. Topics in
+// use keep the number they were declared with, as it can't change since
+func TopicPartitions(name string) int {
+	topicLock.RLock()
+	defer topicLock.RUnlock()
+	if n, ok := partitions[name]; ok {
+		return n
+	}
+	return 1
+}
+
+func lookupTopic(name string, storage Storage) (*Topic, bool) {
+	topicLock.RLock()
+	defer topicLock.RUnlock()
+	t, ok := topics[registryKey{storage: storage, name: name}]
+	return t, ok
+}
+
+// GetTopic returns the topic of name in storage, creating its partition
+// queues on the first call of the storage. Like GetQueue, later calls get
+// the topic as the first one set it. It fails when name breaks the topic
+// naming policy
+func GetTopic(name string, storage Storage, autoCreate bool, opts ...QueueOption) (*Topic, error) {
+	key := registryKey{storage: storage, name: name}
+	topicLock.RLock()
+	if t, ok := topics[key]; ok {
+		topicLock.RUnlock()
+		return t, nil
+	}
+	topicLock.RUnlock()
+	if err := validateTopicName(name); err != nil {
+		return nil, err
+	}
+	topicLock.Lock()
+	defer topicLock.Unlock()
+	if t, ok := topics[key]; ok {
+		return t, nil
+	}
+	n := partitions[name]
+	if n < 1 {
+		n = 1
+	}
+	t := &Topic{name: name, partitions: make([]*Queue, n)}
+	for i := range t.partitions {
+		q, err := GetQueue(PartitionName(name, i, n), storage, autoCreate, opts...)
+		if err != nil {
+			return nil, err
+		}
+		t.partitions[i] = q
+	}
+	topics[key] = t
+	return t, nil
+}
+
+func (t *Topic) Name() string {
+	return t.name
+}
+
+func (t *Topic) Partitions() int {
+	return len(t.partitions)
+}
+
+func (t *Topic) Queue(partition int) (*Queue, error) {
+	if partition < 0 || partition >= len(t.partitions) {
+		return nil, fmt.Errorf("topic [%s] has no partition [%d]", t.name, partition)
+	}
+	return t.partitions[partition], nil
+}
+
+// Partition returns the partition a message of key goes to, keyless
+// messages are spread round robin
+func (t *Topic) Partition(key string) int {
+	n := uint32(len(t.partitions))
+	if n == 1 {
+		return 0
+	}
+	if key == "" {
+		return int((t.next.Add(1) - 1) % n)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % n)
+}
+
+func (t *Topic) Add(ctx context.Context, data ...[]byte) error {
+	return t.AddMessages(ctx, messages(data)...)
+}
+
+// AddMessages routes msgs to their partitions. Messages are added to each
+// partition in the given order, but not atomically across partitions
+func (t *Topic) AddMessages(ctx context.Context, msgs ...*Message) error {
+	_, err := t.addMessages(ctx, msgs, nil)
+	return err
+}
+
+// addMessages adds msgs like AddMessages, it returns the partition each
+// message went to. The messages of the partitions in added were added
+// already, they take the offsets kept there instead of being added again.
+// The offsets of each partition added are kept in added, when not nil, so
+// that adding a batch failing halfway again completes it
+func (t *Topic) addMessages(ctx context.Context, msgs []*Message, added map[int][]int64) ([]int, error) {
+	partitions := make([]int, len(msgs))
+	routed := make(map[int][]*Message)
+	for i, m := range msgs {
+		p := 0
+		if len(t.partitions) > 1 {
+			p = t.Partition(m.Key)
+		}
+		partitions[i] = p
+		routed[p] = append(routed[p], m)
+	}
+	ps := make([]int, 0, len(routed))
+	for p := range routed {
+		ps = append(ps, p)
+	}
+	sort.Ints(ps)
+	for _, p := range ps {
+		ms := routed[p]
+		if offsets, ok := added[p]; ok && len(offsets) == len(ms) {
+			for i, m := range ms {
+				m.Offset = offsets[i]
+			}
+			continue
+		}
+		if err := t.partitions[p].AddMessages(ctx, ms...); err != nil {
+			if len(t.partitions) == 1 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("partition [%d]: %w", p, err)
+		}
+		if added != nil {
+			offsets := make([]int64, len(ms))
+			for i, m := range ms {
+				offsets[i] = m.Offset
+			}
+			added[p] = offsets
+		}
+	}
+	return partitions, nil
+}
+
+func (t *Topic) Unsubscribe(name string) {
+	for _, q := range t.partitions {
+		q.Unsubscribe(name)
+	}
+}
+
+// Subscribe subscribes the partitions given as keys of offsets, each from
+// its offset. consume is never called concurrently. Subscribe returns once
+// every partition subscription ended, the first error ends all of them
+func (t *Topic) Subscribe(
+	ctx context.Context,
+	name string,
+	offsets map[int]int64,
+	batchSize int,
+	consume func(partition int, msgs []*Message) error,
+) error {
+	if len(offsets) == 0 {
+		return fmt.Errorf("no partition of topic [%s] to subscribe", t.name)
+	}
+	ps := make([]int, 0, len(offsets))
+	for p := range offsets {
+		if _, err := t.Queue(p); err != nil {
+			return err
+		}
+		ps = append(ps, p)
+	}
+	sort.Ints(ps)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		once sync.Once
+		ret  error
+	)
+	// the first partition subscription to end, for whatever reason, ends
+	// all of them
+	stop := func(err error) {
+		once.Do(func() {
+			ret = err
+			cancel()
+		})
+	}
+	for _, p := range ps {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			err := t.partitions[p].Subscribe(ctx, name, offsets[p], batchSize, func(msgs []*Message) error {
+				lock.Lock()
+				defer lock.Unlock()
+				return consume(p, msgs)
+			})
+			if err != nil {
+				err = fmt.Errorf("partition [%d]: %w", p, err)
+			}
+			stop(err)
+		}(p)
+	}
+	wg.Wait()
+	return ret
+}
+
+// AllPartitions returns offsets of every partition of t set to offset
+func (t *Topic) AllPartitions(offset int64) map[int]int64 {
+	ret := make(map[int]int64, len(t.partitions))
+	for i := range t.partitions {
+		ret[i] = offset
+	}
+	return ret
+}
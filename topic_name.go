@@ -0,0 +1,99 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// MaxTopicNameLength keeps the table of the last partition of a topic,
+	// q_<topic>__p<n>, within the identifier length of mysql and postgres
+	MaxTopicNameLength = 48
+	// NamespaceSeparator separates the tenant from the topic, as in tenant/topic
+	NamespaceSeparator = "/"
+	// partitionSeparator separates a topic from the partition of its queues
+	partitionSeparator = "__p"
+)
+
+var (
+	ErrInvalidTopicName = errors.New("invalid topic name")
+	// ReservedTopicPrefixes are the prefixes of the topics owned by the
+	// broker, users can't push to or subscribe them. The broker names its
+	// topics _sys-, as dots aren't allowed in topic names, and _sys. stays
+	// reserved for the names given with a dot
+	ReservedTopicPrefixes = []string{"_sys-", "_sys."}
+)
+
+// SplitTopic returns the tenant and the topic of a namespaced name, the
+// tenant of a name without namespace is empty
+func SplitTopic(name string) (tenant, topic string) {
+	if i := strings.Index(name, NamespaceSeparator); i >= 0 {
+		return name[:i], name[i+len(NamespaceSeparator):]
+	}
+	return "", name
+}
+
+// ValidateTopicName checks a topic name given by users against the naming
+// policy: an optional tenant and a topic, made of letters, digits, '_' and
+// '-', without reserved prefixes and at most MaxTopicNameLength long. Dots
+// aren't allowed as db tables named after topics would read as schema.table
+func ValidateTopicName(name string) error {
+	tenant, topic := SplitTopic(name)
+	for _, prefix := range ReservedTopicPrefixes {
+		if strings.HasPrefix(tenant, prefix) || strings.HasPrefix(topic, prefix) {
+			return fmt.Errorf("%w [%s]: prefix [%s] is reserved", ErrInvalidTopicName, name, prefix)
+		}
+	}
+	return validateTopicName(name)
+}
+
+// ValidateDeclaredTopicName checks the name of a topic declared by the
+// operator of the broker, which may use the reserved prefixes
+func ValidateDeclaredTopicName(name string) error {
+	return validateTopicName(name)
+}
+
+// validateTopicName checks name against the naming policy, but allows the
+// reserved prefixes the broker uses for its own topics
+func validateTopicName(name string) error {
+	if len(name) > MaxTopicNameLength {
+		return fmt.Errorf("%w [%s]: longer than %d", ErrInvalidTopicName, name, MaxTopicNameLength)
+	}
+	tenant, topic := SplitTopic(name)
+	if tenant == "" && topic != name {
+		return fmt.Errorf("%w [%s]: empty tenant", ErrInvalidTopicName, name)
+	}
+	for _, part := range []string{tenant, topic} {
+		if strings.Contains(part, "__") {
+			return fmt.Errorf("%w [%s]: '__' is reserved for partitions", ErrInvalidTopicName, name)
+		}
+		for _, c := range part {
+			if !validTopicChar(c) {
+				return fmt.Errorf("%w [%s]: invalid character %q", ErrInvalidTopicName, name, c)
+			}
+		}
+	}
+	if topic == "" {
+		return fmt.Errorf("%w [%s]: empty topic", ErrInvalidTopicName, name)
+	}
+	return nil
+}
+
+// validateQueueName checks the name of a queue, which is the name of a topic
+// possibly followed by the partition of the queue
+func validateQueueName(name string) error {
+	if i := strings.LastIndex(name, partitionSeparator); i > 0 {
+		if p := name[i+len(partitionSeparator):]; p != "" && strings.Trim(p, "0123456789") == "" {
+			name = name[:i]
+		}
+	}
+	return validateTopicName(name)
+}
+
+func validTopicChar(c rune) bool {
+	return c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' ||
+		c == '_' || c == '-'
+}
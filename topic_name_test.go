@@ -0,0 +1,68 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+func TestValidateTopicName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"orders":                true,
+		"orders-v2_eu-west":     true,
+		"orders.v2":             false,
+		"team-a/orders":         true,
+		"":                      false,
+		"team-a/":               false,
+		"/orders":               false,
+		"a/b/c":                 false,
+		"orders;drop":           false,
+		"or ders":               false,
+		"orders__p1":            false,
+		"_sys-expired":          false,
+		"team-a/_sys-expired":   false,
+		"_sys.expired":          false,
+		"team-a/_sys.expired":   false,
+		strings.Repeat("a", 49): false,
+		strings.Repeat("a", 48): true,
+	} {
+		err := push.ValidateTopicName(name)
+		if valid {
+			assert.Nil(t, err, name)
+		} else {
+			assert.True(t, errors.Is(err, push.ErrInvalidTopicName), name)
+		}
+	}
+	// both spellings of the prefix of the broker are reserved
+	err := push.ValidateTopicName("_sys.expired")
+	assert.Contains(t, err.Error(), "prefix [_sys.] is reserved")
+}
+
+func TestGetQueue_invalidName(t *testing.T) {
+	_, err := push.GetQueue("orders;drop", push.NewMemoryStorage(), true)
+	assert.True(t, errors.Is(err, push.ErrInvalidTopicName))
+	// the broker may use reserved topics and partition queues
+	_, err = push.GetQueue("_sys-expired", push.NewMemoryStorage(), true)
+	assert.Nil(t, err)
+	_, err = push.GetQueue("team-a/orders__p3", push.NewMemoryStorage(), true)
+	assert.Nil(t, err)
+}
+
+func TestGetQueue_namesOfDBTables(t *testing.T) {
+	s := sqliteStorage(t)
+	ctx := context.Background()
+	// the reserved topics of the broker are kept in tables as other topics
+	q, err := push.GetQueue("_sys-expired", s, true)
+	assert.Nil(t, err)
+	assert.Nil(t, q.Add(ctx, []byte("x")))
+	msgs, err := s.Get(ctx, "_sys-expired", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+	// a dotted name would read as schema.table
+	_, err = push.GetQueue("orders.created", s, true)
+	assert.True(t, errors.Is(err, push.ErrInvalidTopicName))
+}
@@ -0,0 +1,110 @@
+package push_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+func TestTopic_partitions(t *testing.T) {
+	assert.Nil(t, push.DeclareTopic("orders", 4))
+	s := push.NewMemoryStorage()
+	topic, err := push.GetTopic("orders", s, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, topic.Partitions())
+	assert.NotNil(t, push.DeclareTopic("orders", 2))
+	ctx := context.Background()
+	msgs := []*push.Message{}
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, push.NewMessage([]byte(fmt.Sprintf("%d", i))).WithKey(fmt.Sprintf("key-%d", i%5)))
+	}
+	assert.Nil(t, topic.AddMessages(ctx, msgs...))
+	// messages of a key are in a single partition, in the order they were added
+	for i := 0; i < 5; i++ {
+		p := topic.Partition(fmt.Sprintf("key-%d", i))
+		stored, err := s.Get(ctx, push.PartitionName("orders", p, 4), 0, 100)
+		assert.Nil(t, err)
+		data := []string{}
+		for _, m := range stored {
+			if m.Key == fmt.Sprintf("key-%d", i) {
+				data = append(data, string(m.Data))
+			}
+		}
+		assert.Equal(t, []string{
+			fmt.Sprintf("%d", i),
+			fmt.Sprintf("%d", i+5),
+			fmt.Sprintf("%d", i+10),
+			fmt.Sprintf("%d", i+15),
+		}, data)
+	}
+	var (
+		lock     sync.Mutex
+		received int
+	)
+	err = topic.Subscribe(ctx, "s", topic.AllPartitions(0), 10, func(partition int, msgs []*push.Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+		received += len(msgs)
+		if received == 20 {
+			topic.Unsubscribe("s")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 20, received)
+}
+
+func TestTopic_roundRobin(t *testing.T) {
+	assert.Nil(t, push.DeclareTopic("logs", 3))
+	topic, err := push.GetTopic("logs", push.NewMemoryStorage(), true)
+	assert.Nil(t, err)
+	ps := []int{}
+	for i := 0; i < 6; i++ {
+		ps = append(ps, topic.Partition(""))
+	}
+	assert.Equal(t, []int{0, 1, 2, 0, 1, 2}, ps)
+}
+
+func TestTopic_subscribePartition(t *testing.T) {
+	assert.Nil(t, push.DeclareTopic("events", 2))
+	s := push.NewMemoryStorage()
+	topic, err := push.GetTopic("events", s, true)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	assert.Nil(t, topic.Add(ctx, []byte("0"), []byte("1"), []byte("2"), []byte("3")))
+	partitions := map[int]bool{}
+	err = topic.Subscribe(ctx, "s", map[int]int64{1: 1}, 10, func(partition int, msgs []*push.Message) error {
+		partitions[partition] = true
+		assert.Equal(t, int64(1), msgs[0].Offset)
+		topic.Unsubscribe("s")
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]bool{1: true}, partitions)
+	assert.NotNil(t, topic.Subscribe(ctx, "s", map[int]int64{2: 0}, 10, nil))
+}
+
+func TestGetTopic_perStorage(t *testing.T) {
+	ctx := context.Background()
+	a, b := push.NewMemoryStorage(), push.NewMemoryStorage()
+	ta, err := push.GetTopic("per-storage", a, true)
+	assert.Nil(t, err)
+	tb, err := push.GetTopic("per-storage", b, true)
+	assert.Nil(t, err)
+	assert.Nil(t, ta.Add(ctx, []byte("a")))
+	assert.Nil(t, tb.Add(ctx, []byte("b")))
+	// each storage keeps the messages added to its own topic
+	for s, data := range map[push.Storage]string{a: "a", b: "b"} {
+		msgs, err := s.Get(ctx, "per-storage", 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(msgs))
+		assert.Equal(t, data, string(msgs[0].Data))
+	}
+	again, err := push.GetTopic("per-storage", a, true)
+	assert.Nil(t, err)
+	assert.True(t, again == ta)
+}
@@ -0,0 +1,182 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUndecodable is the error of a message of a typed topic failing to be
+// decoded, subscriptions don't retry it
+var ErrUndecodable = errors.New("message not decodable")
+
+// Transport carries the messages of typed topics
+type Transport interface {
+	Publish(ctx context.Context, topic string, msgs []PushMessage) error
+	// Subscribe handles the messages of topic as subscriber until ctx is
+	// done or handling fails as the transport doesn't retry
+	Subscribe(ctx context.Context, topic, subscriber string, handle MessageHandler) error
+}
+
+type httpTransport struct {
+	client *HTTPClient
+	opts   []SubscribeOption
+}
+
+// HTTPTransport carries messages with c, subscribing with opts. A batch
+// published is pushed once however often it's retried, and subscriptions
+// retry handling as SubscribeMessages does
+func HTTPTransport(c *HTTPClient, opts ...SubscribeOption) Transport {
+	return &httpTransport{client: c, opts: opts}
+}
+
+func (t *httpTransport) Publish(ctx context.Context, topic string, msgs []PushMessage) error {
+	_, err := t.client.PushBatch(ctx, topic, newBatchID(), msgs)
+	return err
+}
+
+func (t *httpTransport) Subscribe(ctx context.Context, topic, subscriber string, handle MessageHandler) error {
+	return t.client.SubscribeMessages(ctx, topic, subscriber, handle, t.opts...)
+}
+
+// Meta is what a message of a TypedTopic carries beside its value
+type Meta struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       string
+	// Timestamp is when the message was published
+	Timestamp time.Time
+	Headers   map[string]string
+}
+
+// Keyed is implemented by the values of typed topics published with a key
+type Keyed interface {
+	MessageKey() string
+}
+
+type headersKey struct{}
+
+// WithHeaders returns a context publishing the messages of typed topics
+// with headers
+func WithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// envelope is the message of a value of a typed topic. The value is Data
+// when it's encoded as JSON, Bytes otherwise
+type envelope struct {
+	ContentType string            `json:"content_type"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Data        json.RawMessage   `json:"data,omitempty"`
+	Bytes       []byte            `json:"bytes,omitempty"`
+}
+
+// TypedTopic publishes and subscribes to the values of T of a topic,
+// encoded by its codec
+type TypedTopic[T any] struct {
+	transport  Transport
+	topic      string
+	codec      Codec
+	subscriber string
+}
+
+type TypedOption func(o *typedOptions)
+
+type typedOptions struct {
+	codec      Codec
+	subscriber string
+}
+
+// TypedCodec sets the codec of the values of the topic, JSONCodec by
+// default
+func TypedCodec(c Codec) TypedOption {
+	return func(o *typedOptions) {
+		o.codec = c
+	}
+}
+
+// TypedSubscriber sets the subscriber the topic is subscribed to as
+func TypedSubscriber(name string) TypedOption {
+	return func(o *typedOptions) {
+		o.subscriber = name
+	}
+}
+
+func NewTypedTopic[T any](transport Transport, topic string, opts ...TypedOption) *TypedTopic[T] {
+	o := typedOptions{codec: JSONCodec}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &TypedTopic[T]{transport: transport, topic: topic, codec: o.codec, subscriber: o.subscriber}
+}
+
+// Publish publishes values as a batch, with the headers of ctx. Values
+// implementing Keyed are published with their key
+func (t *TypedTopic[T]) Publish(ctx context.Context, values ...T) error {
+	if len(values) == 0 {
+		return nil
+	}
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	now := time.Now()
+	msgs := make([]PushMessage, len(values))
+	for i, v := range values {
+		data, err := t.codec.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("typed topic [%s]: encode: %w", t.topic, err)
+		}
+		e := envelope{ContentType: t.codec.ContentType(), Timestamp: now, Headers: headers}
+		if e.ContentType == contentTypeJSON {
+			e.Data = data
+		} else {
+			e.Bytes = data
+		}
+		body, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("typed topic [%s]: encode: %w", t.topic, err)
+		}
+		msgs[i].Data = string(body)
+		if k, ok := any(v).(Keyed); ok {
+			msgs[i].Key = k.MessageKey()
+		}
+	}
+	return t.transport.Publish(ctx, t.topic, msgs)
+}
+
+// Subscribe handles the values of the topic until ctx is done or handling
+// fails as the transport doesn't retry. A message failing to be decoded
+// fails with ErrUndecodable, which isn't retried unless the Permanent of
+// the Reconnect of the transport says otherwise
+func (t *TypedTopic[T]) Subscribe(ctx context.Context, handle func(ctx context.Context, v T, meta Meta) error) error {
+	if t.subscriber == "" {
+		return errors.New("typed topic: no subscriber")
+	}
+	return t.transport.Subscribe(ctx, t.topic, t.subscriber, func(msg ReceivedMessage) error {
+		var e envelope
+		if err := json.Unmarshal([]byte(msg.Data), &e); err != nil {
+			return fmt.Errorf("typed topic [%s]: message at %d: %w: %s", t.topic, msg.Offset, ErrUndecodable, err.Error())
+		}
+		if e.ContentType != t.codec.ContentType() {
+			return fmt.Errorf("typed topic [%s]: message at %d is %s, not %s: %w", t.topic, msg.Offset, e.ContentType, t.codec.ContentType(), ErrUndecodable)
+		}
+		data := []byte(e.Data)
+		if e.ContentType != contentTypeJSON {
+			data = e.Bytes
+		}
+		var v T
+		if err := t.codec.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("typed topic [%s]: message at %d: %w: %s", t.topic, msg.Offset, ErrUndecodable, err.Error())
+		}
+		return handle(ctx, v, Meta{
+			Topic:     t.topic,
+			Partition: msg.Partition,
+			Offset:    msg.Offset,
+			Key:       msg.Key,
+			Timestamp: e.Timestamp,
+			Headers:   e.Headers,
+		})
+	})
+}
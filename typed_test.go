@@ -0,0 +1,106 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type typedOrder struct {
+	ID     int64
+	Amount int
+}
+
+func (o typedOrder) MessageKey() string {
+	return fmt.Sprint(o.ID)
+}
+
+// receive subscribes to topic until n values are handled
+func receive[T any](t *testing.T, topic *push.TypedTopic[T], n int) ([]T, []push.Meta) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var (
+		values []T
+		metas  []push.Meta
+	)
+	err := topic.Subscribe(ctx, func(_ context.Context, v T, meta push.Meta) error {
+		values = append(values, v)
+		metas = append(metas, meta)
+		if len(values) == n {
+			cancel()
+		}
+		return nil
+	})
+	assert.True(t, errors.Is(err, context.Canceled))
+	return values, metas
+}
+
+func TestTypedTopic_codecs(t *testing.T) {
+	for _, codec := range []push.Codec{push.JSONCodec, push.GobCodec, push.MsgpackCodec} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			topic := push.NewTypedTopic[typedOrder](push.NewMemoryTransport(), "typed-orders", push.TypedCodec(codec), push.TypedSubscriber("s"))
+			ctx := push.WithHeaders(context.Background(), map[string]string{"trace": "t1"})
+			before := time.Now()
+			assert.Nil(t, topic.Publish(ctx, typedOrder{ID: 1, Amount: 10}, typedOrder{ID: 2, Amount: 20}))
+			values, metas := receive(t, topic, 2)
+			assert.Equal(t, []typedOrder{{ID: 1, Amount: 10}, {ID: 2, Amount: 20}}, values)
+			assert.Equal(t, int64(1), metas[1].Offset)
+			assert.Equal(t, "2", metas[1].Key)
+			assert.Equal(t, "typed-orders", metas[1].Topic)
+			assert.Equal(t, map[string]string{"trace": "t1"}, metas[1].Headers)
+			assert.False(t, metas[1].Timestamp.Before(before.Truncate(time.Second)))
+		})
+	}
+}
+
+func TestTypedTopic_http(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	transport := push.HTTPTransport(&push.HTTPClient{Endpoint: srv.URL})
+
+	orders := push.NewTypedTopic[typedOrder](transport, "typed-http-orders", push.TypedSubscriber("s"))
+	assert.Nil(t, orders.Publish(context.Background(), typedOrder{ID: 1, Amount: 10}))
+	values, metas := receive(t, orders, 1)
+	assert.Equal(t, []typedOrder{{ID: 1, Amount: 10}}, values)
+	assert.Equal(t, "1", metas[0].Key)
+
+	names := push.NewTypedTopic[*wrapperspb.StringValue](transport, "typed-http-names", push.TypedCodec(push.ProtobufCodec), push.TypedSubscriber("s"))
+	assert.Nil(t, names.Publish(context.Background(), wrapperspb.String("a"), wrapperspb.String("b")))
+	protos, _ := receive(t, names, 2)
+	assert.Equal(t, 2, len(protos))
+	assert.Equal(t, "a", protos[0].GetValue())
+	assert.Equal(t, "b", protos[1].GetValue())
+
+	// a message of another codec isn't decoded
+	gobs := push.NewTypedTopic[typedOrder](transport, "typed-http-orders", push.TypedCodec(push.GobCodec), push.TypedSubscriber("other"))
+	err := gobs.Subscribe(context.Background(), func(context.Context, typedOrder, push.Meta) error {
+		return nil
+	})
+	assert.True(t, errors.Is(err, push.ErrUndecodable))
+}
+
+func TestTypedTopic_handleFails(t *testing.T) {
+	topic := push.NewTypedTopic[int](push.NewMemoryTransport(), "typed-failing", push.TypedSubscriber("s"))
+	assert.Nil(t, topic.Publish(context.Background(), 1, 2))
+	failed := errors.New("failed")
+	err := topic.Subscribe(context.Background(), func(_ context.Context, v int, _ push.Meta) error {
+		if v == 2 {
+			return failed
+		}
+		return nil
+	})
+	assert.True(t, errors.Is(err, failed))
+	// the value failing is handled again
+	values, _ := receive(t, topic, 1)
+	assert.Equal(t, []int{2}, values)
+
+	assert.NotNil(t, push.NewTypedTopic[int](push.NewMemoryTransport(), "typed-failing").Subscribe(context.Background(), nil))
+}
@@ -0,0 +1,196 @@
+package push
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+	"sync"
+)
+
+// ReceivedMessage is a message of a SubMessage
+type ReceivedMessage struct {
+	Partition int
+	Offset    int64
+	Key       string
+	Data      string
+}
+
+// MessageHandler handles a message of SubscribeMessages
+type MessageHandler func(msg ReceivedMessage) error
+
+// SubscribeWorkers handles the messages of SubscribeMessages with n
+// goroutines. Messages with the same key are handled in order by the same
+// goroutine when byKey is true, others are handled in any order
+func SubscribeWorkers(n int, byKey bool) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.workers = n
+		o.byKey = byKey
+	}
+}
+
+// workerPool handles the messages of a stream with its workers, committing
+// the offsets of each partition up to the first message not handled yet
+type workerPool struct {
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	handler MessageHandler
+	// queues are the queues of the workers when they are by key, or the
+	// single queue they share
+	queues  []chan ReceivedMessage
+	offsets *committer
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	pending map[int]*pendingOffsets
+	err     error
+}
+
+func newWorkerPool(ctx context.Context, cancel context.CancelCauseFunc, n int, byKey bool, handle MessageHandler, offsets *committer) *workerPool {
+	if n < 1 {
+		n = 1
+	}
+	p := &workerPool{
+		ctx:     ctx,
+		cancel:  cancel,
+		handler: handle,
+		offsets: offsets,
+		pending: make(map[int]*pendingOffsets),
+	}
+	if byKey {
+		for i := 0; i < n; i++ {
+			p.queues = append(p.queues, make(chan ReceivedMessage, 1))
+		}
+	} else {
+		p.queues = []chan ReceivedMessage{make(chan ReceivedMessage, n)}
+	}
+	for i := 0; i < n; i++ {
+		q := p.queues[i%len(p.queues)]
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for msg := range q {
+				p.run(msg)
+			}
+		}()
+	}
+	return p
+}
+
+// handle queues the messages of msg, waiting for the workers to take them
+func (p *workerPool) handle(msg SubMessage, done func()) {
+	msgs := msg.Messages()
+	if len(msgs) == 0 {
+		done()
+		return
+	}
+	p.lock.Lock()
+	pending, ok := p.pending[msg.Partition]
+	if !ok {
+		pending = &pendingOffsets{done: make(map[int64]bool)}
+		p.pending[msg.Partition] = pending
+	}
+	pending.batches = append(pending.batches, pendingBatch{last: msgs[len(msgs)-1].Offset, done: done})
+	for _, m := range msgs {
+		pending.offsets = append(pending.offsets, m.Offset)
+	}
+	p.lock.Unlock()
+	for _, m := range msgs {
+		select {
+		case p.queue(m) <- m:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// queue returns the queue of the worker handling m
+func (p *workerPool) queue(m ReceivedMessage) chan ReceivedMessage {
+	if len(p.queues) == 1 {
+		return p.queues[0]
+	}
+	// messages without key are spread over the workers
+	if m.Key == "" {
+		return p.queues[int(m.Offset%int64(len(p.queues)))]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(m.Partition) + "/" + m.Key))
+	return p.queues[int(h.Sum32()%uint32(len(p.queues)))]
+}
+
+func (p *workerPool) run(m ReceivedMessage) {
+	// the messages queued once a handler failed, or the subscription is
+	// done, are left for the next stream
+	if p.ctx.Err() != nil {
+		return
+	}
+	if err := p.handler(m); err != nil {
+		p.lock.Lock()
+		if p.err == nil {
+			p.err = handleError{err: err}
+		}
+		p.lock.Unlock()
+		p.cancel(err)
+		return
+	}
+	p.lock.Lock()
+	pending := p.pending[m.Partition]
+	next, ok := pending.complete(m.Offset)
+	var done []func()
+	if ok {
+		// recording under the lock keeps the commits of a partition in
+		// order, storing them is left out of it
+		p.offsets.record(m.Partition, next)
+		done = pending.release(next)
+	}
+	p.lock.Unlock()
+	if ok {
+		p.offsets.persist(m.Partition)
+	}
+	for _, d := range done {
+		d()
+	}
+}
+
+func (p *workerPool) wait() error {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+	return p.err
+}
+
+// pendingOffsets are the offsets of the messages of a partition queued and
+// not committed yet
+type pendingOffsets struct {
+	// offsets are in the order of the messages
+	offsets []int64
+	done    map[int64]bool
+	batches []pendingBatch
+}
+
+// pendingBatch is a batch of a partition not committed yet
+type pendingBatch struct {
+	last int64
+	done func()
+}
+
+// release returns the done of the batches committed with next
+func (p *pendingOffsets) release(next int64) []func() {
+	var done []func()
+	for len(p.batches) > 0 && p.batches[0].last < next {
+		done = append(done, p.batches[0].done)
+		p.batches = p.batches[1:]
+	}
+	return done
+}
+
+// complete marks offset handled, it returns the offset to commit when the
+// messages before it are all handled
+func (p *pendingOffsets) complete(offset int64) (next int64, ok bool) {
+	p.done[offset] = true
+	for len(p.offsets) > 0 && p.done[p.offsets[0]] {
+		delete(p.done, p.offsets[0])
+		next, ok = p.offsets[0]+1, true
+		p.offsets = p.offsets[1:]
+	}
+	return
+}
@@ -0,0 +1,177 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dev-mockingbird/logf"
+	"github.com/tj/assert"
+	"github.com/yang-zzhong/go-push"
+)
+
+// waitOffset waits for the offset of topic committed by subscriber to be want
+func waitOffset(t *testing.T, c *push.HTTPClient, topic, subscriber string, want int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	var offset int64
+	for time.Now().Before(deadline) {
+		assert.Nil(t, c.OffsetStorage.GetOffset(context.Background(), topic, subscriber, &offset))
+		if offset == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("offset of [%s] is %d, want %d", topic, offset, want)
+}
+
+func TestHTTPClient_workersByKey(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	var msgs []push.PushMessage
+	for i := 0; i < 40; i++ {
+		msgs = append(msgs, push.PushMessage{Data: fmt.Sprint(i), Key: fmt.Sprintf("k%d", i%4)})
+	}
+	assert.Nil(t, c.PushMessages("workers-keyed", msgs))
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		lock    sync.Mutex
+		handled = make(map[string][]int64)
+		running int
+		most    int
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.SubscribeMessages(ctx, "workers-keyed", "s", func(msg push.ReceivedMessage) error {
+			lock.Lock()
+			handled[msg.Key] = append(handled[msg.Key], msg.Offset)
+			if running++; running > most {
+				most = running
+			}
+			lock.Unlock()
+			time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return nil
+		}, push.SubscribeWorkers(4, true))
+	}()
+	waitOffset(t, c, "workers-keyed", "s", 40)
+	cancel()
+	<-done
+	assert.Equal(t, 4, len(handled))
+	for key, offsets := range handled {
+		assert.Equal(t, 10, len(offsets), key)
+		for i := 1; i < len(offsets); i++ {
+			assert.True(t, offsets[i-1] < offsets[i], key)
+		}
+	}
+	assert.True(t, most > 1)
+}
+
+func TestHTTPClient_workersCommitInOrder(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("workers-ordered", [][]byte{[]byte("0"), []byte("1"), []byte("2"), []byte("3"), []byte("4")}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	var others sync.WaitGroup
+	others.Add(4)
+	go c.SubscribeMessages(ctx, "workers-ordered", "s", func(msg push.ReceivedMessage) error {
+		if msg.Offset == 0 {
+			<-release
+			return nil
+		}
+		others.Done()
+		return nil
+	}, push.SubscribeWorkers(2, false))
+	others.Wait()
+	// the later messages are handled, but not the first one
+	time.Sleep(20 * time.Millisecond)
+	var offset int64
+	assert.Nil(t, c.OffsetStorage.GetOffset(context.Background(), "workers-ordered", "s", &offset))
+	assert.Equal(t, int64(0), offset)
+	close(release)
+	waitOffset(t, c, "workers-ordered", "s", 5)
+}
+
+func TestHTTPClient_workersRetryFailed(t *testing.T) {
+	srv := httptest.NewServer(push.NewHTTPHandler(push.NewMemoryStorage(), logf.New()))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("workers-failing", [][]byte{[]byte("0"), []byte("1"), []byte("2"), []byte("3")}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var (
+		handled []int64
+		failed  bool
+	)
+	err := c.SubscribeMessages(ctx, "workers-failing", "s", func(msg push.ReceivedMessage) error {
+		if msg.Offset == 2 && !failed {
+			failed = true
+			return errors.New("try again")
+		}
+		handled = append(handled, msg.Offset)
+		if msg.Offset == 3 {
+			cancel()
+		}
+		return nil
+	}, push.SubscribeReconnect(fastReconnect))
+	assert.True(t, errors.Is(err, context.Canceled))
+	// the stream resumed from the message failing
+	assert.Equal(t, []int64{0, 1, 2, 3}, handled)
+
+	permanent := errors.New("poison")
+	r := fastReconnect
+	r.Permanent = func(err error) bool { return errors.Is(err, permanent) }
+	err = c.SubscribeMessages(context.Background(), "workers-failing", "other", func(msg push.ReceivedMessage) error {
+		return permanent
+	}, push.SubscribeReconnect(r))
+	assert.True(t, errors.Is(err, permanent))
+}
+
+func TestHTTPClient_workersCredit(t *testing.T) {
+	h := push.NewHTTPHandler(push.NewMemoryStorage(), logf.New())
+	var granted atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/credit") {
+			granted.Add(1)
+		}
+		h.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	c := &push.HTTPClient{Endpoint: srv.URL}
+	assert.Nil(t, c.Push("workers-credited", [][]byte{[]byte("0"), []byte("1")}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handling := make(chan struct{}, 2)
+	release := make(chan struct{})
+	go c.SubscribeMessages(ctx, "workers-credited", "s", func(msg push.ReceivedMessage) error {
+		handling <- struct{}{}
+		<-release
+		return nil
+	}, push.SubscribeWorkers(2, false), push.SubscribeCredit(1))
+	<-handling
+	<-handling
+	// the batch is queued, but its credit waits for it to be handled
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(0), granted.Load())
+	close(release)
+	waitOffset(t, c, "workers-credited", "s", 2)
+	deadline := time.Now().Add(5 * time.Second)
+	for granted.Load() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, int32(1), granted.Load())
+}